@@ -3,759 +3,498 @@ package main
 import (
 	"errors"
 	"fmt"
-	"reflect"
-	"strconv"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/echojc/gbasm/sm83"
 )
 
-func Assemble(insns []Insn) ([]uint8, []int, error) {
+// Assemble reports every insn that fails rather than just the first. The
+// bytes are only meaningful if none did.
+func Assemble(insns []Insn) ([]uint8, []int, Diagnostics) {
 	out := make([]uint8, 0, len(insns))
 	offsets := make([]int, len(insns))
+	diags := Diagnostics{}
 
 	for i, insn := range insns {
+		offsets[i] = len(out)
 		asm, err := assembleInsn(&insn)
-		if err != nil {
-			return nil, nil, err
+		if argErr, isArgErr := err.(*argError); isArgErr {
+			diags.add(tokenError(insn.Pos, insn.sourceArg(argErr.arg), argErr.Error()))
+			continue
+		} else if err != nil {
+			diags.add(posError(insn.Pos, err.Error()))
+			continue
 		}
-		offsets[i] = len(out)
 		out = append(out, asm...)
 	}
 
-	return out, offsets[:], nil
+	return out, offsets, diags
+}
+
+// argError is an error in one arg rather than the insn as a whole
+type argError struct {
+	arg string
+	err error
+}
+
+func (e *argError) Error() string {
+	return e.err.Error()
 }
 
 func assembleInsn(insn *Insn) ([]uint8, error) {
 	switch insn.Name {
-	case "ld":
-		if len(insn.Args) == 2 {
-			addrHi, errAddrHi := asmAddr16(insn.Args[0])
-			addrLo, errAddrLo := asmAddr16(insn.Args[1])
-			reg16Hi, errReg16Hi := asmReg16(insn.Args[0])
-			num16Lo, errNum16Lo := asmUint16(insn.Args[1])
-			addrRegHi, errAddrRegHi := asmAddrReg(insn.Args[0])
-			addrRegLo, errAddrRegLo := asmAddrReg(insn.Args[1])
-			reg8Hi, errReg8Hi := asmReg8Hi(insn.Args[0])
-			reg8Lo, errReg8Lo := asmReg8Lo(insn.Args[1])
-			num8Lo, errNum8Lo := asmUint8(insn.Args[1])
-
-			switch {
-			case errReg8Hi == nil && errReg8Lo == nil:
-				return []uint8{0x40 | reg8Hi | reg8Lo}, nil
-			case errReg8Hi == nil && errNum8Lo == nil:
-				return []uint8{0x06 | reg8Hi, num8Lo}, nil
-			case errReg16Hi == nil && errNum16Lo == nil:
-				return []uint8{0x01 | reg16Hi, uint8(num16Lo & 0xff), uint8(num16Lo >> 8)}, nil
-			case errAddrRegHi == nil && insn.Args[1] == "a":
-				return []uint8{0x02 | addrRegHi}, nil
-			case insn.Args[0] == "a" && errAddrRegLo == nil:
-				return []uint8{0x0a | addrRegLo}, nil
-			case insn.Args[0] == "a" && errAddrLo == nil:
-				return []uint8{0xfa, uint8(addrLo & 0xff), uint8(addrLo >> 8)}, nil
-			case errAddrHi == nil && insn.Args[1] == "a":
-				return []uint8{0xea, uint8(addrHi & 0xff), uint8(addrHi >> 8)}, nil
-			case errAddrHi == nil && insn.Args[1] == "sp":
-				return []uint8{0x08, uint8(addrHi & 0xff), uint8(addrHi >> 8)}, nil
-			case insn.Args[0] == "sp" && insn.Args[1] == "hl":
-				return []uint8{0xf9}, nil
-			default:
-				insn.Err = errors.New(fmt.Sprintf("ld has invalid args"))
-				return nil, insn
-			}
-		} else {
-			return nil, insn.expectedNumberArgs(2)
-		}
-	case "ldi":
-		if reflect.DeepEqual(insn.Args, []string{"(hl)", "a"}) {
-			return []uint8{0x22}, nil
-		} else if reflect.DeepEqual(insn.Args, []string{"a", "(hl)"}) {
-			return []uint8{0x2a}, nil
-		} else {
-			validArgs := []string{"(hl), a", "a, (hl)"}
-			insn.Err = errors.New(fmt.Sprintf("ldi expects %s only", validArgs))
-			return nil, insn
-		}
-	case "ldd":
-		if reflect.DeepEqual(insn.Args, []string{"(hl)", "a"}) {
-			return []uint8{0x32}, nil
-		} else if reflect.DeepEqual(insn.Args, []string{"a", "(hl)"}) {
-			return []uint8{0x3a}, nil
-		} else {
-			validArgs := []string{"(hl), a", "a, (hl)"}
-			insn.Err = errors.New(fmt.Sprintf("ldd expects %s only", validArgs))
-			return nil, insn
-		}
-	case "ldh":
-		if reflect.DeepEqual(insn.Args, []string{"a", "(c)"}) {
-			return []uint8{0xf2}, nil
-		} else if reflect.DeepEqual(insn.Args, []string{"(c)", "a"}) {
-			return []uint8{0xe2}, nil
-		} else if len(insn.Args) == 2 && insn.Args[0] == "a" {
-			addr, err := asmAddr8(insn.Args[1])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			return []uint8{0xf0, addr}, nil
-		} else if len(insn.Args) == 2 && insn.Args[1] == "a" {
-			addr, err := asmAddr8(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			return []uint8{0xe0, addr}, nil
-		} else {
-			validArgs := []string{"(c), a", "a, (c)", "(n), a", "a, (n)"}
-			insn.Err = errors.New(fmt.Sprintf("ldd expects %s only", validArgs))
-			return nil, insn
-		}
-	case "ldhl":
-		if len(insn.Args) == 2 && insn.Args[0] == "sp" {
-			num, err := asmInt8(insn.Args[1])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			return []uint8{0xf8, uint8(num)}, nil
-		} else {
-			validArgs := []string{"sp, n"}
-			insn.Err = errors.New(fmt.Sprintf("ldhl expects %s only", validArgs))
-			return nil, insn
-		}
-	case "inc":
-		if len(insn.Args) == 1 {
-			reg8, err1 := asmReg8Hi(insn.Args[0])
-			if err1 != nil {
-				reg16, err2 := asmReg16(insn.Args[0])
-				if err2 != nil {
-					insn.Err = errors.New(fmt.Sprintf("%s or %s", err1.Error(), err2.Error()))
-					return nil, insn
-				}
-				return []uint8{0x03 | reg16}, nil
-			}
-			return []uint8{0x04 | reg8}, nil
-		} else {
-			return nil, insn.expectedNumberArgs(1)
-		}
-	case "dec":
-		if len(insn.Args) == 1 {
-			reg8, err1 := asmReg8Hi(insn.Args[0])
-			if err1 != nil {
-				reg16, err2 := asmReg16(insn.Args[0])
-				if err2 != nil {
-					insn.Err = errors.New(fmt.Sprintf("%s or %s", err1.Error(), err2.Error()))
-					return nil, insn
-				}
-				return []uint8{0x0b | reg16}, nil
-			}
-			return []uint8{0x05 | reg8}, nil
-		} else {
+	case "db":
+		if len(insn.Args) == 0 {
 			return nil, insn.expectedNumberArgs(1)
 		}
-	case "add":
-		if len(insn.Args) == 2 {
-			switch insn.Args[0] {
-			case "hl":
-				reg, err := asmReg16(insn.Args[1])
-				if err != nil {
-					insn.Err = err
-					return nil, insn
-				}
-				return []uint8{0x09 | reg}, nil
-			case "sp":
-				num, err := asmInt8(insn.Args[1])
+		out := make([]uint8, 0, len(insn.Args))
+		for _, arg := range insn.Args {
+			if isString(arg) {
+				str, err := asmString(arg)
 				if err != nil {
-					insn.Err = err
-					return nil, insn
-				}
-				return []uint8{0xe8, uint8(num)}, nil
-			case "a":
-				reg, err1 := asmReg8Lo(insn.Args[1])
-				if err1 != nil {
-					num, err2 := asmUint8(insn.Args[1])
-					if err2 != nil {
-						insn.Err = errors.New(fmt.Sprintf("%s or %s", err1.Error(), err2.Error()))
-						return nil, insn
-					}
-					return []uint8{0xc6, num}, nil
-				} else {
-					return []uint8{0x80 | reg}, nil
-				}
-			default:
-				validArgs := []string{"hl", "sp", "a"}
-				insn.Err = errors.New(fmt.Sprintf("add expects %d as first arg", validArgs))
-			}
-		} else {
-			return nil, insn.expectedNumberArgs(2)
-		}
-	case "adc":
-		if len(insn.Args) == 2 {
-			if insn.Args[0] == "a" {
-				reg, err1 := asmReg8Lo(insn.Args[1])
-				if err1 != nil {
-					num, err2 := asmUint8(insn.Args[1])
-					if err2 != nil {
-						insn.Err = errors.New(fmt.Sprintf("%s or %s", err1.Error(), err2.Error()))
-						return nil, insn
-					}
-					return []uint8{0xce, num}, nil
-				} else {
-					return []uint8{0x88 | reg}, nil
-				}
-			} else {
-				validArgs := []string{"a"}
-				insn.Err = errors.New(fmt.Sprintf("adc expects %d as first arg", validArgs))
-			}
-		} else {
-			return nil, insn.expectedNumberArgs(2)
-		}
-	case "sub":
-		if len(insn.Args) == 2 {
-			if insn.Args[0] == "a" {
-				reg, err1 := asmReg8Lo(insn.Args[1])
-				if err1 != nil {
-					num, err2 := asmUint8(insn.Args[1])
-					if err2 != nil {
-						insn.Err = errors.New(fmt.Sprintf("%s or %s", err1.Error(), err2.Error()))
-						return nil, insn
-					}
-					return []uint8{0xd6, num}, nil
-				} else {
-					return []uint8{0x90 | reg}, nil
-				}
-			} else {
-				validArgs := []string{"a"}
-				insn.Err = errors.New(fmt.Sprintf("sub expects %d as first arg", validArgs))
-			}
-		} else {
-			return nil, insn.expectedNumberArgs(2)
-		}
-	case "sbc":
-		if len(insn.Args) == 2 {
-			if insn.Args[0] == "a" {
-				reg, err1 := asmReg8Lo(insn.Args[1])
-				if err1 != nil {
-					num, err2 := asmUint8(insn.Args[1])
-					if err2 != nil {
-						insn.Err = errors.New(fmt.Sprintf("%s or %s", err1.Error(), err2.Error()))
-						return nil, insn
-					}
-					return []uint8{0xde, num}, nil
-				} else {
-					return []uint8{0x98 | reg}, nil
-				}
-			} else {
-				validArgs := []string{"a"}
-				insn.Err = errors.New(fmt.Sprintf("sub expects %d as first arg", validArgs))
-			}
-		} else {
-			return nil, insn.expectedNumberArgs(2)
-		}
-	case "and":
-		if len(insn.Args) == 1 {
-			reg, err1 := asmReg8Lo(insn.Args[0])
-			if err1 != nil {
-				num, err2 := asmUint8(insn.Args[0])
-				if err2 != nil {
-					insn.Err = errors.New(fmt.Sprintf("%s or %s", err1.Error(), err2.Error()))
-					return nil, insn
-				}
-				return []uint8{0xe6, num}, nil
-			} else {
-				return []uint8{0xa0 | reg}, nil
-			}
-		} else {
-			return nil, insn.expectedNumberArgs(1)
-		}
-	case "xor":
-		if len(insn.Args) == 1 {
-			reg, err1 := asmReg8Lo(insn.Args[0])
-			if err1 != nil {
-				num, err2 := asmUint8(insn.Args[0])
-				if err2 != nil {
-					insn.Err = errors.New(fmt.Sprintf("%s or %s", err1.Error(), err2.Error()))
-					return nil, insn
+					return nil, &argError{arg, err}
 				}
-				return []uint8{0xee, num}, nil
+				out = append(out, str...)
 			} else {
-				return []uint8{0xa8 | reg}, nil
-			}
-		} else {
-			return nil, insn.expectedNumberArgs(1)
-		}
-	case "or":
-		if len(insn.Args) == 1 {
-			reg, err1 := asmReg8Lo(insn.Args[0])
-			if err1 != nil {
-				num, err2 := asmUint8(insn.Args[0])
-				if err2 != nil {
-					insn.Err = errors.New(fmt.Sprintf("%s or %s", err1.Error(), err2.Error()))
-					return nil, insn
+				num, err := asmUint8(arg)
+				if err != nil {
+					return nil, &argError{arg, err}
 				}
-				return []uint8{0xf6, num}, nil
-			} else {
-				return []uint8{0xb0 | reg}, nil
+				out = append(out, num)
 			}
-		} else {
-			return nil, insn.expectedNumberArgs(1)
 		}
-	case "cp":
-		if len(insn.Args) == 1 {
-			reg, err1 := asmReg8Lo(insn.Args[0])
-			if err1 != nil {
-				num, err2 := asmUint8(insn.Args[0])
-				if err2 != nil {
-					insn.Err = errors.New(fmt.Sprintf("%s or %s", err1.Error(), err2.Error()))
-					return nil, insn
-				}
-				return []uint8{0xfe, num}, nil
-			} else {
-				return []uint8{0xb8 | reg}, nil
-			}
-		} else {
+		return out, nil
+	case "dw":
+		if len(insn.Args) == 0 {
 			return nil, insn.expectedNumberArgs(1)
 		}
-	case "rlca":
-		return []uint8{0x07}, nil
-	case "rla":
-		return []uint8{0x17}, nil
-	case "rrca":
-		return []uint8{0x0f}, nil
-	case "rra":
-		return []uint8{0x1f}, nil
-	case "jr":
-		switch len(insn.Args) {
-		case 1:
-			addr, err := asmInt8(insn.Args[0])
+		out := make([]uint8, 0, len(insn.Args)*2)
+		for _, arg := range insn.Args {
+			num, err := asmUint16(arg)
 			if err != nil {
-				insn.Err = err
-				return nil, insn
+				return nil, &argError{arg, err}
 			}
-			return []uint8{0x18, uint8(addr)}, nil
-		case 2:
-			cond, err := asmCond(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			addr, err := asmInt8(insn.Args[1])
+			out = append(out, uint8(num&0xff), uint8(num>>8))
+		}
+		return out, nil
+	case "ds":
+		if len(insn.Args) == 1 || len(insn.Args) == 2 {
+			count, err := asmNumber(insn.Args[0])
 			if err != nil {
-				insn.Err = err
-				return nil, insn
+				return nil, &argError{insn.Args[0], err}
+			} else if count < 0 || count > 0x10000 {
+				return nil, &argError{insn.Args[0], errors.New(fmt.Sprintf("ds count %d is out of range", count))}
 			}
-			return []uint8{0x20 | cond, uint8(addr)}, nil
-		default:
-			return nil, insn.expectedNumberArgs(1, 2)
-		}
-	case "jp":
-		switch len(insn.Args) {
-		case 1:
-			if insn.Args[0] == "hl" {
-				return []uint8{0xe9}, nil
-			} else {
-				addr, err := asmUint16(insn.Args[0])
+
+			var fill uint8
+			if len(insn.Args) == 2 {
+				fill, err = asmUint8(insn.Args[1])
 				if err != nil {
-					insn.Err = err
-					return nil, insn
+					return nil, &argError{insn.Args[1], err}
 				}
-				return []uint8{0xc3, uint8(addr & 0xff), uint8(addr >> 8)}, nil
-			}
-		case 2:
-			cond, err := asmCond(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
 			}
-			addr, err := asmUint16(insn.Args[1])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
+
+			out := make([]uint8, count)
+			for i := range out {
+				out[i] = fill
 			}
-			return []uint8{0xc2 | cond, uint8(addr & 0xff), uint8(addr >> 8)}, nil
-		default:
+			return out, nil
+		} else {
 			return nil, insn.expectedNumberArgs(1, 2)
 		}
-	case "daa":
-		return []uint8{0x27}, nil
-	case "cpl":
-		return []uint8{0x2f}, nil
-	case "scf":
-		return []uint8{0x37}, nil
-	case "ccf":
-		return []uint8{0x3f}, nil
-	case "push":
-		if len(insn.Args) == 1 {
-			reg, err := asmReg16PushPop(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			return []uint8{0xc5 | reg}, nil
-		} else {
-			return nil, insn.expectedNumberArgs(1)
+	}
+
+	name, args := canonicalInsn(insn.Name, insn.Args)
+	opcodes := sm83.Lookup(name)
+	if len(opcodes) == 0 {
+		return nil, errors.New(fmt.Sprintf("unknown instruction '%s'", insn.Name))
+	}
+
+	// the first opcode whose operands fit wins. If some opcode's registers
+	// matched but its values didn't (e.g. 'ld a, 300'), that's the most
+	// useful error to report.
+	var firstErr error
+	argCounts := make([]uint, 0)
+	countMatched := false
+	for _, opcode := range opcodes {
+		if len(opcode.Operands) != len(args) {
+			if !containsUint(argCounts, uint(len(opcode.Operands))) {
+				argCounts = append(argCounts, uint(len(opcode.Operands)))
+			}
+			continue
 		}
-	case "pop":
-		if len(insn.Args) == 1 {
-			reg, err := asmReg16PushPop(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			return []uint8{0xc1 | reg}, nil
-		} else {
-			return nil, insn.expectedNumberArgs(1)
+
+		countMatched = true
+		out, matched, err := encodeOpcode(opcode, args)
+		if err == nil {
+			return out, nil
+		} else if matched && firstErr == nil {
+			firstErr = err
 		}
-	case "call":
-		switch len(insn.Args) {
-		case 1:
-			addr, err := asmUint16(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			return []uint8{0xcd, uint8(addr & 0xff), uint8(addr >> 8)}, nil
-		case 2:
-			cond, err := asmCond(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			addr, err := asmUint16(insn.Args[1])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			return []uint8{0xc4 | cond, uint8(addr & 0xff), uint8(addr >> 8)}, nil
-		default:
-			return nil, insn.expectedNumberArgs(1, 2)
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	} else if !countMatched {
+		sort.Slice(argCounts, func(i, j int) bool { return argCounts[i] < argCounts[j] })
+		return nil, insn.expectedNumberArgs(argCounts...)
+	}
+	return nil, errors.New(fmt.Sprintf("'%s %s' is not a valid instruction", insn.Name, strings.Join(insn.sourceArgs(), ", ")))
+}
+
+// sourceArgs are the args as they were written, if they're known
+func (insn *Insn) sourceArgs() []string {
+	if len(insn.SourceArgs) != len(insn.Args) {
+		return insn.Args
+	}
+	return insn.SourceArgs
+}
+
+func (insn *Insn) sourceArg(arg string) string {
+	for i, sourceArg := range insn.sourceArgs() {
+		if insn.Args[i] == arg {
+			return sourceArg
 		}
-	case "ret":
-		switch len(insn.Args) {
-		case 0:
-			return []uint8{0xc9}, nil
-		case 1:
-			cond, err := asmCond(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			return []uint8{0xc0 | cond}, nil
-		default:
-			return nil, insn.expectedNumberArgs(0, 1)
+	}
+	return arg
+}
+
+// canonicalInsn rewrites alternative spellings of instructions into the
+// form that's in the opcode table.
+func canonicalInsn(name string, insnArgs []string) (string, []string) {
+	args := make([]string, len(insnArgs))
+	for i, arg := range insnArgs {
+		args[i] = canonicalArg(arg)
+	}
+
+	switch name {
+	case "add", "adc", "sbc":
+		// 'add b' is short for 'add a, b'
+		if len(args) == 1 {
+			args = []string{"a", args[0]}
 		}
-	case "reti":
-		return []uint8{0xd9}, nil
-	case "di":
-		return []uint8{0xf3}, nil
-	case "ei":
-		return []uint8{0xfb}, nil
-	case "rst":
-		if len(insn.Args) == 1 {
-			addr, err := asmUint16(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			} else if addr > 0x38 || addr%0x08 != 0 {
-				validAddrs := []string{"$00", "$08", "$10", "$18", "$20", "$28", "$30", "$38"}
-				insn.Err = errors.New(fmt.Sprintf("rst expects %d only", validAddrs))
-				return nil, insn
-			}
-			return []uint8{0xc7 | uint8(addr)}, nil
-		} else {
-			return nil, insn.expectedNumberArgs(1)
+	case "sub", "and", "xor", "or", "cp":
+		// 'sub a, b' is the long form of 'sub b'
+		if len(args) == 2 && args[0] == "a" {
+			args = args[1:]
 		}
-	case "halt":
-		return []uint8{0x76, 0x00}, nil
-	case "stop":
-		return []uint8{0x10, 0x00}, nil
-	case "rlc":
-		if len(insn.Args) == 1 {
-			reg, err := asmReg8Lo(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			return []uint8{0xcb, 0x00 | reg}, nil
-		} else {
-			return nil, insn.expectedNumberArgs(1)
+	case "ldi", "ldd":
+		suffix := "+"
+		if name == "ldd" {
+			suffix = "-"
 		}
-	case "rl":
-		if len(insn.Args) == 1 {
-			reg, err := asmReg8Lo(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
+		for i, arg := range args {
+			if arg == "(hl)" {
+				args[i] = "(hl" + suffix + ")"
 			}
-			return []uint8{0xcb, 0x10 | reg}, nil
-		} else {
-			return nil, insn.expectedNumberArgs(1)
 		}
-	case "rrc":
-		if len(insn.Args) == 1 {
-			reg, err := asmReg8Lo(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			return []uint8{0xcb, 0x08 | reg}, nil
-		} else {
-			return nil, insn.expectedNumberArgs(1)
+		name = "ld"
+	case "ldh":
+		if len(args) == 2 && (args[0] == "(c)" || args[1] == "(c)") {
+			name = "ld"
 		}
-	case "rr":
-		if len(insn.Args) == 1 {
-			reg, err := asmReg8Lo(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			return []uint8{0xcb, 0x18 | reg}, nil
-		} else {
-			return nil, insn.expectedNumberArgs(1)
+	case "ldhl":
+		if len(args) == 2 && args[0] == "sp" {
+			name = "ld"
+			args = []string{"hl", "sp+" + args[1]}
 		}
-	case "sla":
-		if len(insn.Args) == 1 {
-			reg, err := asmReg8Lo(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			return []uint8{0xcb, 0x20 | reg}, nil
-		} else {
-			return nil, insn.expectedNumberArgs(1)
+	case "jp":
+		if len(args) == 1 && args[0] == "(hl)" {
+			args[0] = "hl"
 		}
-	case "sra":
-		if len(insn.Args) == 1 {
-			reg, err := asmReg8Lo(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
+	}
+	return name, args
+}
+
+// encodeOpcode assembles args as the operands of opcode. matched is true if
+// every register matched and only a value was out of range or invalid.
+func encodeOpcode(opcode *sm83.Opcode, args []string) ([]uint8, bool, error) {
+	out := make([]uint8, 0, opcode.Length)
+	if opcode.Prefixed {
+		out = append(out, 0xcb)
+	}
+	out = append(out, opcode.Code)
+
+	var valueErr error
+	for i, operand := range opcode.Operands {
+		arg := args[i]
+		if !sm83.IsPlaceholder(operand) {
+			if fixed, isFixed := sm83.FixedValue(operand); isFixed {
+				value, err := asmNumber(arg)
+				if err != nil && valueErr == nil {
+					valueErr = &argError{arg, err}
+				} else if err == nil && value != fixed {
+					return nil, false, errors.New(fmt.Sprintf("expected %s", operand))
+				}
+			} else if arg != operand {
+				return nil, false, errors.New(fmt.Sprintf("expected %s", operand))
 			}
-			return []uint8{0xcb, 0x28 | reg}, nil
-		} else {
-			return nil, insn.expectedNumberArgs(1)
+			continue
 		}
-	case "swap":
-		if len(insn.Args) == 1 {
-			reg, err := asmReg8Lo(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			return []uint8{0xcb, 0x30 | reg}, nil
-		} else {
-			return nil, insn.expectedNumberArgs(1)
+
+		if !fitsPlaceholder(operand, arg) {
+			return nil, false, errors.New(fmt.Sprintf("expected %s", operand))
 		}
-	case "srl":
-		if len(insn.Args) == 1 {
-			reg, err := asmReg8Lo(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			return []uint8{0xcb, 0x38 | reg}, nil
-		} else {
-			return nil, insn.expectedNumberArgs(1)
+		bytes, err := asmPlaceholder(operand, arg)
+		if err != nil && valueErr == nil {
+			valueErr = &argError{arg, err}
 		}
-	case "bit":
-		if len(insn.Args) == 2 {
-			bit, err := asmBit(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			reg, err := asmReg8Lo(insn.Args[1])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			return []uint8{0xcb, 0x40 | bit | reg}, nil
-		} else {
-			return nil, insn.expectedNumberArgs(2)
+		out = append(out, bytes...)
+	}
+
+	if valueErr != nil {
+		return nil, true, valueErr
+	}
+
+	// e.g. stop, which is followed by a $00
+	for len(out) < opcode.Length {
+		out = append(out, 0x00)
+	}
+	return out, true, nil
+}
+
+// fitsPlaceholder is whether arg has the right shape for a placeholder:
+// parens for addresses and no registers.
+func fitsPlaceholder(operand string, arg string) bool {
+	if sm83.IsKeyword(arg) {
+		return false
+	}
+
+	switch operand {
+	case sm83.Mem8, sm83.Mem16:
+		if !isMemOperand(arg) {
+			return false
 		}
-	case "res":
-		if len(insn.Args) == 2 {
-			bit, err := asmBit(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			reg, err := asmReg8Lo(insn.Args[1])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			return []uint8{0xcb, 0x80 | bit | reg}, nil
-		} else {
-			return nil, insn.expectedNumberArgs(2)
+		arg = arg[1 : len(arg)-1]
+	case sm83.SPOffset:
+		if !isSPOffset(arg) {
+			return false
 		}
-	case "set":
-		if len(insn.Args) == 2 {
-			bit, err := asmBit(insn.Args[0])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
-			}
-			reg, err := asmReg8Lo(insn.Args[1])
-			if err != nil {
-				insn.Err = err
-				return nil, insn
+		arg = arg[2:]
+	default:
+		if isMemOperand(arg) {
+			return false
+		}
+	}
+
+	// expressions that don't parse are still numbers, just broken ones
+	if expr, err := ParseExpr(arg); err == nil {
+		for _, name := range expr.SymbolNames() {
+			if isSpecialName(name) {
+				return false
 			}
-			return []uint8{0xcb, 0xc0 | bit | reg}, nil
-		} else {
-			return nil, insn.expectedNumberArgs(2)
 		}
-	case "nop":
-		return []uint8{0x00}, nil
 	}
+	return true
+}
 
-	insn.Err = errors.New(fmt.Sprintf("unknown instruction '%s'", insn.Name))
-	return nil, insn
+func asmPlaceholder(operand string, arg string) ([]uint8, error) {
+	switch operand {
+	case sm83.Imm8:
+		num, err := asmUint8(arg)
+		return []uint8{num}, err
+	case sm83.Imm16, sm83.Addr16:
+		num, err := asmUint16(arg)
+		return []uint8{uint8(num & 0xff), uint8(num >> 8)}, err
+	case sm83.Mem8:
+		addr, err := asmHighAddr(arg)
+		return []uint8{addr}, err
+	case sm83.Mem16:
+		addr, err := asmAddr16(arg)
+		return []uint8{uint8(addr & 0xff), uint8(addr >> 8)}, err
+	case sm83.Offset8, sm83.Rel8:
+		num, err := asmInt8(arg)
+		return []uint8{uint8(num)}, err
+	case sm83.SPOffset:
+		num, err := asmInt8(arg[2:])
+		return []uint8{uint8(num)}, err
+	}
+	return nil, errors.New(fmt.Sprintf("unknown operand type '%s'", operand))
 }
 
-func asmCond(cond string) (uint8, error) {
-	switch cond {
-	case "nz":
-		return 0 << 3, nil
-	case "z":
-		return 1 << 3, nil
-	case "nc":
-		return 2 << 3, nil
-	case "c":
-		return 3 << 3, nil
+func containsUint(values []uint, value uint) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// argOffset is the offset of an arg's value in the assembled insn. For
+// instructions that's always just after the opcode, but db and dw can have
+// many values.
+func argOffset(insn *Insn, argIndex int) int {
+	switch insn.Name {
+	case "db":
+		offset := 0
+		for _, arg := range insn.Args[:argIndex] {
+			if str, err := asmString(arg); err == nil && isString(arg) {
+				offset += len(str)
+			} else {
+				offset++
+			}
+		}
+		return offset
+	case "dw":
+		return argIndex * 2
 	default:
-		validConds := []string{"nz", "z", "nc", "c"}
-		return 0xff, errors.New(fmt.Sprintf("unknown condition '%s', expected %s", cond, validConds))
+		return 1
 	}
 }
 
-func asmAddr8(addr string) (uint8, error) {
-	if addr[0] == '(' && addr[len(addr)-1] == ')' {
-		return asmUint8(addr[1 : len(addr)-1])
-	} else {
+func isString(arg string) bool {
+	return len(arg) > 0 && arg[0] == '"'
+}
+
+func asmString(arg string) ([]uint8, error) {
+	if len(arg) < 2 || arg[0] != '"' || arg[len(arg)-1] != '"' {
+		return nil, errors.New(fmt.Sprintf("unterminated string %s", arg))
+	}
+
+	out := make([]uint8, 0, len(arg))
+	for i := 1; i < len(arg)-1; i++ {
+		c := arg[i]
+		if c != '\\' {
+			out = append(out, c)
+			continue
+		}
+
+		i++
+		if i == len(arg)-1 {
+			return nil, errors.New(fmt.Sprintf("unterminated string %s", arg))
+		}
+		switch arg[i] {
+		case 'n':
+			out = append(out, '\n')
+		case 't':
+			out = append(out, '\t')
+		case '0':
+			out = append(out, 0)
+		case '\\', '"':
+			out = append(out, arg[i])
+		default:
+			return nil, errors.New(fmt.Sprintf("unknown escape '\\%c' in string", arg[i]))
+		}
+	}
+	return out, nil
+}
+
+// asmHighAddr is an address in the $ff00 page, either as the full address
+// or just the low byte.
+func asmHighAddr(addr string) (uint8, error) {
+	if !isMemOperand(addr) {
 		return 0xff, errors.New("expected address in parens")
 	}
+	value, err := asmNumber(addr[1 : len(addr)-1])
+	if err != nil {
+		return 0xff, err
+	} else if value >= 0xff00 && value <= 0xffff {
+		return uint8(value), nil
+	} else if value < 0 || value > 0xff {
+		return 0xff, errors.New(fmt.Sprintf("address %d is not in $ff00-$ffff", value))
+	}
+	return uint8(value), nil
 }
 
 func asmAddr16(addr string) (uint16, error) {
-	if addr[0] == '(' && addr[len(addr)-1] == ')' {
+	if isMemOperand(addr) {
 		return asmUint16(addr[1 : len(addr)-1])
 	} else {
 		return 0xff, errors.New("expected address in parens")
 	}
 }
 
-func asmAddrReg(reg string) (uint8, error) {
-	if reg[0] == '(' && reg[len(reg)-1] == ')' {
-		switch reg[1 : len(reg)-1] {
-		case "bc":
-			return 0 << 4, nil
-		case "de":
-			return 1 << 4, nil
-		}
-	}
-	validRegs := []string{"bc", "de"}
-	return 0xff, errors.New(fmt.Sprintf("unknown register '%s', expected %s", reg, validRegs))
-}
-
 func asmUint16(num string) (uint16, error) {
-	if num[0] == '$' {
-		num, err := strconv.ParseUint(num[1:], 16, 16)
-		return uint16(num), err
-	} else {
-		num, err := strconv.ParseUint(num, 10, 16)
-		return uint16(num), err
+	value, err := asmNumber(num)
+	if err != nil {
+		return 0xff, err
+	} else if value < -0x8000 || value > 0xffff {
+		return 0xff, errors.New(fmt.Sprintf("value %d does not fit in 16 bits", value))
 	}
+	return uint16(value), nil
 }
 
 func asmUint8(num string) (uint8, error) {
-	if num[0] == '$' {
-		num, err := strconv.ParseUint(num[1:], 16, 8)
-		return uint8(num), err
-	} else {
-		num, err := strconv.ParseUint(num, 10, 8)
-		return uint8(num), err
+	value, err := asmNumber(num)
+	if err != nil {
+		return 0xff, err
+	} else if value < -0x80 || value > 0xff {
+		return 0xff, errors.New(fmt.Sprintf("value %d does not fit in 8 bits", value))
 	}
+	return uint8(value), nil
 }
 
 func asmInt8(num string) (int8, error) {
-	if num[0] == '$' {
-		num, err := strconv.ParseInt(num[1:], 16, 8)
-		return int8(num), err
-	} else {
-		num, err := strconv.ParseInt(num, 10, 8)
-		return int8(num), err
+	value, err := asmNumber(num)
+	if err != nil {
+		return 0x7f, err
+	} else if value < -0x80 || value > 0x7f {
+		return 0x7f, errors.New(fmt.Sprintf("value %d does not fit in a signed byte (-128..127)", value))
 	}
+	return int8(value), nil
 }
 
-func asmBit(num string) (uint8, error) {
-	bit, err := strconv.ParseUint(num, 10, 8)
-	if err != nil {
-		return 0xff, err
-	}
-	if bit > 7 {
-		return 0xff, errors.New("bit value must be 0..7 inclusive")
+// asmNumber evaluates a constant expression. Operands wrapped entirely in
+// parens are addresses, not numbers, so they're rejected here.
+func asmNumber(num string) (int, error) {
+	if isMemOperand(num) {
+		return 0, errors.New(fmt.Sprintf("expected a number but got address '%s'", num))
 	}
-	return uint8(bit) << 3, nil
+	return evalExpr(num)
 }
 
-func asmReg16PushPop(reg string) (uint8, error) {
-	switch reg {
-	case "bc":
-		return 0 << 4, nil
-	case "de":
-		return 1 << 4, nil
-	case "hl":
-		return 2 << 4, nil
-	case "af":
-		return 3 << 4, nil
-	default:
-		validRegs := []string{"bc", "de", "hl", "af"}
-		return 0xff, errors.New(fmt.Sprintf("unknown register '%s', expected %s", reg, validRegs))
+// canonicalArg maps alternative spellings of special operands onto the one
+// the assembler checks for.
+func canonicalArg(arg string) string {
+	compact := strings.Map(func(c rune) rune {
+		if unicode.IsSpace(c) {
+			return -1
+		}
+		return c
+	}, arg)
+
+	switch compact {
+	case "(hl+)", "(hli)":
+		return "(hl+)"
+	case "(hl-)", "(hld)":
+		return "(hl-)"
+	case "(c)", "($ff00+c)":
+		return "(c)"
+	case "(hl)", "(bc)", "(de)":
+		return compact
 	}
+	if isSPOffset(compact) {
+		return compact
+	}
+	return arg
 }
 
-func asmReg16(reg string) (uint8, error) {
-	switch reg {
-	case "bc":
-		return 0 << 4, nil
-	case "de":
-		return 1 << 4, nil
-	case "hl":
-		return 2 << 4, nil
-	case "sp":
-		return 3 << 4, nil
-	default:
-		validRegs := []string{"bc", "de", "hl", "sp"}
-		return 0xff, errors.New(fmt.Sprintf("unknown register '%s', expected %s", reg, validRegs))
-	}
+// isSPOffset is for 'sp+e' in 'ld hl, sp+e'
+func isSPOffset(arg string) bool {
+	return len(arg) > 3 && arg[:2] == "sp" && (arg[2] == '+' || arg[2] == '-')
 }
 
-func asmReg8Hi(reg string) (uint8, error) {
-	out, err := asmReg8Lo(reg)
-	if err != nil {
-		return 0xff, err
+func isMemOperand(arg string) bool {
+	if len(arg) < 2 || arg[0] != '(' || arg[len(arg)-1] != ')' {
+		return false
 	}
-	return out << 3, nil
-}
 
-func asmReg8Lo(reg string) (uint8, error) {
-	switch reg {
-	case "b":
-		return 0, nil
-	case "c":
-		return 1, nil
-	case "d":
-		return 2, nil
-	case "e":
-		return 3, nil
-	case "h":
-		return 4, nil
-	case "l":
-		return 5, nil
-	case "(hl)":
-		return 6, nil
-	case "a":
-		return 7, nil
-	default:
-		validRegs := []string{"b", "c", "d", "e", "h", "l", "(hl)", "a"}
-		return 0xff, errors.New(fmt.Sprintf("unknown register '%s', expected %s", reg, validRegs))
+	// make sure the opening paren isn't closed before the end, as in
+	// '(1 + 2) * 3'
+	depth := 0
+	for i, c := range arg {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 && i < len(arg)-1 {
+				return false
+			}
+		}
 	}
+	return true
 }
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// every legal unprefixed opcode, in opcode order ($cb is the prefix and the
+// 11 illegal opcodes are left out)
+var unprefixedReference = []struct {
+	text     string
+	expected []uint8
+}{
+	{"nop", []uint8{0x00}},
+	{"ld bc, $3456", []uint8{0x01, 0x56, 0x34}},
+	{"ld (bc), a", []uint8{0x02}},
+	{"inc bc", []uint8{0x03}},
+	{"inc b", []uint8{0x04}},
+	{"dec b", []uint8{0x05}},
+	{"ld b, $12", []uint8{0x06, 0x12}},
+	{"rlca", []uint8{0x07}},
+	{"ld ($3456), sp", []uint8{0x08, 0x56, 0x34}},
+	{"add hl, bc", []uint8{0x09}},
+	{"ld a, (bc)", []uint8{0x0a}},
+	{"dec bc", []uint8{0x0b}},
+	{"inc c", []uint8{0x0c}},
+	{"dec c", []uint8{0x0d}},
+	{"ld c, $12", []uint8{0x0e, 0x12}},
+	{"rrca", []uint8{0x0f}},
+	{"stop", []uint8{0x10, 0x00}},
+	{"ld de, $3456", []uint8{0x11, 0x56, 0x34}},
+	{"ld (de), a", []uint8{0x12}},
+	{"inc de", []uint8{0x13}},
+	{"inc d", []uint8{0x14}},
+	{"dec d", []uint8{0x15}},
+	{"ld d, $12", []uint8{0x16, 0x12}},
+	{"rla", []uint8{0x17}},
+	{"jr 5", []uint8{0x18, 0x05}},
+	{"add hl, de", []uint8{0x19}},
+	{"ld a, (de)", []uint8{0x1a}},
+	{"dec de", []uint8{0x1b}},
+	{"inc e", []uint8{0x1c}},
+	{"dec e", []uint8{0x1d}},
+	{"ld e, $12", []uint8{0x1e, 0x12}},
+	{"rra", []uint8{0x1f}},
+	{"jr nz, -3", []uint8{0x20, 0xfd}},
+	{"ld hl, $3456", []uint8{0x21, 0x56, 0x34}},
+	{"ld (hl+), a", []uint8{0x22}},
+	{"inc hl", []uint8{0x23}},
+	{"inc h", []uint8{0x24}},
+	{"dec h", []uint8{0x25}},
+	{"ld h, $12", []uint8{0x26, 0x12}},
+	{"daa", []uint8{0x27}},
+	{"jr z, -3", []uint8{0x28, 0xfd}},
+	{"add hl, hl", []uint8{0x29}},
+	{"ld a, (hl+)", []uint8{0x2a}},
+	{"dec hl", []uint8{0x2b}},
+	{"inc l", []uint8{0x2c}},
+	{"dec l", []uint8{0x2d}},
+	{"ld l, $12", []uint8{0x2e, 0x12}},
+	{"cpl", []uint8{0x2f}},
+	{"jr nc, -3", []uint8{0x30, 0xfd}},
+	{"ld sp, $3456", []uint8{0x31, 0x56, 0x34}},
+	{"ld (hl-), a", []uint8{0x32}},
+	{"inc sp", []uint8{0x33}},
+	{"inc (hl)", []uint8{0x34}},
+	{"dec (hl)", []uint8{0x35}},
+	{"ld (hl), $12", []uint8{0x36, 0x12}},
+	{"scf", []uint8{0x37}},
+	{"jr c, -3", []uint8{0x38, 0xfd}},
+	{"add hl, sp", []uint8{0x39}},
+	{"ld a, (hl-)", []uint8{0x3a}},
+	{"dec sp", []uint8{0x3b}},
+	{"inc a", []uint8{0x3c}},
+	{"dec a", []uint8{0x3d}},
+	{"ld a, $12", []uint8{0x3e, 0x12}},
+	{"ccf", []uint8{0x3f}},
+	{"ld b, b", []uint8{0x40}},
+	{"ld b, c", []uint8{0x41}},
+	{"ld b, d", []uint8{0x42}},
+	{"ld b, e", []uint8{0x43}},
+	{"ld b, h", []uint8{0x44}},
+	{"ld b, l", []uint8{0x45}},
+	{"ld b, (hl)", []uint8{0x46}},
+	{"ld b, a", []uint8{0x47}},
+	{"ld c, b", []uint8{0x48}},
+	{"ld c, c", []uint8{0x49}},
+	{"ld c, d", []uint8{0x4a}},
+	{"ld c, e", []uint8{0x4b}},
+	{"ld c, h", []uint8{0x4c}},
+	{"ld c, l", []uint8{0x4d}},
+	{"ld c, (hl)", []uint8{0x4e}},
+	{"ld c, a", []uint8{0x4f}},
+	{"ld d, b", []uint8{0x50}},
+	{"ld d, c", []uint8{0x51}},
+	{"ld d, d", []uint8{0x52}},
+	{"ld d, e", []uint8{0x53}},
+	{"ld d, h", []uint8{0x54}},
+	{"ld d, l", []uint8{0x55}},
+	{"ld d, (hl)", []uint8{0x56}},
+	{"ld d, a", []uint8{0x57}},
+	{"ld e, b", []uint8{0x58}},
+	{"ld e, c", []uint8{0x59}},
+	{"ld e, d", []uint8{0x5a}},
+	{"ld e, e", []uint8{0x5b}},
+	{"ld e, h", []uint8{0x5c}},
+	{"ld e, l", []uint8{0x5d}},
+	{"ld e, (hl)", []uint8{0x5e}},
+	{"ld e, a", []uint8{0x5f}},
+	{"ld h, b", []uint8{0x60}},
+	{"ld h, c", []uint8{0x61}},
+	{"ld h, d", []uint8{0x62}},
+	{"ld h, e", []uint8{0x63}},
+	{"ld h, h", []uint8{0x64}},
+	{"ld h, l", []uint8{0x65}},
+	{"ld h, (hl)", []uint8{0x66}},
+	{"ld h, a", []uint8{0x67}},
+	{"ld l, b", []uint8{0x68}},
+	{"ld l, c", []uint8{0x69}},
+	{"ld l, d", []uint8{0x6a}},
+	{"ld l, e", []uint8{0x6b}},
+	{"ld l, h", []uint8{0x6c}},
+	{"ld l, l", []uint8{0x6d}},
+	{"ld l, (hl)", []uint8{0x6e}},
+	{"ld l, a", []uint8{0x6f}},
+	{"ld (hl), b", []uint8{0x70}},
+	{"ld (hl), c", []uint8{0x71}},
+	{"ld (hl), d", []uint8{0x72}},
+	{"ld (hl), e", []uint8{0x73}},
+	{"ld (hl), h", []uint8{0x74}},
+	{"ld (hl), l", []uint8{0x75}},
+	{"halt", []uint8{0x76}},
+	{"ld (hl), a", []uint8{0x77}},
+	{"ld a, b", []uint8{0x78}},
+	{"ld a, c", []uint8{0x79}},
+	{"ld a, d", []uint8{0x7a}},
+	{"ld a, e", []uint8{0x7b}},
+	{"ld a, h", []uint8{0x7c}},
+	{"ld a, l", []uint8{0x7d}},
+	{"ld a, (hl)", []uint8{0x7e}},
+	{"ld a, a", []uint8{0x7f}},
+	{"add a, b", []uint8{0x80}},
+	{"add a, c", []uint8{0x81}},
+	{"add a, d", []uint8{0x82}},
+	{"add a, e", []uint8{0x83}},
+	{"add a, h", []uint8{0x84}},
+	{"add a, l", []uint8{0x85}},
+	{"add a, (hl)", []uint8{0x86}},
+	{"add a, a", []uint8{0x87}},
+	{"adc a, b", []uint8{0x88}},
+	{"adc a, c", []uint8{0x89}},
+	{"adc a, d", []uint8{0x8a}},
+	{"adc a, e", []uint8{0x8b}},
+	{"adc a, h", []uint8{0x8c}},
+	{"adc a, l", []uint8{0x8d}},
+	{"adc a, (hl)", []uint8{0x8e}},
+	{"adc a, a", []uint8{0x8f}},
+	{"sub b", []uint8{0x90}},
+	{"sub c", []uint8{0x91}},
+	{"sub d", []uint8{0x92}},
+	{"sub e", []uint8{0x93}},
+	{"sub h", []uint8{0x94}},
+	{"sub l", []uint8{0x95}},
+	{"sub (hl)", []uint8{0x96}},
+	{"sub a", []uint8{0x97}},
+	{"sbc a, b", []uint8{0x98}},
+	{"sbc a, c", []uint8{0x99}},
+	{"sbc a, d", []uint8{0x9a}},
+	{"sbc a, e", []uint8{0x9b}},
+	{"sbc a, h", []uint8{0x9c}},
+	{"sbc a, l", []uint8{0x9d}},
+	{"sbc a, (hl)", []uint8{0x9e}},
+	{"sbc a, a", []uint8{0x9f}},
+	{"and b", []uint8{0xa0}},
+	{"and c", []uint8{0xa1}},
+	{"and d", []uint8{0xa2}},
+	{"and e", []uint8{0xa3}},
+	{"and h", []uint8{0xa4}},
+	{"and l", []uint8{0xa5}},
+	{"and (hl)", []uint8{0xa6}},
+	{"and a", []uint8{0xa7}},
+	{"xor b", []uint8{0xa8}},
+	{"xor c", []uint8{0xa9}},
+	{"xor d", []uint8{0xaa}},
+	{"xor e", []uint8{0xab}},
+	{"xor h", []uint8{0xac}},
+	{"xor l", []uint8{0xad}},
+	{"xor (hl)", []uint8{0xae}},
+	{"xor a", []uint8{0xaf}},
+	{"or b", []uint8{0xb0}},
+	{"or c", []uint8{0xb1}},
+	{"or d", []uint8{0xb2}},
+	{"or e", []uint8{0xb3}},
+	{"or h", []uint8{0xb4}},
+	{"or l", []uint8{0xb5}},
+	{"or (hl)", []uint8{0xb6}},
+	{"or a", []uint8{0xb7}},
+	{"cp b", []uint8{0xb8}},
+	{"cp c", []uint8{0xb9}},
+	{"cp d", []uint8{0xba}},
+	{"cp e", []uint8{0xbb}},
+	{"cp h", []uint8{0xbc}},
+	{"cp l", []uint8{0xbd}},
+	{"cp (hl)", []uint8{0xbe}},
+	{"cp a", []uint8{0xbf}},
+	{"ret nz", []uint8{0xc0}},
+	{"pop bc", []uint8{0xc1}},
+	{"jp nz, $3456", []uint8{0xc2, 0x56, 0x34}},
+	{"jp $3456", []uint8{0xc3, 0x56, 0x34}},
+	{"call nz, $3456", []uint8{0xc4, 0x56, 0x34}},
+	{"push bc", []uint8{0xc5}},
+	{"add a, $12", []uint8{0xc6, 0x12}},
+	{"rst $00", []uint8{0xc7}},
+	{"ret z", []uint8{0xc8}},
+	{"ret", []uint8{0xc9}},
+	{"jp z, $3456", []uint8{0xca, 0x56, 0x34}},
+	{"call z, $3456", []uint8{0xcc, 0x56, 0x34}},
+	{"call $3456", []uint8{0xcd, 0x56, 0x34}},
+	{"adc a, $12", []uint8{0xce, 0x12}},
+	{"rst $08", []uint8{0xcf}},
+	{"ret nc", []uint8{0xd0}},
+	{"pop de", []uint8{0xd1}},
+	{"jp nc, $3456", []uint8{0xd2, 0x56, 0x34}},
+	{"call nc, $3456", []uint8{0xd4, 0x56, 0x34}},
+	{"push de", []uint8{0xd5}},
+	{"sub $12", []uint8{0xd6, 0x12}},
+	{"rst $10", []uint8{0xd7}},
+	{"ret c", []uint8{0xd8}},
+	{"reti", []uint8{0xd9}},
+	{"jp c, $3456", []uint8{0xda, 0x56, 0x34}},
+	{"call c, $3456", []uint8{0xdc, 0x56, 0x34}},
+	{"sbc a, $12", []uint8{0xde, 0x12}},
+	{"rst $18", []uint8{0xdf}},
+	{"ldh ($12), a", []uint8{0xe0, 0x12}},
+	{"pop hl", []uint8{0xe1}},
+	{"ld (c), a", []uint8{0xe2}},
+	{"push hl", []uint8{0xe5}},
+	{"and $12", []uint8{0xe6, 0x12}},
+	{"rst $20", []uint8{0xe7}},
+	{"add sp, -2", []uint8{0xe8, 0xfe}},
+	{"jp hl", []uint8{0xe9}},
+	{"ld ($3456), a", []uint8{0xea, 0x56, 0x34}},
+	{"xor $12", []uint8{0xee, 0x12}},
+	{"rst $28", []uint8{0xef}},
+	{"ldh a, ($12)", []uint8{0xf0, 0x12}},
+	{"pop af", []uint8{0xf1}},
+	{"ld a, (c)", []uint8{0xf2}},
+	{"di", []uint8{0xf3}},
+	{"push af", []uint8{0xf5}},
+	{"or $12", []uint8{0xf6, 0x12}},
+	{"rst $30", []uint8{0xf7}},
+	{"ld hl, sp+3", []uint8{0xf8, 0x03}},
+	{"ld sp, hl", []uint8{0xf9}},
+	{"ld a, ($3456)", []uint8{0xfa, 0x56, 0x34}},
+	{"ei", []uint8{0xfb}},
+	{"cp $12", []uint8{0xfe, 0x12}},
+	{"rst $38", []uint8{0xff}},
+}
+
+// the $cb-prefixed opcodes, where the index is the second byte
+var cbReference = []string{
+	"rlc b",
+	"rlc c",
+	"rlc d",
+	"rlc e",
+	"rlc h",
+	"rlc l",
+	"rlc (hl)",
+	"rlc a",
+	"rrc b",
+	"rrc c",
+	"rrc d",
+	"rrc e",
+	"rrc h",
+	"rrc l",
+	"rrc (hl)",
+	"rrc a",
+	"rl b",
+	"rl c",
+	"rl d",
+	"rl e",
+	"rl h",
+	"rl l",
+	"rl (hl)",
+	"rl a",
+	"rr b",
+	"rr c",
+	"rr d",
+	"rr e",
+	"rr h",
+	"rr l",
+	"rr (hl)",
+	"rr a",
+	"sla b",
+	"sla c",
+	"sla d",
+	"sla e",
+	"sla h",
+	"sla l",
+	"sla (hl)",
+	"sla a",
+	"sra b",
+	"sra c",
+	"sra d",
+	"sra e",
+	"sra h",
+	"sra l",
+	"sra (hl)",
+	"sra a",
+	"swap b",
+	"swap c",
+	"swap d",
+	"swap e",
+	"swap h",
+	"swap l",
+	"swap (hl)",
+	"swap a",
+	"srl b",
+	"srl c",
+	"srl d",
+	"srl e",
+	"srl h",
+	"srl l",
+	"srl (hl)",
+	"srl a",
+	"bit 0, b",
+	"bit 0, c",
+	"bit 0, d",
+	"bit 0, e",
+	"bit 0, h",
+	"bit 0, l",
+	"bit 0, (hl)",
+	"bit 0, a",
+	"bit 1, b",
+	"bit 1, c",
+	"bit 1, d",
+	"bit 1, e",
+	"bit 1, h",
+	"bit 1, l",
+	"bit 1, (hl)",
+	"bit 1, a",
+	"bit 2, b",
+	"bit 2, c",
+	"bit 2, d",
+	"bit 2, e",
+	"bit 2, h",
+	"bit 2, l",
+	"bit 2, (hl)",
+	"bit 2, a",
+	"bit 3, b",
+	"bit 3, c",
+	"bit 3, d",
+	"bit 3, e",
+	"bit 3, h",
+	"bit 3, l",
+	"bit 3, (hl)",
+	"bit 3, a",
+	"bit 4, b",
+	"bit 4, c",
+	"bit 4, d",
+	"bit 4, e",
+	"bit 4, h",
+	"bit 4, l",
+	"bit 4, (hl)",
+	"bit 4, a",
+	"bit 5, b",
+	"bit 5, c",
+	"bit 5, d",
+	"bit 5, e",
+	"bit 5, h",
+	"bit 5, l",
+	"bit 5, (hl)",
+	"bit 5, a",
+	"bit 6, b",
+	"bit 6, c",
+	"bit 6, d",
+	"bit 6, e",
+	"bit 6, h",
+	"bit 6, l",
+	"bit 6, (hl)",
+	"bit 6, a",
+	"bit 7, b",
+	"bit 7, c",
+	"bit 7, d",
+	"bit 7, e",
+	"bit 7, h",
+	"bit 7, l",
+	"bit 7, (hl)",
+	"bit 7, a",
+	"res 0, b",
+	"res 0, c",
+	"res 0, d",
+	"res 0, e",
+	"res 0, h",
+	"res 0, l",
+	"res 0, (hl)",
+	"res 0, a",
+	"res 1, b",
+	"res 1, c",
+	"res 1, d",
+	"res 1, e",
+	"res 1, h",
+	"res 1, l",
+	"res 1, (hl)",
+	"res 1, a",
+	"res 2, b",
+	"res 2, c",
+	"res 2, d",
+	"res 2, e",
+	"res 2, h",
+	"res 2, l",
+	"res 2, (hl)",
+	"res 2, a",
+	"res 3, b",
+	"res 3, c",
+	"res 3, d",
+	"res 3, e",
+	"res 3, h",
+	"res 3, l",
+	"res 3, (hl)",
+	"res 3, a",
+	"res 4, b",
+	"res 4, c",
+	"res 4, d",
+	"res 4, e",
+	"res 4, h",
+	"res 4, l",
+	"res 4, (hl)",
+	"res 4, a",
+	"res 5, b",
+	"res 5, c",
+	"res 5, d",
+	"res 5, e",
+	"res 5, h",
+	"res 5, l",
+	"res 5, (hl)",
+	"res 5, a",
+	"res 6, b",
+	"res 6, c",
+	"res 6, d",
+	"res 6, e",
+	"res 6, h",
+	"res 6, l",
+	"res 6, (hl)",
+	"res 6, a",
+	"res 7, b",
+	"res 7, c",
+	"res 7, d",
+	"res 7, e",
+	"res 7, h",
+	"res 7, l",
+	"res 7, (hl)",
+	"res 7, a",
+	"set 0, b",
+	"set 0, c",
+	"set 0, d",
+	"set 0, e",
+	"set 0, h",
+	"set 0, l",
+	"set 0, (hl)",
+	"set 0, a",
+	"set 1, b",
+	"set 1, c",
+	"set 1, d",
+	"set 1, e",
+	"set 1, h",
+	"set 1, l",
+	"set 1, (hl)",
+	"set 1, a",
+	"set 2, b",
+	"set 2, c",
+	"set 2, d",
+	"set 2, e",
+	"set 2, h",
+	"set 2, l",
+	"set 2, (hl)",
+	"set 2, a",
+	"set 3, b",
+	"set 3, c",
+	"set 3, d",
+	"set 3, e",
+	"set 3, h",
+	"set 3, l",
+	"set 3, (hl)",
+	"set 3, a",
+	"set 4, b",
+	"set 4, c",
+	"set 4, d",
+	"set 4, e",
+	"set 4, h",
+	"set 4, l",
+	"set 4, (hl)",
+	"set 4, a",
+	"set 5, b",
+	"set 5, c",
+	"set 5, d",
+	"set 5, e",
+	"set 5, h",
+	"set 5, l",
+	"set 5, (hl)",
+	"set 5, a",
+	"set 6, b",
+	"set 6, c",
+	"set 6, d",
+	"set 6, e",
+	"set 6, h",
+	"set 6, l",
+	"set 6, (hl)",
+	"set 6, a",
+	"set 7, b",
+	"set 7, c",
+	"set 7, d",
+	"set 7, e",
+	"set 7, h",
+	"set 7, l",
+	"set 7, (hl)",
+	"set 7, a",
+}
+
+func assembleText(text string) ([]uint8, error) {
+	insn := ParseInsn(text, Pos{File: "test.asm", Line: 1})
+	return assembleInsn(&insn)
+}
+
+func checkAssembly(t *testing.T, text string, expected []uint8) {
+	actual, err := assembleText(text)
+	if err != nil {
+		t.Errorf("'%s': %v", text, err)
+	} else if !bytes.Equal(actual, expected) {
+		t.Errorf("'%s': expected % x but got % x", text, expected, actual)
+	}
+}
+
+func TestUnprefixedOpcodes(t *testing.T) {
+	seen := make(map[uint8]bool)
+	for _, ref := range unprefixedReference {
+		checkAssembly(t, ref.text, ref.expected)
+		if seen[ref.expected[0]] {
+			t.Errorf("opcode $%02x is in the reference table twice", ref.expected[0])
+		}
+		seen[ref.expected[0]] = true
+	}
+
+	illegal := []uint8{0xcb, 0xd3, 0xdb, 0xdd, 0xe3, 0xe4, 0xeb, 0xec, 0xed, 0xf4, 0xfc, 0xfd}
+	if len(seen)+len(illegal) != 256 {
+		t.Errorf("reference table covers %d opcodes, expected %d", len(seen), 256-len(illegal))
+	}
+}
+
+func TestCBOpcodes(t *testing.T) {
+	if len(cbReference) != 256 {
+		t.Fatalf("reference table has %d opcodes, expected 256", len(cbReference))
+	}
+	for i, text := range cbReference {
+		checkAssembly(t, text, []uint8{0xcb, uint8(i)})
+	}
+}
+
+func TestAlternativeSyntax(t *testing.T) {
+	aliases := []struct {
+		text     string
+		expected []uint8
+	}{
+		{"ld (hli), a", []uint8{0x22}},
+		{"ldi (hl), a", []uint8{0x22}},
+		{"ld a, (hld)", []uint8{0x3a}},
+		{"ldd a, (hl)", []uint8{0x3a}},
+		{"ld ($ff00+c), a", []uint8{0xe2}},
+		{"ld a, ($ff00 + c)", []uint8{0xf2}},
+		{"ldh (c), a", []uint8{0xe2}},
+		{"ldh a, ($ff44)", []uint8{0xf0, 0x44}},
+		{"ld hl, sp - 2", []uint8{0xf8, 0xfe}},
+		{"ldhl sp, 3", []uint8{0xf8, 0x03}},
+		{"jp (hl)", []uint8{0xe9}},
+		{"add b", []uint8{0x80}},
+		{"sub a, $12", []uint8{0xd6, 0x12}},
+		{"sbc $12", []uint8{0xde, 0x12}},
+		{"cp a, (hl)", []uint8{0xbe}},
+		{"xor a, a", []uint8{0xaf}},
+	}
+	for _, alias := range aliases {
+		checkAssembly(t, alias.text, alias.expected)
+	}
+}
+
+func TestWrongNumberOfArgs(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected string
+	}{
+		{"nop a", "'nop' has wrong number of args, expected 0"},
+		{"ds", "'ds' has wrong number of args, expected 1 or 2"},
+		{"ret nz, z", "'ret' has wrong number of args, expected 0 or 1"},
+		{"jp", "'jp' has wrong number of args, expected 1 or 2"},
+	}
+	for _, c := range cases {
+		if _, err := assembleText(c.text); err == nil || err.Error() != c.expected {
+			t.Errorf("'%s': expected '%s' but got '%v'", c.text, c.expected, err)
+		}
+	}
+}
+
+func TestInvalidInstructions(t *testing.T) {
+	invalid := []string{
+		"ld (hl), (hl)",
+		"ldh a, ($1234)",
+		"ld hl, sp+200",
+		"add bc, hl",
+		"jp (bc)",
+	}
+	for _, text := range invalid {
+		if actual, err := assembleText(text); err == nil {
+			t.Errorf("'%s': expected an error but got % x", text, actual)
+		}
+	}
+}
+
+func TestDataDirectives(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected []uint8
+	}{
+		{"db 1, $ff, -1", []uint8{0x01, 0xff, 0xff}},
+		{`db "Hi", 0`, []uint8{'H', 'i', 0x00}},
+		{`db "a,b;c", "\"\\\n\t\0"`, []uint8{'a', ',', 'b', ';', 'c', '"', '\\', '\n', '\t', 0x00}},
+		{"dw $1234, -2", []uint8{0x34, 0x12, 0xfe, 0xff}},
+		{"ds 3", []uint8{0x00, 0x00, 0x00}},
+		{"ds 2, $aa", []uint8{0xaa, 0xaa}},
+		{"ds 0", []uint8{}},
+	}
+	for _, c := range cases {
+		checkAssembly(t, c.text, c.expected)
+	}
+
+	invalid := []string{"db", "db 256", `db "oops`, `db "\q"`, "dw", "dw $10000", "ds", "ds -1", "ds 2, 256", "ds 1, 2, 3"}
+	for _, text := range invalid {
+		if actual, err := assembleText(text); err == nil {
+			t.Errorf("'%s': expected an error but got % x", text, actual)
+		}
+	}
+}
+
+func TestDataLabelOffsets(t *testing.T) {
+	lines := []string{
+		".main",
+		"  db 1, 2, 3",
+		".words",
+		"  dw 1, 2",
+		"  db \"abc\"",
+		".space",
+		"  ds 10, $ee",
+		"  nop",
+		".after",
+		"  dw words, space, after",
+	}
+	rom, labelOffsets, diags := Compile(parseUnit(t, lines), CompileOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	expected := map[string]uint16{"main": 0x0150, "words": 0x0153, "space": 0x015a, "after": 0x0165}
+	for label, offset := range expected {
+		if labelOffsets[label].Offset != offset {
+			t.Errorf("expected '%s' at $%04x but got $%04x", label, offset, labelOffsets[label].Offset)
+		}
+	}
+	if actual := rom[0x0165:0x016b]; !bytes.Equal(actual, []uint8{0x53, 0x01, 0x5a, 0x01, 0x65, 0x01}) {
+		t.Errorf("expected the labels' addresses but got % x", actual)
+	}
+	if actual := rom[0x015a:0x0165]; !bytes.Equal(actual, append(bytes.Repeat([]uint8{0xee}, 10), 0x00)) {
+		t.Errorf("expected the ds fill then a nop but got % x", actual)
+	}
+}
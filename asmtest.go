@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/echojc/gbasm/sim"
+)
+
+// AsmTest is a routine whose label starts with 'test_', and what the
+// '@in' and '@expect' comments above it set up and check
+type AsmTest struct {
+	Label   string
+	Pos     Pos
+	Inputs  []*testSetting
+	Expects []*testSetting
+}
+
+// testSetting is one 'name=value' from an annotation, for a register, flag
+// or, with Addr set, the bytes at an address
+type testSetting struct {
+	Name   string
+	Addr   *Expr
+	Values []*Expr
+	Pos    Pos
+}
+
+type TestOptions struct {
+	MBC string
+	// print every test instead of just the failures
+	Verbose bool
+	// a test fails if it hasn't returned after this many cycles
+	MaxCycles int
+}
+
+// flags by the names annotations use, since 'c' is already a register
+var testFlags = map[string]uint8{"zf": sim.FlagZ, "nf": sim.FlagN, "hf": sim.FlagH, "cf": sim.FlagC}
+
+var testRegisters = map[string]bool{
+	"a": true, "f": true, "b": true, "c": true, "d": true, "e": true, "h": true, "l": true,
+	"af": true, "bc": true, "de": true, "hl": true, "sp": true,
+}
+
+// where each test returns to, which is a halt in case it ever runs
+const testReturnLabel = "!test_return"
+
+// FindTests collects the tests in a unit. Annotations are comments above
+// the label, like '; @in a=3 (buffer)=1,2' or '; @expect a=6 zf=0'.
+func FindTests(unit *Unit) ([]*AsmTest, Diagnostics) {
+	tests := []*AsmTest{}
+	diags := Diagnostics{}
+	inputs, expects := []*testSetting{}, []*testSetting{}
+	for _, line := range unit.Lines {
+		if line.Skipped {
+			continue
+		}
+		text := strings.TrimSpace(line.Text)
+		if strings.HasPrefix(text, ";") {
+			comment := strings.ToLower(strings.TrimSpace(text[1:]))
+			fields := strings.Fields(comment)
+			if len(fields) == 0 || fields[0] != "@in" && fields[0] != "@expect" {
+				continue
+			}
+
+			settings, err := parseTestSettings(comment[len(fields[0]):], line.Pos)
+			if err != nil {
+				diags.add(err)
+			} else if fields[0] == "@in" {
+				inputs = append(inputs, settings...)
+			} else {
+				expects = append(expects, settings...)
+			}
+			continue
+		}
+
+		// annotations belong to the next label
+		if line.Section == "" || line.Insn >= 0 {
+			continue
+		}
+		if strings.HasPrefix(line.Section, "test_") {
+			tests = append(tests, &AsmTest{line.Section, line.Pos, inputs, expects})
+		} else {
+			for _, setting := range append(inputs, expects...) {
+				diags.add(posError(setting.Pos, fmt.Sprintf("'%s' is above '%s', which isn't a test_ label", setting.Name, line.Section)))
+			}
+		}
+		inputs, expects = []*testSetting{}, []*testSetting{}
+	}
+	for _, setting := range append(inputs, expects...) {
+		diags.add(posError(setting.Pos, fmt.Sprintf("'%s' isn't above a test_ label", setting.Name)))
+	}
+	return tests, diags
+}
+
+// parseTestSettings parses space separated settings like 'hl=buffer+2' or
+// '($c000)=1,2,3'
+func parseTestSettings(text string, pos Pos) ([]*testSetting, error) {
+	settings := []*testSetting{}
+	for _, field := range strings.Fields(text) {
+		i := strings.Index(field, "=")
+		if i < 0 {
+			return nil, tokenError(pos, field, fmt.Sprintf("expected 'name=value' but got '%s'", field))
+		}
+		setting := &testSetting{Name: field[:i], Pos: pos.at(field)}
+
+		valueTexts := []string{field[i+1:]}
+		if strings.HasPrefix(setting.Name, "(") && strings.HasSuffix(setting.Name, ")") {
+			addr, err := ParseExpr(setting.Name[1 : len(setting.Name)-1])
+			if err != nil {
+				return nil, tokenError(pos, field, err.Error())
+			}
+			setting.Addr = addr
+			valueTexts = strings.Split(field[i+1:], ",")
+		} else if _, isFlag := testFlags[setting.Name]; !isFlag && !testRegisters[setting.Name] {
+			return nil, tokenError(pos, field, fmt.Sprintf("unknown register or flag '%s' (flags are zf, nf, hf and cf)", setting.Name))
+		}
+
+		for _, valueText := range valueTexts {
+			value, err := ParseExpr(valueText)
+			if err != nil {
+				return nil, tokenError(pos, field, err.Error())
+			}
+			setting.Values = append(setting.Values, value)
+		}
+		settings = append(settings, setting)
+	}
+	return settings, nil
+}
+
+// testSymbols lets annotations use labels as well as constants
+type testSymbols struct {
+	labelOffsets labelOffsets
+	constants    Constants
+}
+
+func (s testSymbols) Value(name string) (int, error) {
+	if _, found := s.labelOffsets[name]; found {
+		return s.labelOffsets.Value(name)
+	}
+	return s.constants.Value(name)
+}
+
+func (s testSymbols) Bank(name string) (int, error) {
+	return s.labelOffsets.Bank(name)
+}
+
+// RunTests builds the unit and runs every test in it, writing the results
+// to w. It returns how many tests there were and how many failed. The unit
+// gets a 'main' if it doesn't have one, so a file of tests can include just
+// the routines it needs.
+func RunTests(w io.Writer, unit *Unit, options TestOptions) (int, int, Diagnostics) {
+	tests, diags := FindTests(unit)
+	if diags.HasErrors() || len(tests) == 0 {
+		return 0, 0, diags
+	}
+
+	for _, label := range []string{"main", testReturnLabel} {
+		if _, found := unit.Sections[label]; !found {
+			section := &Section{Label: label, Placement: newPlacement(), Insns: []Insn{{Name: "halt"}}}
+			section.Region = RegionROM0
+			unit.Sections[label] = section
+			unit.Labels = append(unit.Labels, label)
+		}
+	}
+	rom, labelOffsets, compileDiags := Compile(unit, CompileOptions{MBC: options.MBC})
+	diags = append(diags, compileDiags...)
+	if diags.HasErrors() {
+		return 0, 0, diags
+	}
+
+	symbols := testSymbols{labelOffsets, Constants(unit.Constants)}
+	failed := 0
+	for _, test := range tests {
+		if options.Verbose {
+			fmt.Fprintf(w, "=== RUN   %s\n", test.Label)
+		}
+		cycles, failures := runTest(test, rom, labelOffsets, symbols, options.MaxCycles)
+
+		result := "PASS"
+		if len(failures) > 0 {
+			result = "FAIL"
+			failed++
+		}
+		if options.Verbose || len(failures) > 0 {
+			fmt.Fprintf(w, "--- %s: %s (%d cycles)\n", result, test.Label, cycles)
+		}
+		for _, failure := range failures {
+			fmt.Fprintf(w, "    %s\n", failure)
+		}
+	}
+	return len(tests), failed, diags
+}
+
+// runTest calls the test's routine from a fresh CPU and returns how many
+// cycles it took and everything that went wrong
+func runTest(test *AsmTest, rom []uint8, labelOffsets labelOffsets, symbols Symbols, maxCycles int) (int, []string) {
+	failures := []string{}
+	cpu := sim.New(rom)
+	memory := cpu.Memory.(*sim.FlatMemory)
+	if labelOffsets[test.Label].Region == RegionROMX {
+		memory.Bank = labelOffsets[test.Label].Bank
+	}
+
+	for _, setting := range test.Inputs {
+		values, addr, err := setting.eval(symbols)
+		if err != nil {
+			failures = append(failures, err.Error())
+		} else if setting.Addr != nil {
+			for i, value := range values {
+				memory.Write(uint16(addr+i), uint8(value))
+			}
+		} else if flag, isFlag := testFlags[setting.Name]; isFlag {
+			cpu.F &^= flag
+			if values[0] != 0 {
+				cpu.F |= flag
+			}
+		} else {
+			cpu.SetReg(setting.Name, values[0])
+		}
+	}
+	if len(failures) > 0 {
+		return 0, failures
+	}
+
+	// call it from the return address
+	returnAddr := labelOffsets[testReturnLabel].Offset
+	cpu.SP -= 2
+	memory.Write(cpu.SP, uint8(returnAddr))
+	memory.Write(cpu.SP+1, uint8(returnAddr>>8))
+	cpu.PC = labelOffsets[test.Label].Offset
+
+	reason, err := cpu.Run(sim.RunOptions{Breakpoints: map[uint16]bool{returnAddr: true}, MaxCycles: maxCycles})
+	if err != nil {
+		return cpu.Cycles, append(failures, testFailure(test.Pos, err.Error()))
+	} else if reason == sim.StopCycleLimit {
+		return cpu.Cycles, append(failures, testFailure(test.Pos, fmt.Sprintf("didn't return within %d cycles (stopped at $%04x)", maxCycles, cpu.PC)))
+	} else if reason == sim.StopHalt {
+		return cpu.Cycles, append(failures, testFailure(test.Pos, fmt.Sprintf("halted at $%04x instead of returning", cpu.PC-1)))
+	}
+
+	for _, setting := range test.Expects {
+		values, addr, err := setting.eval(symbols)
+		if err != nil {
+			failures = append(failures, err.Error())
+		} else if setting.Addr != nil {
+			for i, value := range values {
+				if actual := memory.Read(uint16(addr + i)); actual != uint8(value) {
+					failures = append(failures, testFailure(setting.Pos, fmt.Sprintf("($%04x) = $%02x, expected $%02x", addr+i, actual, uint8(value))))
+				}
+			}
+		} else if flag, isFlag := testFlags[setting.Name]; isFlag {
+			actual, expected := 0, 0
+			if cpu.Flag(flag) {
+				actual = 1
+			}
+			if values[0] != 0 {
+				expected = 1
+			}
+			if actual != expected {
+				failures = append(failures, testFailure(setting.Pos, fmt.Sprintf("%s = %d, expected %d", setting.Name, actual, expected)))
+			}
+		} else {
+			actual, _ := cpu.Reg(setting.Name)
+			format := "%s = $%02x, expected $%02x"
+			mask := 0xff
+			if len(setting.Name) == 2 {
+				format = "%s = $%04x, expected $%04x"
+				mask = 0xffff
+			}
+			if actual != values[0]&mask {
+				failures = append(failures, testFailure(setting.Pos, fmt.Sprintf(format, setting.Name, actual, values[0]&mask)))
+			}
+		}
+	}
+	return cpu.Cycles, failures
+}
+
+// testFailure is a message with the line it came from, like go test's
+func testFailure(pos Pos, msg string) string {
+	return fmt.Sprintf("%s:%d: %s", pos.File, pos.Line, msg)
+}
+
+// eval works out the values, and the address for memory
+func (s *testSetting) eval(symbols Symbols) ([]int, int, error) {
+	addr := 0
+	if s.Addr != nil {
+		var err error
+		if addr, err = s.Addr.Eval(symbols); err != nil {
+			return nil, 0, errors.New(testFailure(s.Pos, err.Error()))
+		} else if addr < 0 || addr > 0xffff {
+			return nil, 0, errors.New(testFailure(s.Pos, fmt.Sprintf("address $%x is out of range", addr)))
+		}
+	}
+
+	values := []int{}
+	for _, expr := range s.Values {
+		value, err := expr.Eval(symbols)
+		if err != nil {
+			return nil, 0, errors.New(testFailure(s.Pos, err.Error()))
+		}
+		values = append(values, value)
+	}
+	return values, addr, nil
+}
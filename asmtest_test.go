@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunTests(t *testing.T) {
+	lines := []string{
+		".add_b",
+		"  add a, b",
+		"  ret",
+		".buffer:wram0",
+		"  ds 4",
+		".double",
+		"  ld c, 3",
+		".double_loop",
+		"  ld a, (hl)",
+		"  add a, a",
+		"  ld (hl+), a",
+		"  dec c",
+		"  jr nz, double_loop",
+		"  ret",
+		"; @in a=3 b=4",
+		"; @expect a=7 zf=0 cf=0",
+		".test_add",
+		"  jp add_b",
+		"; @in a=$ff b=1",
+		"; @expect a=1 zf=0",
+		"; @expect CF=1",
+		".test_add_carry",
+		"  jp add_b",
+		"; @in hl=buffer (buffer)=1,2,$81",
+		"; @expect (buffer)=2,4,3 hl=buffer+3 cf=1",
+		".test_double",
+		"  jp double",
+		".test_halt",
+		"  halt",
+		".test_forever",
+		"  jr test_forever",
+	}
+
+	var buffer bytes.Buffer
+	count, failed, diags := RunTests(&buffer, parseUnit(t, lines), TestOptions{MaxCycles: 1000})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if count != 5 || failed != 4 {
+		t.Errorf("expected 4 of 5 tests to fail but got %d of %d", failed, count)
+	}
+
+	expected := []string{
+		"--- FAIL: test_add_carry (36 cycles)",
+		"    compile.asm:20: a = $00, expected $01",
+		"    compile.asm:20: zf = 1, expected 0",
+		"--- FAIL: test_double (144 cycles)",
+		"    compile.asm:25: ($c002) = $02, expected $03",
+		"--- FAIL: test_halt (4 cycles)",
+		"    compile.asm:28: halted at $0165 instead of returning",
+		"--- FAIL: test_forever (1008 cycles)",
+		"    compile.asm:30: didn't return within 1000 cycles (stopped at $0166)",
+	}
+	if output := strings.TrimRight(buffer.String(), "\n"); output != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%s\nbut got\n%s", strings.Join(expected, "\n"), output)
+	}
+
+	buffer.Reset()
+	RunTests(&buffer, parseUnit(t, lines[:18]), TestOptions{Verbose: true, MaxCycles: 1000})
+	if output := buffer.String(); output != "=== RUN   test_add\n--- PASS: test_add (36 cycles)\n" {
+		t.Errorf("unexpected verbose output:\n%s", output)
+	}
+}
+
+func TestTestAnnotationErrors(t *testing.T) {
+	cases := []struct {
+		lines    []string
+		expected string
+	}{
+		{[]string{"; @in a", ".test_x", "  ret"}, "expected 'name=value' but got 'a'"},
+		{[]string{"; @in q=1", ".test_x", "  ret"}, "unknown register or flag 'q' (flags are zf, nf, hf and cf)"},
+		{[]string{"; @in a=(", ".test_x", "  ret"}, ""},
+		{[]string{"; @expect a=1", ".main", "  ret"}, "'a' is above 'main', which isn't a test_ label"},
+		{[]string{".test_x", "  ret", "; @expect a=1"}, "'a' isn't above a test_ label"},
+	}
+
+	for _, c := range cases {
+		_, diags := FindTests(parseUnit(t, c.lines))
+		if !diags.HasErrors() {
+			t.Errorf("expected an error for %v", c.lines)
+		} else if c.expected != "" && !strings.Contains(diags[0].Error(), c.expected) {
+			t.Errorf("expected '%s' but got '%s'", c.expected, diags[0].Error())
+		}
+	}
+}
+
+func TestTestAnnotationsInIf(t *testing.T) {
+	// annotations in a block that isn't assembled don't count
+	lines := []string{
+		"if 0",
+		"; @expect a=1",
+		".test_skipped",
+		"  ret",
+		"endif",
+		"; @expect a=3",
+		".test_three",
+		"  ld a, 3",
+		"  ret",
+	}
+	tests, diags := FindTests(parseUnit(t, lines))
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if len(tests) != 1 || tests[0].Label != "test_three" || len(tests[0].Expects) != 1 {
+		t.Errorf("expected just test_three with one expectation but got %v", tests)
+	}
+}
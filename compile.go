@@ -6,147 +6,141 @@ import (
 )
 
 type LabelOffset struct {
-	Label       string
-	Offset      uint16
+	Label  string
+	Offset uint16
+	// the bank that Offset is in, so the position in the ROM file is
+	// romOffset(Bank, Offset)
+	Bank        int
+	Region      string
+	Size        int
 	InsnOffsets []int
 }
 
-func Compile(unit *Unit) ([]uint8, error) {
-	if _, found := unit.Sections["main"]; !found {
-		return nil, errors.New("label 'main' is not defined")
-	}
-
-	// for resolving labels
-	labelOffsets := map[string]LabelOffset{}
-
-	// enough space for all header stuff
-	output := make([]uint8, 0x0150)
-
-	// compile special sections
-	for idx, label := range []string{
-		"rst_00",
-		"rst_08",
-		"rst_10",
-		"rst_18",
-		"rst_20",
-		"rst_28",
-		"rst_30",
-		"rst_38",
-		"int_vblank",
-		"int_lcdc",
-		"int_timer",
-		"int_serial",
-		"int_keys",
-	} {
-		bytes, insnOffsets, err := compileSpecial(unit, label)
-		if err != nil {
-			return nil, err
-		}
+// labelOffsets resolve label expressions once sections have been placed
+type labelOffsets map[string]LabelOffset
 
-		labelOffset := idx * 0x08
-		for i := 0; i < len(bytes); i++ {
-			output[labelOffset+i] = bytes[i]
-		}
-
-		labelOffsets[label] = LabelOffset{
-			label,
-			uint16(labelOffset),
-			insnOffsets,
-		}
+func (l labelOffsets) Value(name string) (int, error) {
+	if labelOffset, found := l[name]; found {
+		return int(labelOffset.Offset), nil
 	}
+	return 0, errors.New(fmt.Sprintf("unknown label '%s'", name))
+}
 
-	// copy header
-	header := generateHeader()
-	for i := 0; i < len(header); i++ {
-		output[0x0100+i] = header[i]
+func (l labelOffsets) Bank(name string) (int, error) {
+	if labelOffset, found := l[name]; found {
+		return labelOffset.Bank, nil
 	}
+	return 0, errors.New(fmt.Sprintf("unknown label '%s'", name))
+}
 
-	// generate main
-	bytes, insnOffsets, err := compileSection(unit, "main")
-	if err != nil {
-		return nil, err
+// bankAt is the bank that addr, somewhere in this section, is in. ROM0 is
+// bank 0 and switchable banks start at 1, but without an MBC there's no
+// switching and ROM0 sections can carry on past $4000 into bank 1 as if it
+// were one flat ROM.
+func (l LabelOffset) bankAt(addr int) int {
+	if l.Region == "" || l.Region == RegionROM0 {
+		return addr >> 14
 	}
-	labelOffsets["main"] = LabelOffset{
-		"main",
-		0x0150,
-		insnOffsets,
-	}
-	output = append(output, bytes...)
+	return l.Bank
+}
 
-	// generate everything else
-	for _, label := range unit.Labels {
-		// skip already compiled sections
-		if _, found := labelOffsets[label]; found {
-			continue
-		}
+// romOffset is where addr in the given bank is in the ROM file
+func romOffset(bank int, addr uint16) int {
+	return bank*0x4000 + int(addr&0x3fff)
+}
 
-		bytes, insnOffsets, err := compileSection(unit, label)
-		if err != nil {
-			return nil, err
-		}
+type CompileOptions struct {
+	// turn jr into jp when the target is out of range, instead of failing.
+	// The insns are changed in the unit too.
+	RelaxBranches bool
+	// warn about jp whose target is close enough for jr
+	WarnShortJumps bool
+	// see LinkOptions
+	MBC         string
+	Trampolines bool
+	Header      Header
+}
 
-		// align a section to the closest 0x100 (for lookup tables, etc.)
-		offset := uint16(len(output))
-		if unit.Sections[label].IsAligned && (offset&0x00ff) != 0 {
-			alignedOffset := (offset + 0x100) & 0xff00
-			output = append(output, make([]uint8, alignedOffset-offset)...)
-			offset = alignedOffset
-		}
+// Compile assembles and links a single unit. It's the same as linking the
+// unit's object on its own, except that jrs can be relaxed.
+func Compile(unit *Unit, options CompileOptions) ([]uint8, labelOffsets, Diagnostics) {
+	object, diags := CompileObject(unit, "", options)
+	if diags.HasErrors() {
+		return nil, nil, diags
+	}
+	return Link([]*Object{object}, options.linkOptions())
+}
 
-		labelOffsets[label] = LabelOffset{
-			label,
-			offset,
-			insnOffsets,
+// CompileObject is the object that Compile links, after any relaxing.
+func CompileObject(unit *Unit, file string, options CompileOptions) (*Object, Diagnostics) {
+	for {
+		object, diags := BuildObject(unit, file)
+		if diags.HasErrors() {
+			return nil, diags
 		}
-		output = append(output, bytes...)
+		objects := []*Object{object}
+
+		// every jr that gets relaxed into a jp moves the code after it,
+		// which can push other jrs out of range, so keep going until
+		// nothing changes
+		if options.RelaxBranches {
+			mbc, err := LookupMBC(options.MBC)
+			if err != nil {
+				diags.add(err)
+				return nil, diags
+			}
+			_, labelOffsets, diags := placeObjects(objects, mbc, options.Trampolines)
+			if diags.HasErrors() {
+				return nil, diags
+			}
+			if relaxBranches(unit, labelOffsets) {
+				continue
+			}
+		}
+		return object, diags
 	}
+}
+
+func (o CompileOptions) linkOptions() LinkOptions {
+	return LinkOptions{o.WarnShortJumps, o.MBC, o.Trampolines, o.Header}
+}
 
-	// resolve labels
+// jrDelta is the displacement a jr at addr needs to reach target
+func jrDelta(addr uint16, target int) int {
+	return target - int(addr+2)
+}
+
+// relaxBranches turns every jr whose target is out of range into a jp.
+// It returns false if there weren't any.
+func relaxBranches(unit *Unit, labelOffsets labelOffsets) bool {
+	relaxed := false
 	for _, labelUsage := range unit.LabelUsages {
-		targetLabel := labelUsage.TargetLabel
-		targetAddr := uint16(labelOffsets[targetLabel].Offset)
+		insn := &unit.Sections[labelUsage.SourceSection].Insns[labelUsage.SourceInsnIndex]
+		if insn.Name != "jr" {
+			continue
+		}
+		targetAddr, err := labelUsage.Expr.Eval(labelOffsets)
+		if err != nil {
+			continue
+		}
 
 		usage := labelOffsets[labelUsage.SourceSection]
 		usageOffset := usage.Offset + uint16(usage.InsnOffsets[labelUsage.SourceInsnIndex])
-
-		insn := unit.Sections[labelUsage.SourceSection].Insns[labelUsage.SourceInsnIndex]
-		if insn.Name == "jr" {
-			// calculate relative
-			startAddr := usageOffset + 2
-			delta := int(targetAddr) - int(startAddr)
-
-			if delta > 127 || delta < -128 { // int8 range
-				insn.Err = errors.New(fmt.Sprintf("target label '%s' is out of range (%d)", targetLabel, delta))
-				return nil, &insn
-			}
-
-			output[usageOffset+1] = uint8(int8(delta))
-		} else {
-			// inject absolute
-			output[usageOffset+1] = uint8(targetAddr & 0xff)
-			output[usageOffset+2] = uint8(targetAddr >> 8)
+		if delta := jrDelta(usageOffset, targetAddr); delta > 127 || delta < -128 {
+			// the target still goes just after the opcode, it's just
+			// 16 bits now
+			insn.Name = "jp"
+			relaxed = true
 		}
 	}
-
-	// calculate checksum
-	var checksum uint = 0
-	for _, b := range output {
-		checksum += uint(b)
-	}
-	output[0x014e] = uint8(checksum >> 8)
-	output[0x014f] = uint8(checksum & 0xff)
-
-	return output, nil
+	return relaxed
 }
 
-func compileSection(unit *Unit, label string) ([]uint8, []int, error) {
+func compileSection(unit *Unit, label string) ([]uint8, []int, Diagnostics) {
 	if section, found := unit.Sections[label]; found {
 		output := make([]uint8, len(section.Data))
 
-		bytes, offsets, err := Assemble(section.Insns)
-		if err != nil {
-			return nil, nil, err
-		}
+		bytes, offsets, diags := Assemble(section.Insns)
 
 		// prepend data block if necessary
 		if len(section.Data) > 0 {
@@ -157,35 +151,10 @@ func compileSection(unit *Unit, label string) ([]uint8, []int, error) {
 		}
 
 		output = append(output, bytes...)
-		return output, offsets, nil
+		return output, offsets, diags
 	} else {
-		return nil, nil, errors.New(fmt.Sprintf("unknown label '%s'", label))
-	}
-}
-
-func compileSpecial(unit *Unit, label string) ([]uint8, []int, error) {
-	output := []uint8{}
-	var offsets []int = nil
-
-	if section, found := unit.Sections[label]; found {
-		bytes, _offsets, err := Assemble(section.Insns)
-		offsets = _offsets
-		if err != nil {
-			return output, nil, err
-		}
-
-		output = bytes
-	}
-
-	return output, offsets, nil
-}
-
-func generateHeader() [0x50]uint8 {
-	return [0x50]uint8{
-		0x00, 0xc3, 0x50, 0x01, 0xce, 0xed, 0x66, 0x66, 0xcc, 0x0d, 0x00, 0x0b, 0x03, 0x73, 0x00, 0x83,
-		0x00, 0x0c, 0x00, 0x0d, 0x00, 0x08, 0x11, 0x1f, 0x88, 0x89, 0x00, 0x0e, 0xdc, 0xcc, 0x6e, 0xe6,
-		0xdd, 0xdd, 0xd9, 0x99, 0xbb, 0xbb, 0x67, 0x63, 0x6e, 0x0e, 0xec, 0xcc, 0xdd, 0xdc, 0x99, 0x9f,
-		0xbb, 0xb9, 0x33, 0x3e, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xe7, 0x00, 0x00,
+		diags := Diagnostics{}
+		diags.add(errors.New(fmt.Sprintf("unknown label '%s'", label)))
+		return nil, nil, diags
 	}
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+)
+
+func parseUnit(t *testing.T, lines []string) *Unit {
+	unit, diags := Parse("compile.asm", lines, ParseOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	return unit
+}
+
+func TestRelaxBranches(t *testing.T) {
+	// only the second jr is out of range at first, but relaxing it pushes
+	// the first one out of range too
+	lines := []string{
+		".main",
+		"  jr nz, first",
+		"  jr second",
+		"  ds 125",
+		".first",
+		"  ds 4",
+		".second",
+		"  jr first",
+	}
+
+	if _, _, diags := Compile(parseUnit(t, lines), CompileOptions{}); !diags.HasErrors() {
+		t.Fatal("expected an out of range error without relaxing")
+	}
+
+	unit := parseUnit(t, lines)
+	rom, _, diags := Compile(unit, CompileOptions{RelaxBranches: true})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	expected := map[int][]uint8{
+		0x150: {0xc2, 0xd3, 0x01}, // jp nz, first
+		0x153: {0xc3, 0xd7, 0x01}, // jp second
+		0x1d7: {0x18, 0xfa},       // jr first
+	}
+	for addr, bytes := range expected {
+		for i, b := range bytes {
+			if rom[addr+i] != b {
+				t.Errorf("expected $%02x at $%04x but got $%02x", b, addr+i, rom[addr+i])
+			}
+		}
+	}
+	if name := unit.Sections["main"].Insns[0].Name; name != "jp" {
+		t.Errorf("expected the relaxed insn to be a jp in the unit but it's '%s'", name)
+	}
+}
+
+func TestWarnShortJumps(t *testing.T) {
+	lines := []string{
+		".main",
+		"  jp z, near",
+		"  jp far",
+		"  jp $0150",
+		".near",
+		"  ds 200",
+		".far",
+	}
+	_, _, diags := Compile(parseUnit(t, lines), CompileOptions{WarnShortJumps: true})
+	if len(diags) != 1 || diags.HasErrors() {
+		t.Fatalf("expected 1 warning but got:\n%v", diags)
+	}
+	if diags[0].Severity != SeverityWarning || diags[0].Pos.Line != 2 || diags[0].Token != "near" {
+		t.Errorf("expected a warning about 'near' on line 2 but got '%s'", diags[0])
+	}
+}
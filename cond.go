@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// condFrame is an if/elif/else/endif block that's being parsed.
+type condFrame struct {
+	pos          Pos
+	active       bool // lines in the current branch get parsed
+	taken        bool // one of the branches has already been active
+	parentActive bool
+	seenElse     bool
+}
+
+func (p *parser) isActive() bool {
+	return len(p.conds) == 0 || p.conds[len(p.conds)-1].active
+}
+
+// conditional handles if/elif/else/endif, with endc accepted for endif as
+// in rgbds, and returns false for anything else.
+func (p *parser) conditional(directive string, text string, pos Pos) (bool, error) {
+	switch directive {
+	case "if":
+		frame := condFrame{pos: pos, parentActive: p.isActive()}
+		if frame.parentActive {
+			value, err := p.evalCondition(text, pos)
+			if err != nil {
+				// skip the whole block so its else and endif still match
+				frame.taken = true
+				p.conds = append(p.conds, frame)
+				return true, err
+			}
+			frame.active = value
+			frame.taken = value
+		}
+		p.conds = append(p.conds, frame)
+	case "elif":
+		if len(p.conds) == 0 {
+			return true, posError(pos, "'elif' without 'if'")
+		}
+		frame := &p.conds[len(p.conds)-1]
+		if frame.seenElse {
+			return true, posError(pos, "'elif' after 'else'")
+		}
+		frame.active = false
+		if frame.parentActive && !frame.taken {
+			value, err := p.evalCondition(text, pos)
+			if err != nil {
+				frame.taken = true
+				return true, err
+			}
+			frame.active = value
+			frame.taken = value
+		}
+	case "else":
+		if len(p.conds) == 0 {
+			return true, posError(pos, "'else' without 'if'")
+		}
+		frame := &p.conds[len(p.conds)-1]
+		if frame.seenElse {
+			return true, posError(pos, "duplicate 'else'")
+		}
+		frame.seenElse = true
+		frame.active = frame.parentActive && !frame.taken
+		frame.taken = true
+	case "endif", "endc":
+		if len(p.conds) == 0 {
+			return true, posError(pos, fmt.Sprintf("'%s' without 'if'", directive))
+		}
+		p.conds = p.conds[:len(p.conds)-1]
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+func (p *parser) evalCondition(text string, pos Pos) (bool, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return false, posError(pos, "expected a condition")
+	}
+
+	expr, err := ParseExpr(text)
+	if err != nil {
+		return false, tokenError(pos, text, err.Error())
+	}
+	value, err := expr.Eval(p)
+	if err != nil {
+		return false, tokenError(pos, text, err.Error())
+	}
+	return value != 0, nil
+}
+
+// closeConds makes sure every if opened since depth was closed again, so
+// blocks can't leak out of macros or included files.
+func (p *parser) closeConds(depth int) error {
+	if len(p.conds) > depth {
+		pos := p.conds[depth].pos
+		p.conds = p.conds[:depth]
+		return posError(pos, "'if' without 'endif'")
+	}
+	return nil
+}
+
+// the parser resolves symbols in directives like 'if' and 'equ', where
+// only constants have values but labels and macros can be tested with def()
+
+func (p *parser) Value(name string) (int, error) {
+	return p.constants.Value(name)
+}
+
+func (p *parser) Bank(name string) (int, error) {
+	return p.constants.Bank(name)
+}
+
+func (p *parser) Defined(name string) bool {
+	_, isConstant := p.constants[name]
+	_, isMacro := p.macros[name]
+	return isConstant || isMacro || p.isLabel(name)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+var condSource = []string{
+	".main",
+	"if def(debug) && debug >= 2",
+	"  db 2",
+	"elif def(debug)",
+	"  db 1",
+	"  if debug == 1",
+	"    db $11",
+	"  else",
+	"    db $ff",
+	"  endif",
+	"else",
+	"  db 0",
+	"  if 1",
+	"    db $ff",
+	"  endc",
+	"endif",
+	"  db $aa",
+}
+
+func TestConditionals(t *testing.T) {
+	cases := []struct {
+		defines  map[string]int
+		expected []uint8
+	}{
+		{nil, []uint8{0x00, 0xff, 0xaa}},
+		{map[string]int{"DEBUG": 1}, []uint8{0x01, 0x11, 0xaa}},
+		{map[string]int{"debug": 0}, []uint8{0x01, 0xff, 0xaa}},
+		{map[string]int{"debug": 3}, []uint8{0x02, 0xaa}},
+	}
+	for _, c := range cases {
+		unit, diags := Parse("cond.asm", condSource, ParseOptions{Defines: c.defines})
+		if diags.HasErrors() {
+			t.Fatal(diags)
+		}
+		rom, _, diags := Compile(unit, CompileOptions{})
+		if diags.HasErrors() {
+			t.Fatal(diags)
+		}
+		if actual := rom[0x150 : 0x150+len(c.expected)]; !bytes.Equal(actual, c.expected) {
+			t.Errorf("with %v: expected % x but got % x", c.defines, c.expected, actual)
+		}
+	}
+}
+
+func TestConditionalErrors(t *testing.T) {
+	cases := []struct {
+		lines    []string
+		expected string
+		line     uint
+	}{
+		{[]string{".main", "if 1", "  nop"}, "'if' without 'endif'", 2},
+		{[]string{".main", "if 0", "if 1", "endif"}, "'if' without 'endif'", 2},
+		{[]string{".main", "endif"}, "'endif' without 'if'", 2},
+		{[]string{".main", "endc"}, "'endc' without 'if'", 2},
+		{[]string{".main", "else"}, "'else' without 'if'", 2},
+		{[]string{".main", "elif 1"}, "'elif' without 'if'", 2},
+		{[]string{".main", "if 1", "else", "elif 1", "endif"}, "'elif' after 'else'", 4},
+		{[]string{".main", "if 1", "else", "else", "endif"}, "duplicate 'else'", 4},
+		{[]string{".main", "if", "endif"}, "expected a condition", 2},
+		{[]string{".main", "if nope", "else", "endif"}, "unknown constant 'nope'", 2},
+		{[]string{".main", "if 0", "elif nope", "else", "endif"}, "unknown constant 'nope'", 3},
+		// blocks can't be left open at the end of a macro
+		{[]string{"macro open", "if 1", "endm", ".main", "  open"}, "'if' without 'endif'", 2},
+	}
+	for _, c := range cases {
+		_, diags := Parse("cond.asm", c.lines, ParseOptions{})
+		if len(diags) != 1 || diags[0].Message != c.expected || diags[0].Pos.Line != c.line {
+			t.Errorf("%v: expected '%s' on line %d but got:\n%v", c.lines, c.expected, c.line, diags)
+		}
+	}
+
+	// skipped branches aren't evaluated
+	if _, diags := Parse("cond.asm", []string{".main", "if 0", "if nope", "endif", "elif 1", "elif nope", "endif"}, ParseOptions{}); diags.HasErrors() {
+		t.Errorf("expected skipped conditions not to be evaluated but got:\n%v", diags)
+	}
+
+	_, diags := Parse("cond.asm", []string{".main"}, ParseOptions{Defines: map[string]int{"hl": 1}})
+	if len(diags) != 1 || diags[0].Message != "can't define 'hl' (alphanumeric + '_' + '!', not starting with '!' and not a register)" {
+		t.Errorf("expected an invalid define but got:\n%v", diags)
+	}
+}
+
+func TestParseDefines(t *testing.T) {
+	defines := parseDefines(stringList{"DEBUG", "level=2 * 3", "x=$10"})
+	expected := map[string]int{"DEBUG": 1, "level": 6, "x": 16}
+	if !reflect.DeepEqual(defines, expected) {
+		t.Errorf("expected %v but got %v", expected, defines)
+	}
+}
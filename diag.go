@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+)
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// Diagnostic is an error or warning about the source. Pos is empty for ones
+// that aren't about any particular line, like -D values. Token is the part of
+// the line it's about, if it's about something more specific than the line.
+type Diagnostic struct {
+	Pos      Pos
+	Severity Severity
+	Message  string
+	Token    string
+}
+
+func (d *Diagnostic) Error() string {
+	if d.Pos.Line == 0 {
+		return d.Severity.String() + ": " + d.Message
+	}
+	return d.Pos.String() + ": " + d.Severity.String() + ": " + d.Message
+}
+
+// Diagnostics are collected while parsing and compiling so that as many
+// problems as possible are reported in one run.
+type Diagnostics []*Diagnostic
+
+// Excerpt is the source line with the span underlined, e.g.
+//
+//	jr far_away
+//	   ^~~~~~~~
+func (d *Diagnostic) Excerpt() string {
+	pos := d.Pos
+	if pos.Source == "" || pos.Column == 0 {
+		return ""
+	}
+
+	source := strings.TrimRight(pos.Source, " \t\r")
+	start := int(pos.Column) - 1
+	end := int(pos.EndColumn) - 1
+	if start > len(source) {
+		return source
+	}
+	if end > len(source) {
+		end = len(source)
+	}
+
+	// keep tabs so the caret lines up however wide they're displayed
+	var underline strings.Builder
+	for _, c := range []byte(source[:start]) {
+		if c == '\t' {
+			underline.WriteByte('\t')
+		} else {
+			underline.WriteByte(' ')
+		}
+	}
+	underline.WriteByte('^')
+	if end > start+1 {
+		underline.WriteString(strings.Repeat("~", end-start-1))
+	}
+	return source + "\n" + underline.String()
+}
+
+func (ds Diagnostics) HasErrors() bool {
+	for _, d := range ds {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+func (ds Diagnostics) Error() string {
+	strs := make([]string, len(ds))
+	for i, d := range ds {
+		strs[i] = d.Error()
+	}
+	return strings.Join(strs, "\n")
+}
+
+// add records err as an error, keeping its position if it has one
+func (ds *Diagnostics) add(err error) {
+	switch err := err.(type) {
+	case *Diagnostic:
+		*ds = append(*ds, err)
+	case Diagnostics:
+		*ds = append(*ds, err...)
+	default:
+		*ds = append(*ds, &Diagnostic{Severity: SeverityError, Message: err.Error()})
+	}
+}
+
+func posError(pos Pos, msg string) error {
+	return &Diagnostic{pos, SeverityError, msg, ""}
+}
+
+// tokenError is an error about one token on the line rather than all of it
+func tokenError(pos Pos, token string, msg string) error {
+	return &Diagnostic{pos.at(token), SeverityError, msg, token}
+}
+
+func tokenWarning(pos Pos, token string, msg string) *Diagnostic {
+	return &Diagnostic{pos.at(token), SeverityWarning, msg, token}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/echojc/gbasm/sm83"
+)
+
+// runs of at least this many zero bytes are written as 'ds'
+const minZeroRun = 16
+
+// disInsn is a decoded instruction, or data when opcode is nil
+type disInsn struct {
+	addr   int
+	bytes  []uint8
+	opcode *sm83.Opcode
+}
+
+// disBank is the code in one switchable bank of a banked ROM, with the
+// labels for jumps and calls within it
+type disBank struct {
+	bank   int
+	insns  []disInsn
+	labels map[int]string
+}
+
+// Disassemble turns a ROM back into source that assembles to the same
+// bytes. Anything that gbasm can't reproduce (like a different header) is
+// returned as a warning.
+func Disassemble(rom []uint8) ([]string, []string, error) {
+	if len(rom) < 0x150 {
+		return nil, nil, errors.New(fmt.Sprintf("ROM is only %d bytes, too small to have a header", len(rom)))
+	} else if len(rom) > 0x8000 && len(rom)%0x4000 != 0 {
+		return nil, nil, errors.New(fmt.Sprintf("ROM is %d bytes, which isn't a whole number of 16 KiB banks", len(rom)))
+	}
+
+	warnings := make([]string, 0)
+	header := generateHeader()
+	if !bytes.Equal(rom[0x100:0x134], header[:0x34]) {
+		warnings = append(warnings, "ROM entry point or logo differs from the one gbasm generates, reassembling won't reproduce it")
+	}
+	headerLines, headerWarnings := disHeader(rom)
+	warnings = append(warnings, headerWarnings...)
+	for addr := len(vectorNames) * 8; addr < 0x100; addr++ {
+		if rom[addr] != 0x00 {
+			warnings = append(warnings, fmt.Sprintf("non-zero bytes in $%04x-$00ff are outside every vector and will be lost", addr))
+			break
+		}
+	}
+
+	// code starts at $0150 and runs until the zero padding at the end. A
+	// flat ROM is one space up to $8000, but with an MBC, ROM0 stops at
+	// $4000 and every other bank is disassembled on its own.
+	banked := len(rom) > 0x8000
+	codeEnd := len(rom)
+	if banked {
+		codeEnd = 0x4000
+	}
+	code := decodeRange(rom, 0x150, trimZeros(rom, 0x150, codeEnd))
+
+	vectors := make(map[string][]disInsn)
+	labels := map[int]string{0x150: "main"}
+	for idx, name := range vectorNames {
+		start := idx * 8
+		if slotEnd := trimZeros(rom, start, start+8); slotEnd > start {
+			vectors[name] = decodeRange(rom, start, slotEnd)
+			labels[start] = name
+		}
+	}
+
+	banks := []*disBank{}
+	mbc := ""
+	if banked {
+		for _, m := range mbcs {
+			if m.IsBanked() && (rom[0x0147] == m.CartType || rom[0x0147] == m.CartTypeRAM) {
+				mbc = m.Name
+			}
+		}
+		if mbc == "" {
+			warnings = append(warnings, fmt.Sprintf("cart_type $%02x isn't an MBC gbasm supports, so the banks can't be reassembled", rom[0x0147]))
+		}
+
+		for bank := 1; bank < len(rom)/0x4000; bank++ {
+			// the ROM as the CPU sees it with this bank switched in
+			mapped := make([]uint8, 0x8000)
+			copy(mapped, rom[:0x4000])
+			copy(mapped[0x4000:], rom[bank*0x4000:(bank+1)*0x4000])
+			if end := trimZeros(mapped, 0x4000, 0x8000); end > 0x4000 {
+				banks = append(banks, &disBank{bank, decodeRange(mapped, 0x4000, end), map[int]string{0x4000: fmt.Sprintf("bank_%02x", bank)}})
+			}
+		}
+	}
+
+	// only jump and call targets in the code get labels, as that's where a
+	// new section can start. Code in ROMX can only jump to ROM0 or its own
+	// bank.
+	boundaries := insnAddrs(code)
+	addLabels(labels, code, boundaries, "")
+	for _, insns := range vectors {
+		addLabels(labels, insns, boundaries, "")
+	}
+	for _, b := range banks {
+		addLabels(labels, b.insns, boundaries, "")
+		addLabels(b.labels, b.insns, insnAddrs(b.insns), fmt.Sprintf("%02x_", b.bank))
+	}
+
+	lines := []string{"; disassembled by gbasm"}
+	if mbc != "" {
+		lines = append(lines, fmt.Sprintf("; reassemble with -mbc %s", mbc))
+	}
+	lines = append(lines, headerLines...)
+
+	for _, name := range vectorNames {
+		if insns, found := vectors[name]; found {
+			lines = append(lines, "", "."+name)
+			lines = append(lines, formatInsns(insns, labels, insns[0].addr, 0)...)
+		}
+	}
+
+	lines = append(lines, "", ".main")
+	lines = append(lines, formatInsns(code, labels, 0x150, 0)...)
+
+	for _, b := range banks {
+		for addr, label := range labels {
+			b.labels[addr] = label
+		}
+		lines = append(lines, "", fmt.Sprintf(".%s:romx:bank=%d:at=$4000", b.labels[0x4000], b.bank))
+		lines = append(lines, formatInsns(b.insns, b.labels, 0x4000, b.bank)...)
+	}
+
+	return lines, warnings, nil
+}
+
+// trimZeros is where the zero padding at the end of [start, end) starts
+func trimZeros(rom []uint8, start int, end int) int {
+	for end > start && rom[end-1] == 0x00 {
+		end--
+	}
+	return end
+}
+
+func insnAddrs(insns []disInsn) map[int]bool {
+	addrs := make(map[int]bool)
+	for _, insn := range insns {
+		addrs[insn.addr] = true
+	}
+	return addrs
+}
+
+// addLabels labels every jump or call target in insns that's the start of
+// an insn in boundaries, with prefix going before the address
+func addLabels(labels map[int]string, insns []disInsn, boundaries map[int]bool, prefix string) {
+	for _, insn := range insns {
+		if target, isJump := jumpTarget(insn); isJump && boundaries[target] {
+			if _, found := labels[target]; !found {
+				labels[target] = fmt.Sprintf("l_%s%04x", prefix, target)
+			}
+		}
+	}
+}
+
+// disHeader turns the header fields back into 'header' directives, with
+// warnings for anything they can't express
+func disHeader(rom []uint8) ([]string, []string) {
+	lines := []string{}
+	warnings := []string{}
+	number := func(name string, addr int) {
+		if rom[addr] != 0x00 {
+			lines = append(lines, fmt.Sprintf("header %s $%02x", name, rom[addr]))
+		}
+	}
+	keyword := func(name string, addr int) {
+		if rom[addr] == 0x00 {
+			return
+		}
+		for keyword, b := range headerKeywords[name] {
+			if b == rom[addr] {
+				lines = append(lines, fmt.Sprintf("header %s %s", name, keyword))
+				return
+			}
+		}
+		warnings = append(warnings, fmt.Sprintf("header %s $%02x isn't a known value and will be lost", name, rom[addr]))
+	}
+
+	// the CGB flag takes the last byte of the title
+	titleEnd := 0x0144
+	if rom[0x0143]&0x80 != 0 {
+		titleEnd = 0x0143
+	}
+	title := bytes.TrimRight(rom[0x0134:titleEnd], "\x00")
+	if len(title) > 0 {
+		if isPrintable(title) {
+			lines = append(lines, fmt.Sprintf("header title %q", title))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("header title %q isn't printable and will be lost", title))
+		}
+	}
+	if titleEnd == 0x0143 {
+		keyword("cgb", 0x0143)
+	}
+
+	// $33 means the new licensee code at $0144 is used instead, which
+	// gets set for SGB support too
+	if rom[0x014b] == 0x33 && isPrintable(rom[0x0144:0x0146]) {
+		lines = append(lines, fmt.Sprintf("header licensee %q", rom[0x0144:0x0146]))
+	} else {
+		if rom[0x0144] != 0x00 || rom[0x0145] != 0x00 {
+			warnings = append(warnings, fmt.Sprintf("new licensee code %q isn't printable and will be lost", rom[0x0144:0x0146]))
+		}
+		if rom[0x014b] != 0x33 || rom[0x0146] != 0x03 {
+			number("licensee", 0x014b)
+		}
+	}
+	keyword("sgb", 0x0146)
+	number("cart_type", 0x0147)
+	number("rom_size", 0x0148)
+	number("ram_size", 0x0149)
+	keyword("destination", 0x014a)
+	number("version", 0x014c)
+
+	if rom[0x014d] != headerChecksum(rom) {
+		warnings = append(warnings, fmt.Sprintf("header checksum $%02x is wrong, reassembling will fix it", rom[0x014d]))
+	}
+	return lines, warnings
+}
+
+func isPrintable(text []uint8) bool {
+	for _, c := range text {
+		if c < 0x20 || c >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeRange decodes [start, end) one instruction after another. Bytes that
+// aren't a whole, legal instruction become data.
+func decodeRange(rom []uint8, start int, end int) []disInsn {
+	insns := make([]disInsn, 0)
+	for addr := start; addr < end; {
+		opcode := decodeOpcode(rom, addr, end)
+		if opcode == nil {
+			insns = append(insns, disInsn{addr, rom[addr : addr+1], nil})
+			addr++
+			continue
+		}
+		insns = append(insns, disInsn{addr, rom[addr : addr+opcode.Length], opcode})
+		addr += opcode.Length
+	}
+	return insns
+}
+
+func decodeOpcode(rom []uint8, addr int, end int) *sm83.Opcode {
+	var opcode *sm83.Opcode
+	if rom[addr] == 0xcb {
+		if addr+1 >= end {
+			return nil
+		}
+		opcode = sm83.Prefixed[rom[addr+1]]
+	} else {
+		opcode = sm83.Unprefixed[rom[addr]]
+	}
+
+	if opcode == nil || addr+opcode.Length > end {
+		return nil
+	} else if opcode.Mnemonic == "stop" && rom[addr+1] != 0x00 {
+		// only 'stop' followed by $00 reassembles to the same bytes
+		return nil
+	}
+	return opcode
+}
+
+func jumpTarget(insn disInsn) (int, bool) {
+	if insn.opcode == nil {
+		return 0, false
+	}
+	for _, operand := range insn.opcode.Operands {
+		switch operand {
+		case sm83.Addr16:
+			return int(insn.bytes[1]) | int(insn.bytes[2])<<8, true
+		case sm83.Rel8:
+			return insn.addr + 2 + int(int8(insn.bytes[1])), true
+		}
+	}
+	return 0, false
+}
+
+// formatInsns writes out insns, starting a new section at every label
+// except the one at start, which the caller has already written. Sections
+// in a ROMX bank are pinned to their address, since only ROM0 sections carry
+// on from the one before.
+func formatInsns(insns []disInsn, labels map[int]string, start int, bank int) []string {
+	lines := make([]string, 0, len(insns))
+	for i := 0; i < len(insns); i++ {
+		insn := insns[i]
+		if label, found := labels[insn.addr]; found && insn.addr != start {
+			if bank > 0 {
+				label += fmt.Sprintf(":romx:bank=%d:at=$%04x", bank, insn.addr)
+			}
+			lines = append(lines, "", "."+label)
+		}
+
+		if insn.opcode != nil && insn.opcode.Code == 0x00 && !insn.opcode.Prefixed {
+			count := zeroRun(insns[i:], labels)
+			if count >= minZeroRun {
+				lines = append(lines, fmt.Sprintf("  ds %d", count))
+				i += count - 1
+				continue
+			}
+		}
+
+		lines = append(lines, "  "+formatInsn(insn, labels))
+	}
+	return lines
+}
+
+// zeroRun counts nops up to the next label
+func zeroRun(insns []disInsn, labels map[int]string) int {
+	count := 0
+	for _, insn := range insns {
+		if insn.opcode == nil || insn.opcode.Code != 0x00 || insn.opcode.Prefixed {
+			break
+		} else if _, found := labels[insn.addr]; found && count > 0 {
+			break
+		}
+		count++
+	}
+	return count
+}
+
+func formatInsn(insn disInsn, labels map[int]string) string {
+	if insn.opcode == nil {
+		values := make([]string, len(insn.bytes))
+		for i, b := range insn.bytes {
+			values[i] = fmt.Sprintf("$%02x", b)
+		}
+		return "db " + strings.Join(values, ", ")
+	}
+
+	args := make([]string, len(insn.opcode.Operands))
+	valueOffset := 1
+	if insn.opcode.Prefixed {
+		valueOffset = 2
+	}
+	for i, operand := range insn.opcode.Operands {
+		args[i] = formatOperand(operand, insn, valueOffset, labels)
+		valueOffset += sm83.OperandSize(operand)
+	}
+
+	if len(args) == 0 {
+		return insn.opcode.Mnemonic
+	}
+	return insn.opcode.Mnemonic + " " + strings.Join(args, ", ")
+}
+
+func formatOperand(operand string, insn disInsn, offset int, labels map[int]string) string {
+	if !sm83.IsPlaceholder(operand) {
+		return operand
+	}
+
+	value := int(insn.bytes[offset])
+	if sm83.OperandSize(operand) == 2 {
+		value |= int(insn.bytes[offset+1]) << 8
+	}
+
+	switch operand {
+	case sm83.Imm8:
+		return fmt.Sprintf("$%02x", value)
+	case sm83.Imm16:
+		return fmt.Sprintf("$%04x", value)
+	case sm83.Addr16:
+		if label, found := labels[value]; found {
+			return label
+		}
+		return fmt.Sprintf("$%04x", value)
+	case sm83.Mem8:
+		return fmt.Sprintf("($ff%02x)", value)
+	case sm83.Mem16:
+		return fmt.Sprintf("($%04x)", value)
+	case sm83.Offset8:
+		return fmt.Sprintf("%d", int8(value))
+	case sm83.SPOffset:
+		return fmt.Sprintf("sp%+d", int8(value))
+	case sm83.Rel8:
+		// jr takes a label or the raw displacement
+		if label, found := labels[insn.addr+2+int(int8(value))]; found {
+			return label
+		}
+		return fmt.Sprintf("%d", int8(value))
+	}
+	return operand
+}
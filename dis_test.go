@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func compileROM(t *testing.T, filename string, lines []string, options CompileOptions) []uint8 {
+	unit, diags := Parse(filename, lines, ParseOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	rom, _, diags := Compile(unit, options)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	return rom
+}
+
+func checkRoundTrip(t *testing.T, rom []uint8, options CompileOptions) []string {
+	lines, warnings, err := Disassemble(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) > 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+
+	reassembled := compileROM(t, "dis.asm", lines, options)
+	if !bytes.Equal(rom, reassembled) {
+		for i := range rom {
+			if rom[i] != reassembled[i] {
+				t.Fatalf("reassembled ROM differs first at $%04x:\n%s", i, strings.Join(lines, "\n"))
+			}
+		}
+	}
+	return lines
+}
+
+func TestRoundTripExample(t *testing.T) {
+	lines, err := readLines("test.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRoundTrip(t, compileROM(t, "test.asm", lines, CompileOptions{}), CompileOptions{})
+}
+
+func TestRoundTripHeader(t *testing.T) {
+	lines := []string{
+		`header title "ROUND \\ \"TRIP\""`,
+		"header cgb only",
+		"header sgb yes",
+		"header licensee $33",
+		"header cart_type $1b",
+		"header destination overseas",
+		"header version 3",
+		".main",
+		"  halt",
+	}
+	checkRoundTrip(t, compileROM(t, "header.asm", lines, CompileOptions{}), CompileOptions{})
+}
+
+func TestRoundTripAllOpcodes(t *testing.T) {
+	lines := []string{
+		".rst_38",
+		"  jp main",
+		".int_vblank",
+		"  push af",
+		"  call handler",
+		"  pop af",
+		"  reti",
+		".main",
+	}
+	for _, ref := range unprefixedReference {
+		lines = append(lines, "  "+ref.text)
+	}
+	for _, text := range cbReference {
+		lines = append(lines, "  "+text)
+	}
+	lines = append(lines,
+		".handler",
+		"  jr handler",
+		"  jr nz, handler",
+		"  ds 32",
+		// illegal opcodes, stop with a non-zero byte and a cut off insn
+		"  db $d3, $10, $01, $fd",
+		"  ds 20, $ff",
+		"  db $01, $02",
+	)
+	checkRoundTrip(t, compileROM(t, "opcodes.asm", lines, CompileOptions{}), CompileOptions{})
+}
+
+func TestRoundTripBanked(t *testing.T) {
+	lines := []string{
+		".main",
+		"  ld a, bank(far)",
+		"  ld ($2000), a",
+		"  call far",
+		"  jr main",
+		".common",
+		"  ret",
+		".far:romx:bank=2",
+		"  ld b, 3",
+		".far_loop:romx:bank=2",
+		"  dec b",
+		"  jr nz, far_loop",
+		"  call common",
+		"  jp far_loop",
+		".other:romx:bank=3",
+		"  jp other",
+	}
+	options := CompileOptions{MBC: "mbc1"}
+	rom := compileROM(t, "banked.asm", lines, options)
+	if len(rom) != 0x10000 {
+		t.Fatalf("expected a 64 KiB ROM but got %d bytes", len(rom))
+	}
+
+	dis := strings.Join(checkRoundTrip(t, rom, options), "\n")
+	expected := []string{
+		"; reassemble with -mbc mbc1",
+		"  call $4000",
+		".bank_02:romx:bank=2:at=$4000",
+		".l_02_4002:romx:bank=2:at=$4002",
+		"  call l_015a",
+		"  jp l_02_4002",
+		".bank_03:romx:bank=3:at=$4000",
+		"  jp bank_03",
+	}
+	for _, line := range expected {
+		if !strings.Contains(dis, line) {
+			t.Errorf("expected '%s' in:\n%s", line, dis)
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Expr is a parsed constant expression. Leaves are either numbers
+// (Op == "num") or symbol references (Op == "sym"); everything else is a
+// unary or binary operator, or one of the functions in exprFuncs, applied to
+// Args.
+type Expr struct {
+	Op    string
+	Value int
+	Name  string
+	Args  []*Expr
+}
+
+// Symbols resolves names used in expressions to values, and labels to the
+// ROM bank they end up in.
+type Symbols interface {
+	Value(name string) (int, error)
+	Bank(name string) (int, error)
+}
+
+type noSymbols struct{}
+
+func (noSymbols) Value(name string) (int, error) {
+	return 0, errors.New(fmt.Sprintf("unknown symbol '%s'", name))
+}
+
+func (noSymbols) Bank(name string) (int, error) {
+	return 0, errors.New(fmt.Sprintf("unknown label '%s'", name))
+}
+
+// functions that can be called in expressions, e.g. 'high(table)'
+var exprFuncs = map[string]bool{
+	"high": true,
+	"low":  true,
+	"bank": true,
+	"def":  true,
+}
+
+// binary operators from lowest to highest precedence
+var binaryOps = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// sorted so that longer operators are matched first
+var operatorTokens = []string{
+	"||", "&&", "==", "!=", "<=", ">=", "<<", ">>",
+	"|", "^", "&", "<", ">", "+", "-", "*", "/", "%", "~", "!", "(", ")",
+}
+
+type exprToken struct {
+	text  string
+	value int
+	isNum bool
+	isSym bool
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func ParseExpr(text string) (*Expr, error) {
+	tokens, err := tokenizeExpr(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("expected expression")
+	}
+
+	p := &exprParser{tokens, 0}
+	expr, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errors.New(fmt.Sprintf("unexpected '%s' in expression", p.tokens[p.pos].text))
+	}
+	return expr, nil
+}
+
+// evalExpr parses and evaluates an expression that may only contain
+// literal numbers.
+func evalExpr(text string) (int, error) {
+	expr, err := ParseExpr(text)
+	if err != nil {
+		return 0, err
+	}
+	return expr.Eval(noSymbols{})
+}
+
+func tokenizeExpr(text string) ([]exprToken, error) {
+	tokens := make([]exprToken, 0)
+
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '$' || isDigit(c) || c == '%' && expectOperand(tokens) && i+1 < len(text) && (text[i+1] == '0' || text[i+1] == '1'):
+			base := 10
+			start := i
+			if c == '$' {
+				base = 16
+				start++
+			} else if c == '%' {
+				base = 2
+				start++
+			}
+			end := start
+			for end < len(text) && isAlnum(text[end]) {
+				end++
+			}
+			value, err := strconv.ParseUint(text[start:end], base, 32)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid number '%s'", text[i:end]))
+			}
+			tokens = append(tokens, exprToken{text: text[i:end], value: int(value), isNum: true})
+			i = end
+		case isIdentStart(c):
+			end := i + 1
+			for end < len(text) && isIdentChar(text[end]) && !(text[end] == '!' && end+1 < len(text) && text[end+1] == '=') {
+				end++
+			}
+			tokens = append(tokens, exprToken{text: text[i:end], isSym: true})
+			i = end
+		default:
+			found := false
+			for _, op := range operatorTokens {
+				if strings.HasPrefix(text[i:], op) {
+					tokens = append(tokens, exprToken{text: op})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, errors.New(fmt.Sprintf("unexpected character '%c' in expression", c))
+			}
+		}
+	}
+
+	return tokens, nil
+}
+
+// a '%' is a binary literal wherever an operand is expected, otherwise it's
+// the modulo operator
+func expectOperand(tokens []exprToken) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+	last := tokens[len(tokens)-1]
+	return !last.isNum && !last.isSym && last.text != ")"
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlnum(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// labels can contain '!', but in expressions a leading '!' is logical not
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c) || c == '!'
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos].text
+	}
+	return ""
+}
+
+func (p *exprParser) parseBinary(level int) (*Expr, error) {
+	if level == len(binaryOps) {
+		return p.parseUnary()
+	}
+
+	lhs, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := p.peek()
+		matched := false
+		for _, candidate := range binaryOps[level] {
+			if op == candidate {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return lhs, nil
+		}
+		p.pos++
+
+		rhs, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		lhs = &Expr{Op: op, Args: []*Expr{lhs, rhs}}
+	}
+}
+
+func (p *exprParser) parseUnary() (*Expr, error) {
+	switch op := p.peek(); op {
+	case "-", "+", "~", "!":
+		p.pos++
+		arg, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if op == "+" {
+			return arg, nil
+		}
+		return &Expr{Op: op, Args: []*Expr{arg}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (*Expr, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+
+	token := p.tokens[p.pos]
+	p.pos++
+
+	switch {
+	case token.isNum:
+		return &Expr{Op: "num", Value: token.value}, nil
+	case token.isSym && exprFuncs[token.text] && p.peek() == "(":
+		p.pos++
+		arg, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New(fmt.Sprintf("missing ')' after %s(", token.text))
+		}
+		p.pos++
+		if (token.text == "bank" || token.text == "def") && arg.Op != "sym" {
+			return nil, errors.New(fmt.Sprintf("%s() expects a name", token.text))
+		}
+		return &Expr{Op: token.text, Args: []*Expr{arg}}, nil
+	case token.isSym:
+		return &Expr{Op: "sym", Name: token.text}, nil
+	case token.text == "(":
+		expr, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing ')' in expression")
+		}
+		p.pos++
+		return expr, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unexpected '%s' in expression", token.text))
+	}
+}
+
+// SymbolNames returns the names of all symbols referenced in the expression.
+func (e *Expr) SymbolNames() []string {
+	if e.Op == "sym" {
+		return []string{e.Name}
+	}
+	names := make([]string, 0)
+	for _, arg := range e.Args {
+		names = append(names, arg.SymbolNames()...)
+	}
+	return names
+}
+
+// Substitute returns a copy of the expression with every symbol that
+// symbols knows about replaced by its value.
+func (e *Expr) Substitute(symbols Symbols) *Expr {
+	if e.Op == "sym" {
+		if value, err := symbols.Value(e.Name); err == nil {
+			return &Expr{Op: "num", Value: value}
+		}
+		return e
+	}
+
+	out := &Expr{Op: e.Op, Value: e.Value, Name: e.Name}
+	for _, arg := range e.Args {
+		out.Args = append(out.Args, arg.Substitute(symbols))
+	}
+	return out
+}
+
+func (e *Expr) String() string {
+	switch {
+	case e.Op == "num":
+		return strconv.Itoa(e.Value)
+	case e.Op == "sym":
+		return e.Name
+	case exprFuncs[e.Op]:
+		return fmt.Sprintf("%s(%s)", e.Op, e.Args[0])
+	case len(e.Args) == 1:
+		return e.Op + e.Args[0].operandString()
+	default:
+		return fmt.Sprintf("%s %s %s", e.Args[0].operandString(), e.Op, e.Args[1].operandString())
+	}
+}
+
+func (e *Expr) operandString() string {
+	if len(e.Args) == 0 || exprFuncs[e.Op] {
+		return e.String()
+	}
+	return "(" + e.String() + ")"
+}
+
+func (e *Expr) Eval(symbols Symbols) (int, error) {
+	switch e.Op {
+	case "num":
+		return e.Value, nil
+	case "sym":
+		return symbols.Value(e.Name)
+	case "bank":
+		return symbols.Bank(e.Args[0].Name)
+	case "def":
+		// symbols that know about more than just values (like labels that
+		// haven't been placed yet) can say so
+		if definer, ok := symbols.(interface{ Defined(string) bool }); ok {
+			return boolToInt(definer.Defined(e.Args[0].Name)), nil
+		}
+		_, err := symbols.Value(e.Args[0].Name)
+		return boolToInt(err == nil), nil
+	case "&&", "||":
+		// the right side is only evaluated if it matters, so that
+		// 'def(x) && x > 1' works when x isn't defined
+		lhs, err := e.Args[0].Eval(symbols)
+		if err != nil || (lhs != 0) == (e.Op == "||") {
+			return boolToInt(lhs != 0), err
+		}
+		rhs, err := e.Args[1].Eval(symbols)
+		return boolToInt(rhs != 0), err
+	}
+
+	args := make([]int, len(e.Args))
+	for i, arg := range e.Args {
+		value, err := arg.Eval(symbols)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = value
+	}
+
+	if len(args) == 1 {
+		switch e.Op {
+		case "high":
+			return (args[0] >> 8) & 0xff, nil
+		case "low":
+			return args[0] & 0xff, nil
+		case "-":
+			return -args[0], nil
+		case "~":
+			return ^args[0], nil
+		case "!":
+			return boolToInt(args[0] == 0), nil
+		}
+	}
+
+	lhs, rhs := args[0], args[1]
+	switch e.Op {
+	case "|":
+		return lhs | rhs, nil
+	case "^":
+		return lhs ^ rhs, nil
+	case "&":
+		return lhs & rhs, nil
+	case "==":
+		return boolToInt(lhs == rhs), nil
+	case "!=":
+		return boolToInt(lhs != rhs), nil
+	case "<":
+		return boolToInt(lhs < rhs), nil
+	case "<=":
+		return boolToInt(lhs <= rhs), nil
+	case ">":
+		return boolToInt(lhs > rhs), nil
+	case ">=":
+		return boolToInt(lhs >= rhs), nil
+	case "<<":
+		if rhs < 0 {
+			return 0, errors.New(fmt.Sprintf("negative shift count %d", rhs))
+		}
+		return lhs << uint(rhs), nil
+	case ">>":
+		if rhs < 0 {
+			return 0, errors.New(fmt.Sprintf("negative shift count %d", rhs))
+		}
+		return lhs >> uint(rhs), nil
+	case "+":
+		return lhs + rhs, nil
+	case "-":
+		return lhs - rhs, nil
+	case "*":
+		return lhs * rhs, nil
+	case "/":
+		if rhs == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return lhs / rhs, nil
+	case "%":
+		if rhs == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return lhs % rhs, nil
+	}
+
+	return 0, errors.New(fmt.Sprintf("unknown operator '%s'", e.Op))
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEvalExpr(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected int
+	}{
+		// precedence, from highest to lowest
+		{"2 + 3 * 4", 14},
+		{"(2 + 3) * 4", 20},
+		{"10 - 4 - 3", 3},
+		{"1 << 2 + 1", 8},
+		{"1 + 2 < 4", 1},
+		{"1 < 2 == 1", 1},
+		{"6 & 3 == 3", 0},
+		{"1 | 6 & 3", 3},
+		{"1 ^ 3 & 2", 3},
+		{"0 || 1 && 0", 0},
+		{"0 && nope", 0},
+		{"2 || nope", 1},
+		{"-2 * 3", -6},
+		{"~0 & $ff", 0xff},
+		{"!0 + !5", 1},
+
+		// % is binary where an operand is expected, and modulo otherwise
+		{"%1010", 10},
+		{"%101 + 1", 6},
+		{"7 % 3", 1},
+		{"7 %10", 7},
+		{"7%%10", 1},
+		{"-7 % 3", -1},
+
+		{"$ff", 255},
+		{"$10 >> 2", 4},
+		{"17 / 5", 3},
+	}
+	for _, c := range cases {
+		actual, err := evalExpr(c.text)
+		if err != nil {
+			t.Errorf("'%s': %v", c.text, err)
+		} else if actual != c.expected {
+			t.Errorf("'%s': expected %d but got %d", c.text, c.expected, actual)
+		}
+	}
+}
+
+func TestEvalExprErrors(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected string
+	}{
+		{"1 << -1", "negative shift count -1"},
+		{"8 >> (1 - 2)", "negative shift count -1"},
+		{"1 / 0", "division by zero"},
+		{"1 % (2 - 2)", "division by zero"},
+		{"$fg", "invalid number '$fg'"},
+		{"(1 + 2", "missing ')' in expression"},
+		{"1 +", "unexpected end of expression"},
+		{"1 2", "unexpected '2' in expression"},
+		{"1 @ 2", "unexpected character '@' in expression"},
+		{"foo", "unknown symbol 'foo'"},
+	}
+	for _, c := range cases {
+		if actual, err := evalExpr(c.text); err == nil {
+			t.Errorf("'%s': expected an error but got %d", c.text, actual)
+		} else if err.Error() != c.expected {
+			t.Errorf("'%s': expected '%s' but got '%s'", c.text, c.expected, err)
+		}
+	}
+}
+
+func TestExprRange(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected []uint8
+	}{
+		{"ld a, 255", []uint8{0x3e, 0xff}},
+		{"ld a, -128", []uint8{0x3e, 0x80}},
+		{"ld bc, $ffff", []uint8{0x01, 0xff, 0xff}},
+		{"ld bc, -1", []uint8{0x01, 0xff, 0xff}},
+	}
+	for _, c := range cases {
+		checkAssembly(t, c.text, c.expected)
+	}
+
+	outOfRange := []struct {
+		text     string
+		expected string
+	}{
+		{"ld a, 256", "value 256 does not fit in 8 bits"},
+		{"ld a, -129", "value -129 does not fit in 8 bits"},
+		{"ld bc, $10000", "value 65536 does not fit in 16 bits"},
+		{"add sp, 128", "value 128 does not fit in a signed byte (-128..127)"},
+	}
+	for _, c := range outOfRange {
+		if actual, err := assembleText(c.text); err == nil {
+			t.Errorf("'%s': expected a range error but got % x", c.text, actual)
+		} else if !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("'%s': expected '%s' but got '%s'", c.text, c.expected, err)
+		}
+	}
+}
+
+func TestLabelExprs(t *testing.T) {
+	lines := []string{
+		".main",
+		"  ld a, (table)",
+		"  ld a, (table + 1)",
+		"  ld (table + 2), a",
+		"  ld (hl), low(table + 1)",
+		"  ld hl, table + 1",
+		"  ld a, high(table)",
+		"  ld a, bank(table)",
+		"  ld bc, table_end - table",
+		".table:aligned",
+		"  nop",
+		"  nop",
+		".table_end",
+	}
+	unit, diags := Parse("expr.asm", lines, ParseOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	rom, _, diags := Compile(unit, CompileOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	expected := []uint8{0xfa, 0x00, 0x02, 0xfa, 0x01, 0x02, 0xea, 0x02, 0x02, 0x36, 0x01, 0x21, 0x01, 0x02, 0x3e, 0x02, 0x3e, 0x00, 0x01, 0x02, 0x00}
+	if actual := rom[0x0150 : 0x0150+len(expected)]; !bytes.Equal(actual, expected) {
+		t.Errorf("expected\n% x\nbut got\n% x", expected, actual)
+	}
+
+	// without parens it's the address, bare label or not
+	errors := map[string]string{
+		"ld a, table":      "value of 'table' (338) does not fit in 8 bits",
+		"ld a, table + 1":  "value of 'table + 1' (339) does not fit in 8 bits",
+		"ld (hl), table":   "value of 'table' (338) does not fit in 8 bits",
+		"ld (hl), (table)": "'ld (hl), (table)' is not a valid instruction",
+	}
+	for line, message := range errors {
+		unit, diags := Parse("expr.asm", []string{".main", "  " + line, ".table", "  nop"}, ParseOptions{})
+		if diags.HasErrors() {
+			t.Fatal(diags)
+		}
+		if _, _, diags := Compile(unit, CompileOptions{}); len(diags) != 1 || diags[0].Message != message {
+			t.Errorf("expected '%s' for '%s' but got:\n%v", message, line, diags)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// the boot ROM won't start a cartridge without this exact logo at $0104
+var nintendoLogo = [48]uint8{
+	0xce, 0xed, 0x66, 0x66, 0xcc, 0x0d, 0x00, 0x0b, 0x03, 0x73, 0x00, 0x83, 0x00, 0x0c, 0x00, 0x0d,
+	0x00, 0x08, 0x11, 0x1f, 0x88, 0x89, 0x00, 0x0e, 0xdc, 0xcc, 0x6e, 0xe6, 0xdd, 0xdd, 0xd9, 0x99,
+	0xbb, 0xbb, 0x67, 0x63, 0x6e, 0x0e, 0xec, 0xcc, 0xdd, 0xdc, 0x99, 0x9f, 0xbb, 0xb9, 0x33, 0x3e,
+}
+
+// generateHeader is the header with every field left blank, which header
+// fields are written over
+func generateHeader() [0x50]uint8 {
+	// nop; jp $0150
+	header := [0x50]uint8{0x00, 0xc3, 0x50, 0x01}
+	copy(header[0x04:], nintendoLogo[:])
+	return header
+}
+
+// HeaderField is one cartridge header setting from a 'header' directive or
+// a config file, already encoded as the bytes that go at Addr
+type HeaderField struct {
+	Name  string
+	Addr  int
+	Bytes []uint8
+	Pos   Pos
+}
+
+// Header is every field that was set. Anything else is left blank, except
+// the cartridge type and ROM/RAM sizes which come from the MBC and layout.
+type Header []*HeaderField
+
+// the values that keyword fields accept
+var headerKeywords = map[string]map[string]uint8{
+	"cgb":         {"no": 0x00, "supported": 0x80, "only": 0xc0},
+	"sgb":         {"no": 0x00, "yes": 0x03},
+	"destination": {"japan": 0x00, "overseas": 0x01},
+}
+
+// addresses of the one byte numeric fields
+var headerNumbers = map[string]int{
+	"cart_type": 0x0147,
+	"rom_size":  0x0148,
+	"ram_size":  0x0149,
+	"version":   0x014c,
+}
+
+// ParseHeaderField parses 'name value', e.g. 'title "TETRIS"'
+func ParseHeaderField(text string, pos Pos, symbols Symbols) (*HeaderField, error) {
+	name, value := text, ""
+	if i := strings.IndexFunc(text, unicode.IsSpace); i >= 0 {
+		name, value = text[:i], strings.TrimSpace(text[i+1:])
+	}
+	if value == "" {
+		return nil, errors.New(fmt.Sprintf("header field '%s' needs a value", name))
+	}
+	field := &HeaderField{Name: name, Pos: pos}
+
+	if keywords, found := headerKeywords[name]; found {
+		b, found := keywords[value]
+		if !found {
+			names := []string{}
+			for keyword := range keywords {
+				names = append(names, keyword)
+			}
+			sort.Strings(names)
+			return nil, errors.New(fmt.Sprintf("header field '%s' can't be '%s' (expected one of %s)", name, value, strings.Join(names, ", ")))
+		}
+		field.Addr = map[string]int{"cgb": 0x0143, "sgb": 0x0146, "destination": 0x014a}[name]
+		field.Bytes = []uint8{b}
+		return field, nil
+	}
+
+	if addr, found := headerNumbers[name]; found || name == "licensee" && !isString(value) {
+		if name == "licensee" {
+			// the old licensee code, for cartridges from before the SGB
+			addr = 0x014b
+		}
+		expr, err := ParseExpr(value)
+		if err != nil {
+			return nil, err
+		}
+		n, err := expr.Eval(symbols)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || n > 0xff {
+			return nil, errors.New(fmt.Sprintf("header field '%s' has to fit in a byte, got %d", name, n))
+		}
+		field.Addr = addr
+		field.Bytes = []uint8{uint8(n)}
+		return field, nil
+	}
+
+	// the rest are text
+	lengths := map[string][2]int{"title": {1, 16}, "manufacturer": {4, 4}, "licensee": {2, 2}}
+	length, found := lengths[name]
+	if !found {
+		return nil, errors.New(fmt.Sprintf("unknown header field '%s'", name))
+	}
+	if !isString(value) {
+		return nil, errors.New(fmt.Sprintf("header field '%s' has to be a string", name))
+	}
+	str, err := asmString(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range str {
+		if c < 0x20 || c >= 0x7f {
+			return nil, errors.New(fmt.Sprintf("header field '%s' can only have printable ASCII", name))
+		}
+	}
+	if len(str) < length[0] || len(str) > length[1] {
+		if length[0] == length[1] {
+			return nil, errors.New(fmt.Sprintf("header field '%s' has to be %d characters", name, length[0]))
+		}
+		return nil, errors.New(fmt.Sprintf("header field '%s' can be at most %d characters", name, length[1]))
+	}
+	field.Addr = map[string]int{"title": 0x0134, "manufacturer": 0x013f, "licensee": 0x0144}[name]
+	field.Bytes = str
+	return field, nil
+}
+
+// ParseHeaderConfig reads a config file with one field per line, the same
+// as a 'header' directive without the 'header'
+func ParseHeaderConfig(filename string, lines []string) (Header, Diagnostics) {
+	header := Header{}
+	diags := Diagnostics{}
+	for i, text := range lines {
+		column, endColumn := lineSpan(text)
+		pos := Pos{File: filename, Line: uint(i + 1), Column: column, EndColumn: endColumn, Source: text}
+		if text = cleanLine(text); text == "" {
+			continue
+		}
+		field, err := ParseHeaderField(text, pos, noSymbols{})
+		if err != nil {
+			diags.add(posError(pos, err.Error()))
+			continue
+		}
+		header = append(header, field)
+	}
+	return header, diags
+}
+
+// mergeHeaders puts the fields from everywhere together. Setting the same
+// field twice is fine as long as it's set to the same thing.
+func mergeHeaders(headers ...Header) (Header, Diagnostics) {
+	merged := Header{}
+	diags := Diagnostics{}
+	fields := make(map[string]*HeaderField)
+	for _, header := range headers {
+		for _, field := range header {
+			if other, found := fields[field.Name]; !found {
+				fields[field.Name] = field
+				merged = append(merged, field)
+			} else if other.Addr != field.Addr || string(other.Bytes) != string(field.Bytes) {
+				diags.add(posError(field.Pos, fmt.Sprintf("header field '%s' was already set to something else at %s", field.Name, other.Pos)))
+			}
+		}
+	}
+	return merged, diags
+}
+
+func (h Header) field(name string) *HeaderField {
+	for _, field := range h {
+		if field.Name == name {
+			return field
+		}
+	}
+	return nil
+}
+
+// apply writes the fields over the ROM's header, which already has the
+// cartridge type and sizes filled in, and returns the ROM padded out to
+// rom_size if that's bigger. The header checksum has to be worked out after
+// this.
+func (h Header) apply(rom []uint8, mbc MBC) ([]uint8, Diagnostics) {
+	diags := Diagnostics{}
+
+	// the end of the title gets used for the manufacturer and CGB flag
+	if title := h.field("title"); title != nil {
+		maxLength := 16
+		if h.field("manufacturer") != nil {
+			maxLength = 11
+		} else if h.field("cgb") != nil {
+			maxLength = 15
+		}
+		if len(title.Bytes) > maxLength {
+			diags.add(posError(title.Pos, fmt.Sprintf("title can be at most %d characters with the manufacturer or CGB flag set", maxLength)))
+		}
+	}
+
+	// SGB features only work with the new licensee code, which is flagged
+	// by $33 in the old one
+	if sgb := h.field("sgb"); sgb != nil && sgb.Bytes[0] != 0 {
+		if licensee := h.field("licensee"); licensee != nil && licensee.Addr == 0x014b && licensee.Bytes[0] != 0x33 {
+			diags.add(posError(licensee.Pos, "SGB support needs the new licensee code (a string) or $33"))
+		}
+		rom[0x014b] = 0x33
+	}
+	if licensee := h.field("licensee"); licensee != nil && licensee.Addr == 0x0144 {
+		rom[0x014b] = 0x33
+	}
+
+	// the ROM gets padded out to a bigger size, which has to be one the MBC
+	// can switch all the banks of
+	romBanks := len(rom) / 0x4000
+	if romSize := h.field("rom_size"); romSize != nil {
+		if romSize.Bytes[0] < rom[0x0148] {
+			diags.add(posError(romSize.Pos, fmt.Sprintf("rom_size $%02x is smaller than the ROM ($%02x)", romSize.Bytes[0], rom[0x0148])))
+		} else if romSize.Bytes[0] > 8 || 2<<romSize.Bytes[0] > mbc.MaxBanks {
+			diags.add(posError(romSize.Pos, fmt.Sprintf("rom_size $%02x is larger than MBC '%s' can have (%d banks)", romSize.Bytes[0], mbc.Name, mbc.MaxBanks)))
+		} else {
+			romBanks = 2 << romSize.Bytes[0]
+		}
+	}
+
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	if romBanks*0x4000 > len(rom) {
+		padded := make([]uint8, romBanks*0x4000)
+		copy(padded, rom)
+		rom = padded
+	}
+	for _, field := range h {
+		copy(rom[field.Addr:], field.Bytes)
+	}
+	return rom, diags
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHeaderFields(t *testing.T) {
+	lines := []string{
+		"version equ 2",
+		`header title "Hello World"`,
+		`header manufacturer "ABCD"`,
+		"header cgb supported",
+		"header sgb yes",
+		`header licensee "01"`,
+		"header destination overseas",
+		"header version version",
+		"header ram_size $03",
+		".main",
+		"  halt",
+	}
+	rom, _, diags := Compile(parseUnit(t, lines), CompileOptions{MBC: "mbc1"})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	expected := append([]uint8("Hello World"), 'A', 'B', 'C', 'D', 0x80, '0', '1', 0x03, 0x01, 0x00, 0x03, 0x01, 0x33, 0x02)
+	if header := rom[0x0134:0x014d]; !bytes.Equal(header, expected) {
+		t.Errorf("expected header\n% x\nbut got\n% x", expected, header)
+	}
+	if rom[0x014d] != headerChecksum(rom) {
+		t.Errorf("header checksum $%02x is wrong", rom[0x014d])
+	}
+
+	var checksum uint16
+	for i, b := range rom {
+		if i != 0x014e && i != 0x014f {
+			checksum += uint16(b)
+		}
+	}
+	if uint16(rom[0x014e])<<8|uint16(rom[0x014f]) != checksum {
+		t.Errorf("global checksum is wrong")
+	}
+}
+
+func TestHeaderConfig(t *testing.T) {
+	config, diags := ParseHeaderConfig("game.cfg", []string{
+		`title "GAME" ; comment`,
+		"",
+		"version 1",
+	})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	lines := []string{"header version 1", ".main", "  halt"}
+	rom, _, diags := Compile(parseUnit(t, lines), CompileOptions{Header: config})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if string(rom[0x0134:0x0138]) != "GAME" || rom[0x014c] != 1 {
+		t.Errorf("expected the config to set the title and version")
+	}
+
+	lines[0] = "header version 2"
+	_, _, diags = Compile(parseUnit(t, lines), CompileOptions{Header: config})
+	if len(diags) != 1 || diags[0].Message != "header field 'version' was already set to something else at game.cfg:3:1" {
+		t.Errorf("expected a conflict but got:\n%v", diags)
+	}
+}
+
+func TestHeaderErrors(t *testing.T) {
+	expected := map[string]string{
+		"header title":                     "header field 'title' needs a value",
+		"header frob 1":                    "unknown header field 'frob'",
+		"header title 1":                   "header field 'title' has to be a string",
+		`header title "0123456789abcdefg"`: "header field 'title' can be at most 16 characters",
+		`header manufacturer "ABC"`:        "header field 'manufacturer' has to be 4 characters",
+		"header cgb maybe":                 "header field 'cgb' can't be 'maybe' (expected one of no, only, supported)",
+		"header version 256":               "header field 'version' has to fit in a byte, got 256",
+	}
+	for line, message := range expected {
+		_, diags := Parse("header.asm", []string{line, ".main", "  halt"}, ParseOptions{})
+		if len(diags) != 1 || diags[0].Message != message {
+			t.Errorf("expected '%s' for '%s' but got:\n%v", message, line, diags)
+		}
+	}
+
+	lines := []string{`header title "0123456789abcdef"`, "header cgb only", "header rom_size 0", ".main", "  halt", ".big1:romx", "  ds $4000", ".big2:romx", "  ds $4000"}
+	_, _, diags := Compile(parseUnit(t, lines), CompileOptions{MBC: "mbc5"})
+	if len(diags) != 2 {
+		t.Errorf("expected errors for the title and ROM size but got:\n%v", diags)
+	}
+}
+
+func TestHeaderROMSize(t *testing.T) {
+	lines := []string{"header rom_size 2", ".main", "  halt"}
+	rom, _, diags := Compile(parseUnit(t, lines), CompileOptions{MBC: "mbc1"})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if len(rom) != 0x20000 || rom[0x0148] != 0x02 {
+		t.Errorf("expected a 128 KiB ROM with size $02 but got %d bytes with size $%02x", len(rom), rom[0x0148])
+	}
+
+	// sizes the MBC can't switch all the banks of
+	tests := []struct{ mbc, line, message string }{
+		{"", "header rom_size 1", "rom_size $01 is larger than MBC 'none' can have (2 banks)"},
+		{"mbc1", "header rom_size 7", "rom_size $07 is larger than MBC 'mbc1' can have (128 banks)"},
+		{"mbc5", "header rom_size 9", "rom_size $09 is larger than MBC 'mbc5' can have (512 banks)"},
+	}
+	for _, test := range tests {
+		lines[0] = test.line
+		_, _, diags := Compile(parseUnit(t, lines), CompileOptions{MBC: test.mbc})
+		if len(diags) != 1 || diags[0].Message != test.message {
+			t.Errorf("expected '%s' for '%s' but got:\n%v", test.message, test.line, diags)
+		}
+	}
+}
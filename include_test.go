@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes each file under a new temp dir, which is returned
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "gbasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, text := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"consts.inc":     "value equ 7\n",
+		"lib/lib.inc":    "include \"nested.inc\"\n.helper\n  ret\n",
+		"lib/nested.inc": "nested equ 9\n",
+	})
+	defer os.RemoveAll(dir)
+
+	lines := []string{
+		"include \"consts.inc\"",
+		"include \"lib.inc\"",
+		".main",
+		"  ld a, value",
+		"  ld b, nested",
+		"  call helper",
+	}
+	filename := filepath.Join(dir, "main.asm")
+
+	// consts.inc is next to main.asm, and nested.inc is next to lib.inc,
+	// but lib.inc is only found with an include dir
+	_, diags := Parse(filename, lines, ParseOptions{})
+	if len(diags) == 0 || diags[0].Pos.Line != 2 || !strings.HasPrefix(diags[0].Message, "could not find 'lib.inc'") {
+		t.Errorf("expected lib.inc not to be found but got:\n%v", diags)
+	}
+
+	unit, diags := Parse(filename, lines, ParseOptions{IncludeDirs: []string{filepath.Join(dir, "lib")}})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	rom, labelOffsets, diags := Compile(unit, CompileOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	expected := []uint8{0x3e, 0x07, 0x06, 0x09, 0xcd}
+	if actual := rom[0x150 : 0x150+len(expected)]; !bytes.Equal(actual, expected) {
+		t.Errorf("expected % x but got % x", expected, actual)
+	}
+	if pos := unit.Sections["helper"].Pos; pos.File != filepath.Join(dir, "lib", "lib.inc") || pos.Line != 2 {
+		t.Errorf("expected helper to be from lib.inc:2 but got %s", pos)
+	}
+	if _, found := labelOffsets["helper"]; !found {
+		t.Errorf("expected helper to be placed")
+	}
+}
+
+func TestIncludeCycle(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.inc": "include \"b.inc\"\n",
+		"b.inc": "nop_count equ 1\ninclude \"a.inc\"\n",
+	})
+	defer os.RemoveAll(dir)
+
+	_, diags := Parse(filepath.Join(dir, "main.asm"), []string{"include \"a.inc\"", ".main"}, ParseOptions{})
+	if len(diags) != 1 {
+		t.Fatalf("expected 1 error but got:\n%v", diags)
+	}
+
+	// it's reported on the include that closes the loop
+	diag := diags[0]
+	a, b := filepath.Join(dir, "a.inc"), filepath.Join(dir, "b.inc")
+	if diag.Pos.File != b || diag.Pos.Line != 2 || diag.Pos.Column != 9 || diag.Token != "\"a.inc\"" {
+		t.Errorf("expected the error at the include in b.inc but got '%s'", diag)
+	}
+	if expected := "recursive include of '" + a + "' (" + a + " -> " + b + " -> " + a + ")"; diag.Message != expected {
+		t.Errorf("expected '%s' but got '%s'", expected, diag.Message)
+	}
+}
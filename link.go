@@ -0,0 +1,459 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// special sections that go at the rst and interrupt vectors, 8 bytes apart
+var vectorNames = []string{
+	"rst_00",
+	"rst_08",
+	"rst_10",
+	"rst_18",
+	"rst_20",
+	"rst_28",
+	"rst_30",
+	"rst_38",
+	"int_vblank",
+	"int_lcdc",
+	"int_timer",
+	"int_serial",
+	"int_keys",
+}
+
+type LinkOptions struct {
+	// warn about jp whose target is close enough for jr
+	WarnShortJumps bool
+	// the memory bank controller to set up the header and banks for, by
+	// name ("" for none)
+	MBC string
+	// move vectors that are too long for their slot somewhere else, and
+	// put a jp to them in the slot
+	Trampolines bool
+	// header fields from a config file, which are merged with the ones
+	// from 'header' directives
+	Header Header
+}
+
+// Link places the sections of every object in the ROM and patches in the
+// values of their fixups. Sections go in the order of the objects, and in
+// the order they were defined within each one. The label offsets are
+// returned too, for symbol files.
+func Link(objects []*Object, options LinkOptions) ([]uint8, labelOffsets, Diagnostics) {
+	mbc, err := LookupMBC(options.MBC)
+	if err != nil {
+		diags := Diagnostics{}
+		diags.add(err)
+		return nil, nil, diags
+	}
+
+	headers := []Header{options.Header}
+	for _, object := range objects {
+		headers = append(headers, object.Header)
+	}
+	header, diags := mergeHeaders(headers...)
+	if diags.HasErrors() {
+		return nil, nil, diags
+	}
+
+	// WRAMX only switches past bank 1 in CGB mode
+	cgb := header.field("cgb")
+	for _, object := range objects {
+		for _, section := range object.Sections {
+			if section.Region == RegionWRAMX && section.Bank > 1 && (cgb == nil || cgb.Bytes[0] == 0) {
+				diags.add(tokenError(section.Pos, section.Label, fmt.Sprintf("WRAMX bank %d only exists on the CGB (set 'header cgb supported' or 'only')", section.Bank)))
+			}
+		}
+	}
+	if diags.HasErrors() {
+		return nil, nil, diags
+	}
+
+	output, labelOffsets, diags := placeObjects(objects, mbc, options.Trampolines)
+	if diags.HasErrors() {
+		return nil, nil, diags
+	}
+	output, errs := header.apply(output, mbc)
+	if errs.HasErrors() {
+		return nil, nil, errs
+	}
+	output[0x014d] = headerChecksum(output)
+
+	for _, object := range objects {
+		for _, section := range object.Sections {
+			for _, fixup := range section.Fixups {
+				if warning, err := applyFixup(output, labelOffsets[section.Label], fixup, labelOffsets, options); err != nil {
+					diags.add(err)
+				} else if warning != nil {
+					diags = append(diags, warning)
+				}
+			}
+		}
+	}
+
+	// calculate checksum, over everything including the padding
+	var checksum uint = 0
+	for _, b := range output {
+		checksum += uint(b)
+	}
+	output[0x014e] = uint8(checksum >> 8)
+	output[0x014f] = uint8(checksum & 0xff)
+
+	if diags.HasErrors() {
+		return nil, nil, diags
+	}
+	return output, labelOffsets, diags
+}
+
+func applyFixup(output []uint8, section LabelOffset, fixup *Fixup, labelOffsets labelOffsets, options LinkOptions) (*Diagnostic, error) {
+	valueAddr := section.Offset + uint16(fixup.Offset)
+	valueOffset := romOffset(section.bankAt(int(valueAddr)), valueAddr)
+
+	// the first label is what's most likely to be wrong
+	token := fixup.Expr.SymbolNames()[0]
+	targetAddr, err := fixup.Expr.Eval(labelOffsets)
+	if err != nil {
+		return nil, tokenError(fixup.Pos, token, err.Error())
+	}
+
+	// two switchable banks are never mapped in at the same time
+	if fixup.Kind == FixupRelative || fixup.Kind == FixupJump || fixup.Kind == FixupCall {
+		if target := labelOffsets[token]; target.Region == RegionROMX && section.Bank > 0 && section.Bank != target.Bank {
+			return nil, tokenError(fixup.Pos, token, fmt.Sprintf("target label '%s' is in bank %d, which isn't mapped in from bank %d", token, target.Bank, section.Bank))
+		}
+	}
+
+	switch fixup.Kind {
+	case FixupRelative:
+		// the value is the last byte of the jr
+		delta := jrDelta(valueAddr-1, targetAddr)
+		if delta > 127 || delta < -128 { // int8 range
+			return nil, tokenError(fixup.Pos, token, fmt.Sprintf("target label '%s' is out of range (%d)", fixup.Expr, delta))
+		}
+
+		output[valueOffset] = uint8(int8(delta))
+	case FixupByte, FixupHighByte:
+		// ldh addresses are always in the $ff00 page, so only the low
+		// byte gets encoded
+		if fixup.Kind == FixupHighByte {
+			if targetAddr < 0xff00 || targetAddr > 0xffff {
+				return nil, tokenError(fixup.Pos, token, fmt.Sprintf("'%s' ($%04x) isn't in $ff00-$ffff, so ldh can't reach it", fixup.Expr, targetAddr))
+			}
+			targetAddr &= 0xff
+		}
+		if targetAddr < -0x80 || targetAddr > 0xff {
+			return nil, tokenError(fixup.Pos, token, fmt.Sprintf("value of '%s' (%d) does not fit in 8 bits", fixup.Expr, targetAddr))
+		}
+
+		output[valueOffset] = uint8(targetAddr)
+	case FixupWord, FixupJump, FixupCall:
+		if targetAddr < -0x8000 || targetAddr > 0xffff {
+			return nil, tokenError(fixup.Pos, token, fmt.Sprintf("value of '%s' (%d) does not fit in 16 bits", fixup.Expr, targetAddr))
+		}
+
+		// inject absolute
+		output[valueOffset] = uint8(targetAddr & 0xff)
+		output[valueOffset+1] = uint8(targetAddr >> 8)
+
+		if options.WarnShortJumps && fixup.Kind == FixupJump {
+			// a jr is a byte shorter, which moves a target after it a
+			// byte closer
+			delta := jrDelta(valueAddr-1, targetAddr)
+			if delta > 0 {
+				delta--
+			}
+			if delta <= 127 && delta >= -128 {
+				return tokenWarning(fixup.Pos, token, fmt.Sprintf("'%s' is close enough for 'jr', which is a byte shorter", token)), nil
+			}
+		}
+	default:
+		return nil, posError(fixup.Pos, fmt.Sprintf("unknown fixup kind '%s'", fixup.Kind))
+	}
+	return nil, nil
+}
+
+// chunk is a section with placement attributes, and the plain ROM0
+// sections after it, which stay right after it so code can fall through
+// from one to the next
+type chunk struct {
+	Sections []*ObjectSection
+	Size     int
+}
+
+func (c *chunk) head() *ObjectSection {
+	return c.Sections[0]
+}
+
+// chunks splits every object's sections into chunks, leaving out vectors
+// because they each have their own slot
+func chunks(objects []*Object) []*chunk {
+	chunks := []*chunk{}
+	for _, object := range objects {
+		var current *chunk
+		for _, section := range object.Sections {
+			if isVector(section.Label) {
+				current = nil
+				continue
+			}
+
+			isPlain := section.Placement == newPlacement() && section.Label != "main"
+			if !isPlain || current == nil || current.head().Region != "" && current.head().Region != RegionROM0 {
+				current = &chunk{}
+				chunks = append(chunks, current)
+			}
+			current.Sections = append(current.Sections, section)
+			current.Size += len(section.Bytes)
+		}
+	}
+	return chunks
+}
+
+// placeObjects lays out every section, without applying fixups. Sections
+// are placed in chunks: the ones with a fixed address go first, then the
+// rest go in the first gap that fits them, in ROM0, ROMX and then RAM.
+// Floating ROM0 chunks start after main. The output is padded to a size
+// the MBC can have, with the header set up to match.
+//
+// Vectors longer than their 8 byte slot are an error, unless trampolines
+// is set, in which case they're placed like any other ROM0 section with a
+// jp to them in the slot.
+func placeObjects(objects []*Object, mbc MBC, trampolines bool) ([]uint8, labelOffsets, Diagnostics) {
+	diags := Diagnostics{}
+
+	sections := make(map[string]*ObjectSection)
+	for _, object := range objects {
+		for _, section := range object.Sections {
+			if other, found := sections[section.Label]; found {
+				diags.add(tokenError(section.Pos, section.Label, fmt.Sprintf("duplicate label '%s' (also defined at %s)", section.Label, other.Pos)))
+				continue
+			}
+			sections[section.Label] = section
+		}
+	}
+	if _, found := sections["main"]; !found {
+		diags.add(errors.New("label 'main' is not defined"))
+	}
+	for _, label := range append([]string{"main"}, vectorNames...) {
+		if section, found := sections[label]; !found {
+			continue
+		} else if section.Region != "" && section.Region != RegionROM0 {
+			diags.add(tokenError(section.Pos, section.Label, fmt.Sprintf("'%s' has to be in ROM0", section.Label)))
+		} else if section.At >= 0 || section.Align > 1 {
+			diags.add(tokenError(section.Pos, section.Label, fmt.Sprintf("'%s' always goes at a fixed address, so it can't be moved", section.Label)))
+		}
+	}
+	if diags.HasErrors() {
+		return nil, nil, diags
+	}
+
+	// for resolving labels
+	labelOffsets := labelOffsets{}
+	romEnd := 0x0150
+	place := func(c *chunk, w window, addr int) {
+		for _, section := range c.Sections {
+			offset := w.offset(addr)
+			bank := w.Bank
+			if w.Space == "rom" {
+				// see LabelOffset.bankAt
+				bank = offset >> 14
+				if offset+len(section.Bytes) > romEnd {
+					romEnd = offset + len(section.Bytes)
+				}
+			}
+
+			labelOffsets[section.Label] = LabelOffset{
+				section.Label,
+				uint16(addr),
+				bank,
+				section.Region,
+				len(section.Bytes),
+				section.InsnOffsets,
+			}
+			addr += len(section.Bytes)
+		}
+	}
+
+	// the special sections and the header are always in the same place
+	rom0 := window{"rom", 0, 0x0000, 0x4000}
+	allocated := allocator{}
+	chunks := chunks(objects)
+	trampolined := make(map[string]bool)
+	for idx, label := range vectorNames {
+		section, found := sections[label]
+		if !found {
+			continue
+		}
+
+		allocated.reserve(rom0.Space, idx*0x08, idx*0x08+0x08, label)
+		if len(section.Bytes) <= 0x08 {
+			place(&chunk{[]*ObjectSection{section}, len(section.Bytes)}, rom0, idx*0x08)
+		} else if trampolines {
+			chunks = append(chunks, &chunk{[]*ObjectSection{section}, len(section.Bytes)})
+			trampolined[label] = true
+		} else {
+			diags.add(tokenError(section.Pos, section.Label, fmt.Sprintf("'%s' is %d bytes, which doesn't fit in its 8 byte slot at $%04x (use -trampoline to move it)", section.Label, len(section.Bytes), idx*0x08)))
+		}
+	}
+	allocated.reserve(rom0.Space, 0x0100, 0x0150, "the header")
+
+	// then main and fixed addresses, with main first so anything in its way
+	// gets the blame
+	fixed := append([]*chunk{}, chunks...)
+	sort.SliceStable(fixed, func(i, j int) bool {
+		return fixed[i].head().Label == "main" && fixed[j].head().Label != "main"
+	})
+	for _, c := range fixed {
+		section := c.head()
+		at := section.At
+		if section.Label == "main" {
+			at = 0x0150
+		} else if at < 0 {
+			continue
+		}
+
+		windows, err := section.windows(mbc)
+		if err != nil {
+			diags.add(tokenError(section.Pos, section.Label, err.Error()))
+			continue
+		}
+
+		// every bank has the same addresses
+		w := windows[0]
+		name := regions[section.Region].Name
+		if section.Region == "" {
+			name = regions[RegionROM0].Name
+		}
+		end := at + c.Size
+		if at < w.Start || at >= w.End {
+			diags.add(tokenError(section.Pos, section.Label, fmt.Sprintf("section '%s' at $%04x isn't in %s ($%04x-$%04x)", section.Label, at, name, w.Start, w.End-1)))
+			continue
+		} else if end > w.End {
+			diags.add(tokenError(section.Pos, section.Label, fmt.Sprintf("section '%s' at $%04x (%d bytes) goes past the end of %s", section.Label, at, c.Size, name)))
+			continue
+		}
+
+		// the first bank where the address is free, if it could be any
+		placed, other := false, ""
+		for _, w := range windows {
+			if blocker := allocated.reserve(w.Space, w.offset(at), w.offset(at)+c.Size, section.Label); blocker == "" {
+				place(c, w, at)
+				placed = true
+				break
+			} else if other == "" {
+				other = blocker
+			}
+		}
+		if !placed {
+			diags.add(tokenError(section.Pos, section.Label, fmt.Sprintf("section '%s' at $%04x-$%04x overlaps '%s'", section.Label, at, end-1, other)))
+		}
+	}
+
+	// everything else, first fit
+	for _, region := range regionNames {
+		for _, c := range chunks {
+			section := c.head()
+			if _, found := labelOffsets[section.Label]; found || section.At >= 0 || section.Label == "main" {
+				continue
+			} else if section.Region != region && !(region == RegionROM0 && section.Region == "") {
+				continue
+			} else if region == RegionSRAM && !mbc.IsBanked() {
+				diags.add(tokenError(section.Pos, section.Label, fmt.Sprintf("section '%s' is in SRAM, which needs an MBC", section.Label)))
+				continue
+			}
+
+			windows, err := section.windows(mbc)
+			if err != nil {
+				diags.add(tokenError(section.Pos, section.Label, err.Error()))
+				continue
+			}
+
+			placed := false
+			for _, w := range windows {
+				start := w.Start
+				if region == RegionROM0 {
+					start = 0x0150
+				}
+				offset, found := allocated.firstFit(w.Space, w.offset(start), w.offset(w.End-1)+1, c.Size, section.Placement)
+				if found {
+					// offsets and addresses only differ by a multiple of
+					// the bank size
+					allocated.reserve(w.Space, offset, offset+c.Size, section.Label)
+					place(c, w, start+offset-w.offset(start))
+					placed = true
+					break
+				}
+			}
+			if !placed {
+				where := regions[region].Name
+				if section.Bank >= 0 {
+					where = fmt.Sprintf("%s bank %d", where, section.Bank)
+				} else if region == RegionROMX {
+					where = "any ROMX bank"
+				}
+				hint := ""
+				if region == RegionROMX && !mbc.IsBanked() {
+					hint = ", use an MBC for more banks"
+				}
+				diags.add(tokenError(section.Pos, section.Label, fmt.Sprintf("section '%s' (%d bytes) doesn't fit in %s%s", section.Label, c.Size, where, hint)))
+			}
+		}
+	}
+
+	// pad to a real ROM size
+	banks := romBanks((romEnd + 0x3fff) / 0x4000)
+	output := make([]uint8, banks*0x4000)
+
+	header := generateHeader()
+	copy(output[0x0100:], header[:])
+	for _, object := range objects {
+		for _, section := range object.Sections {
+			labelOffset, found := labelOffsets[section.Label]
+			if !found || isRAMRegion(section.Region) {
+				continue
+			}
+			copy(output[romOffset(labelOffset.Bank, labelOffset.Offset):], section.Bytes)
+		}
+	}
+	for idx, label := range vectorNames {
+		if trampolined[label] {
+			addr := labelOffsets[label].Offset
+			copy(output[idx*0x08:], []uint8{0xc3, uint8(addr & 0xff), uint8(addr >> 8)})
+		}
+	}
+
+	output[0x0147] = mbc.CartType
+	output[0x0148] = romSize(banks)
+	sramBanks := 0
+	for _, labelOffset := range labelOffsets {
+		if labelOffset.Region == RegionSRAM && labelOffset.Bank >= sramBanks {
+			sramBanks = labelOffset.Bank + 1
+		}
+	}
+	if sramBanks > 0 {
+		output[0x0147] = mbc.CartTypeRAM
+		output[0x0149] = ramSize(sramBanks)
+	}
+
+	return output, labelOffsets, diags
+}
+
+func isVector(label string) bool {
+	for _, name := range vectorNames {
+		if name == label {
+			return true
+		}
+	}
+	return false
+}
+
+// headerChecksum is the byte at $014d that the boot ROM checks before it
+// runs anything
+func headerChecksum(rom []uint8) uint8 {
+	checksum := uint8(0)
+	for _, b := range rom[0x0134:0x014d] {
+		checksum = checksum - b - 1
+	}
+	return checksum
+}
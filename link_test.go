@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+var linkSources = [][]string{
+	{
+		".main",
+		"  call helper",
+		"  ld a, (counter)",
+		"  jr main",
+		".rst_38",
+		"  jp helper + 1",
+	},
+	{
+		".helper",
+		"  ld hl, main",
+		"  ret",
+		".counter:aligned",
+		"  db low(counter), bank(helper)",
+	},
+}
+
+func buildObject(t *testing.T, file string, lines []string) *Object {
+	unit, diags := Parse(file, lines, ParseOptions{AllowUndefinedLabels: true})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	object, diags := BuildObject(unit, file)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	// everything should survive being written out and read back in
+	var buffer bytes.Buffer
+	if err := object.Write(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadObject(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return read
+}
+
+func TestLinkMatchesCompile(t *testing.T) {
+	a := buildObject(t, "a.asm", linkSources[0])
+	b := buildObject(t, "b.asm", linkSources[1])
+
+	if !reflect.DeepEqual(a.Exports, []string{"main", "rst_38"}) || !reflect.DeepEqual(a.Imports, []string{"helper", "counter"}) {
+		t.Errorf("unexpected exports %v and imports %v", a.Exports, a.Imports)
+	}
+
+	linked, _, diags := Link([]*Object{a, b}, LinkOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	all := append(append([]string{}, linkSources[0]...), linkSources[1]...)
+	compiled, _, diags := Compile(parseUnit(t, all), CompileOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	if !bytes.Equal(linked, compiled) {
+		t.Errorf("linked ROM differs from the compiled one")
+	}
+}
+
+func TestLinkErrors(t *testing.T) {
+	a := buildObject(t, "a.asm", linkSources[0])
+	b := buildObject(t, "b.asm", linkSources[1])
+
+	// one for each usage, like Parse
+	if _, _, diags := Link([]*Object{a}, LinkOptions{}); len(diags) != 3 {
+		t.Errorf("expected errors for 'helper' (twice) and 'counter' but got:\n%v", diags)
+	}
+	if _, _, diags := Link([]*Object{a, b, b}, LinkOptions{}); len(diags) != 2 {
+		t.Errorf("expected duplicate label errors for 'helper' and 'counter' but got:\n%v", diags)
+	}
+	if _, _, diags := Link([]*Object{b}, LinkOptions{}); !diags.HasErrors() {
+		t.Errorf("expected an error for missing 'main'")
+	}
+}
+
+func TestReadObjectVersion(t *testing.T) {
+	if _, err := ReadObject(bytes.NewBufferString(`{"Version": 999}`)); err == nil {
+		t.Errorf("expected an error for an unknown version")
+	}
+}
+
+var bankedSource = []string{
+	".main",
+	"  ld a, bank(big2)",
+	"  ld ($2000), a",
+	"  call big2",
+	".big1:romx",
+	"  ds $3000",
+	"  ret",
+	".big2:romx",
+	"  ds $3000",
+	"  ret",
+	".small:romx:aligned",
+	"  ds $800",
+}
+
+func TestLinkBanks(t *testing.T) {
+	object, diags := BuildObject(parseUnit(t, bankedSource), "")
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	mbc, _ := LookupMBC("mbc5")
+	rom, labelOffsets, diags := placeObjects([]*Object{object}, mbc, false)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	expected := map[string][2]int{
+		"big1":  {1, 0x4000},
+		"big2":  {2, 0x4000},
+		"small": {1, 0x7100},
+	}
+	for label, bankOffset := range expected {
+		if labelOffset := labelOffsets[label]; labelOffset.Bank != bankOffset[0] || int(labelOffset.Offset) != bankOffset[1] {
+			t.Errorf("expected '%s' at %02x:%04x but got %02x:%04x", label, bankOffset[0], bankOffset[1], labelOffset.Bank, labelOffset.Offset)
+		}
+	}
+
+	// 3 banks round up to 4
+	if len(rom) != 0x10000 || rom[0x0147] != 0x19 || rom[0x0148] != 0x01 {
+		t.Errorf("expected a 64 KiB MBC5 ROM but got %d bytes with type %02x and size %02x", len(rom), rom[0x0147], rom[0x0148])
+	}
+
+	linked, _, diags := Link([]*Object{object}, LinkOptions{MBC: "mbc5"})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if linked[0x0151] != 0x02 || linked[0x8000+0x3000] != 0xc9 {
+		t.Errorf("expected bank(big2) to be 2 and big2 to be at $8000 in the ROM")
+	}
+}
+
+func TestLinkFlatROM(t *testing.T) {
+	// without an MBC, big runs past $4000 and its jp is patched in bank 1
+	lines := []string{".main", "  halt", ".big:at=$3ffe", "  nop", "  nop", "  jp big"}
+	rom, _, diags := Compile(parseUnit(t, lines), CompileOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if !bytes.Equal(rom[0x4000:0x4003], []uint8{0xc3, 0xfe, 0x3f}) || rom[0x0001] != 0x00 {
+		t.Errorf("expected 'jp $3ffe' at $4000 but got % x", rom[0x4000:0x4003])
+	}
+}
+
+func TestLinkLabelFunctions(t *testing.T) {
+	objects := []*Object{
+		buildObject(t, "main.asm", []string{
+			".main",
+			"  ld a, high(table)",
+			"  ld a, low(table)",
+			"  ld a, bank(table)",
+			"  ld a, high(table + $ff)",
+			"  ld a, bank(main)",
+			"  ld hl, table",
+			"  ld a, high(other)",
+			"  ld a, low(other)",
+		}),
+		buildObject(t, "data.asm", []string{
+			".table:romx:bank=3:at=$5234",
+			"  db high(main), low(main), bank(other)",
+			".other:romx:bank=2:at=$4010",
+			"  db bank(table)",
+		}),
+	}
+	rom, _, diags := Link(objects, LinkOptions{MBC: "mbc5"})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	expected := map[int][]uint8{
+		0x0150: {
+			0x3e, 0x52, // high(table)
+			0x3e, 0x34, // low(table)
+			0x3e, 0x03, // bank(table)
+			0x3e, 0x53, // high(table + $ff)
+			0x3e, 0x00, // bank(main)
+			0x21, 0x34, 0x52, // ld hl, table
+			0x3e, 0x40, // high(other)
+			0x3e, 0x10, // low(other)
+		},
+		romOffset(3, 0x5234): {0x01, 0x50, 0x02},
+		romOffset(2, 0x4010): {0x03},
+	}
+	for offset, bytes := range expected {
+		for i, b := range bytes {
+			if rom[offset+i] != b {
+				t.Errorf("expected $%02x at offset $%05x but got $%02x", b, offset+i, rom[offset+i])
+			}
+		}
+	}
+}
+
+func TestLinkBankErrors(t *testing.T) {
+	// without an MBC there's only bank 1
+	diags := linkDiagnostics(t, bankedSource, "")
+	if len(diags) != 1 || diags[0].Token != "big2" {
+		t.Errorf("expected big2 not to fit but got:\n%v", diags)
+	}
+
+	lines := append([]string{}, bankedSource...)
+	lines[9] = "  jr big1"
+	diags = linkDiagnostics(t, lines, "mbc1")
+	if len(diags) != 1 || diags[0].Message != "target label 'big1' is in bank 1, which isn't mapped in from bank 2" {
+		t.Errorf("expected a bank error but got:\n%v", diags)
+	}
+
+	// calls need their target mapped in too
+	lines[9] = "  call big1"
+	diags = linkDiagnostics(t, lines, "mbc1")
+	if len(diags) != 1 || diags[0].Message != "target label 'big1' is in bank 1, which isn't mapped in from bank 2" {
+		t.Errorf("expected a bank error for call but got:\n%v", diags)
+	}
+	lines[9] = "  jp big1 + 1"
+	diags = linkDiagnostics(t, lines, "mbc1")
+	if len(diags) != 1 || diags[0].Message != "target label 'big1' is in bank 1, which isn't mapped in from bank 2" {
+		t.Errorf("expected a bank error for jp but got:\n%v", diags)
+	}
+
+	lines[0] = ".main:romx"
+	diags = linkDiagnostics(t, lines, "mbc1")
+	if len(diags) != 1 || diags[0].Message != "'main' has to be in ROM0" {
+		t.Errorf("expected main to be in ROM0 but got:\n%v", diags)
+	}
+
+	diags = linkDiagnostics(t, lines, "mbc2")
+	if len(diags) != 1 || !diags.HasErrors() {
+		t.Errorf("expected an unknown MBC but got:\n%v", diags)
+	}
+}
+
+func linkDiagnostics(t *testing.T, lines []string, mbc string) Diagnostics {
+	object, diags := BuildObject(parseUnit(t, lines), "")
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	_, _, diags = Link([]*Object{object}, LinkOptions{MBC: mbc})
+	return diags
+}
+
+func TestLinkRAM(t *testing.T) {
+	lines := []string{
+		".main",
+		"  ldh a, (joypad)",
+		"  ld (player), a",
+		"  ld hl, save",
+		".player:wram0",
+		"  ds 3",
+		".buffer:wram0:aligned",
+		"  ds $100",
+		".joypad:hram",
+		"  ds 1",
+		".save:sram",
+		"  ds 16",
+	}
+	object, diags := BuildObject(parseUnit(t, lines), "")
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	rom, _, diags := Link([]*Object{object}, LinkOptions{MBC: "mbc1"})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	expected := []uint8{
+		0xf0, 0x80, // ldh a, ($ff80)
+		0xea, 0x00, 0xc0, // ld ($c000), a
+		0x21, 0x00, 0xa0, // ld hl, $a000
+	}
+	if !bytes.Equal(rom[0x0150:0x0150+len(expected)], expected) {
+		t.Errorf("expected % x but got % x", expected, rom[0x0150:0x0150+len(expected)])
+	}
+	// no ROM bytes for any of the RAM
+	if len(rom) != 0x8000 || rom[0x0147] != 0x03 || rom[0x0149] != 0x02 {
+		t.Errorf("expected a 32 KiB ROM with battery backed RAM but got %d bytes with type %02x and RAM size %02x", len(rom), rom[0x0147], rom[0x0149])
+	}
+
+	mbc, _ := LookupMBC("mbc1")
+	_, labelOffsets, _ := placeObjects([]*Object{object}, mbc, false)
+	if labelOffsets["buffer"].Offset != 0xc100 {
+		t.Errorf("expected buffer to be aligned to $c100 but got $%04x", labelOffsets["buffer"].Offset)
+	}
+}
+
+func TestLinkRAMErrors(t *testing.T) {
+	lines := []string{
+		".main",
+		"  ldh a, (stack)",
+		".stack:hram",
+		"  ds $7f",
+		".too_much:hram",
+		"  ds 1",
+		".save:sram",
+		"  ds 1",
+	}
+	diags := linkDiagnostics(t, lines, "")
+	expected := []string{
+		"section 'save' is in SRAM, which needs an MBC",
+		"section 'too_much' (1 bytes) doesn't fit in HRAM",
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("expected %d errors but got:\n%v", len(expected), diags)
+	}
+	for i, diag := range diags {
+		if diag.Message != expected[i] {
+			t.Errorf("expected '%s' but got '%s'", expected[i], diag.Message)
+		}
+	}
+
+	lines = []string{
+		".main",
+		"  ldh a, (player)",
+		".player:wram0",
+		"  ds 1",
+	}
+	diags = linkDiagnostics(t, lines, "")
+	if len(diags) != 1 || diags[0].Message != "'player' ($c000) isn't in $ff00-$ffff, so ldh can't reach it" {
+		t.Errorf("expected an ldh error but got:\n%v", diags)
+	}
+
+	// only the CGB has WRAMX banks past 1
+	lines = []string{".main", "  halt", ".vars:wramx:bank=2", "  ds 1"}
+	diags = linkDiagnostics(t, lines, "")
+	if len(diags) != 1 || diags[0].Message != "WRAMX bank 2 only exists on the CGB (set 'header cgb supported' or 'only')" {
+		t.Errorf("expected a CGB error but got:\n%v", diags)
+	}
+	diags = linkDiagnostics(t, append([]string{"header cgb only"}, lines...), "")
+	if len(diags) != 0 {
+		t.Errorf("expected bank 2 to be fine on the CGB but got:\n%v", diags)
+	}
+
+	_, diags = Parse("ram.asm", []string{".vars:wramx", "  ds 2, $ff", "  nop"}, ParseOptions{})
+	if len(diags) != 2 {
+		t.Errorf("expected errors for the fill value and nop but got:\n%v", diags)
+	}
+}
+
+func TestLinkPlacement(t *testing.T) {
+	lines := []string{
+		".main",
+		"  nop",
+		".table:align=$100",
+		"  ds $10",
+		".after",
+		"  ret",
+		".small:align=$10",
+		"  ds 4",
+		".pinned:at=$1000",
+		"  db 1",
+		".vram_copy:at=$68",
+		"  ret",
+		".offset:align=$100:offset=$80",
+		"  db 2",
+		".banked:bank=3",
+		"  db 3",
+		".romx_fixed:romx:at=$4000",
+		"  db 4",
+		".romx_fixed2:romx:at=$4000",
+		"  db 5",
+		".wram_fixed:at=$c100",
+		"  ds 2",
+		".wram_float:wram0",
+		"  ds $200",
+	}
+	object, diags := BuildObject(parseUnit(t, lines), "")
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	mbc, _ := LookupMBC("mbc5")
+	rom, labelOffsets, diags := placeObjects([]*Object{object}, mbc, false)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	expected := map[string][2]int{
+		"table":     {0, 0x0200},
+		"after":     {0, 0x0210}, // follows table
+		"small":     {0, 0x0160}, // in the gap before table
+		"pinned":    {0, 0x1000},
+		"vram_copy": {0, 0x0068},
+		"offset":    {0, 0x0180},
+		"banked":    {3, 0x4000},
+		// the first bank where $4000 is free
+		"romx_fixed":  {1, 0x4000},
+		"romx_fixed2": {2, 0x4000},
+		"wram_fixed":  {0, 0xc100},
+		"wram_float":  {0, 0xc102}, // too big for the gap before wram_fixed
+	}
+	for label, bankOffset := range expected {
+		if labelOffset := labelOffsets[label]; labelOffset.Bank != bankOffset[0] || int(labelOffset.Offset) != bankOffset[1] {
+			t.Errorf("expected '%s' at %02x:%04x but got %02x:%04x", label, bankOffset[0], bankOffset[1], labelOffset.Bank, labelOffset.Offset)
+		}
+	}
+	if rom[0x1000] != 1 || rom[0x0068] != 0xc9 || rom[0x0180] != 2 || rom[3*0x4000] != 3 {
+		t.Errorf("sections weren't copied to where they were placed")
+	}
+}
+
+func TestLinkPlacementErrors(t *testing.T) {
+	lines := []string{
+		".main",
+		"  nop",
+		".sa:at=$1000",
+		"  ds 4",
+		".sb:at=$1002",
+		"  db 1",
+		".sc:at=$150",
+		"  db 1",
+		".sd:at=$3fff",
+		"  dw 0",
+		".se:bank=200",
+		"  db 0",
+		".sf:bank=$20",
+		"  db 0",
+	}
+	diags := linkDiagnostics(t, lines, "mbc1")
+	expected := []string{
+		"section 'sb' at $1002-$1002 overlaps 'sa'",
+		"section 'sc' at $0150-$0150 overlaps 'main'",
+		"section 'sd' at $3fff (2 bytes) goes past the end of ROM0",
+		"bank 200 doesn't exist with MBC 'mbc1' (which has up to 127)",
+		"MBC 'mbc1' can't switch to bank $20",
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("expected %d errors but got:\n%v", len(expected), diags)
+	}
+	for i, diag := range diags {
+		if diag.Message != expected[i] {
+			t.Errorf("expected '%s' but got '%s'", expected[i], diag.Message)
+		}
+	}
+}
+
+func TestSectionAttributeErrors(t *testing.T) {
+	expected := map[string]string{
+		".x:align=3":          "alignment $3 has to be a power of two up to $4000",
+		".x:at=$e000":         "address $e000 isn't in ROM or RAM",
+		".x:offset=4":         "offset $4 has to be less than the alignment $1",
+		".x:wram0:bank=2":     "WRAM0 can't be in bank 2 (expected 0-0)",
+		".x:frob":             "unknown section attribute 'frob'",
+		".x:at":               "section attribute 'at' needs a value, e.g. 'at=$100'",
+		".x:aligned=1":        "section attribute 'aligned' doesn't take a value",
+		".x:at=$101:align=2":  "address $0101 isn't aligned to $2 (offset $0)",
+		".x:romx:hram":        "a section can't be in both romx and hram",
+		".x:at=$4000:bank=$0": "ROMX can't be in bank 0 (expected 1-511)",
+	}
+	for line, message := range expected {
+		_, diags := Parse("attrs.asm", []string{line}, ParseOptions{})
+		if len(diags) != 1 || diags[0].Message != message {
+			t.Errorf("expected '%s' for '%s' but got:\n%v", message, line, diags)
+		}
+	}
+}
+
+func TestLinkVectorOverflow(t *testing.T) {
+	lines := []string{
+		".main",
+		"  halt",
+		".int_vblank",
+		"  push af",
+		"  push bc",
+		"  ld a, 1",
+		"  ld b, a",
+		"  ld (vblanks), a",
+		"  pop bc",
+		"  pop af",
+		"  reti",
+		".vblanks:wram0",
+		"  ds 1",
+	}
+	diags := linkDiagnostics(t, lines, "")
+	if len(diags) != 1 || diags[0].Message != "'int_vblank' is 11 bytes, which doesn't fit in its 8 byte slot at $0040 (use -trampoline to move it)" {
+		t.Errorf("expected a vector overflow but got:\n%v", diags)
+	}
+
+	object, diags := BuildObject(parseUnit(t, lines), "")
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	rom, _, diags := Link([]*Object{object}, LinkOptions{Trampolines: true})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	// the handler goes right after main, with its fixup applied there
+	expected := []uint8{0xc3, 0x51, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00}
+	if !bytes.Equal(rom[0x0040:0x0048], expected) {
+		t.Errorf("expected a jp to $0151 in the slot but got % x", rom[0x0040:0x0048])
+	}
+	if rom[0x0151] != 0xf5 || rom[0x0156] != 0xea || rom[0x0157] != 0x00 || rom[0x0158] != 0xc0 {
+		t.Errorf("expected the handler at $0151 but got % x", rom[0x0151:0x015e])
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// LinkMap is where everything ended up, bank by bank
+type LinkMap struct {
+	Banks []*MapBank
+}
+
+// MapBank is one bank of a region, with End exclusive
+type MapBank struct {
+	Region   string
+	Bank     int
+	Start    int
+	End      int
+	Used     int
+	Free     int
+	Sections []*MapSection
+}
+
+// MapSection is a section and the plain ones after it that were placed
+// with it, which are its symbols. Padding is the gap left before it to
+// align it.
+type MapSection struct {
+	Name    string
+	Start   int
+	End     int
+	Size    int
+	Padding int
+	Symbols []*MapSymbol
+}
+
+type MapSymbol struct {
+	Name string
+	Addr int
+}
+
+// BuildLinkMap works out the layout from what Link returned. Every bank in
+// the ROM is included, but RAM regions only if something is in them.
+func BuildLinkMap(objects []*Object, labelOffsets labelOffsets, romSize int) *LinkMap {
+	linkMap := &LinkMap{}
+	banks := make(map[string]*MapBank)
+	bankFor := func(region string, bank int) *MapBank {
+		key := fmt.Sprintf("%s:%d", region, bank)
+		if mapBank, found := banks[key]; found {
+			return mapBank
+		}
+
+		info := regions[region]
+		mapBank := &MapBank{Region: info.Name, Bank: bank, Start: info.Start, End: info.End}
+		banks[key] = mapBank
+		linkMap.Banks = append(linkMap.Banks, mapBank)
+		return mapBank
+	}
+	for bank := 0; bank < romSize/0x4000; bank++ {
+		if bank == 0 {
+			bankFor(RegionROM0, 0)
+		} else {
+			bankFor(RegionROMX, bank)
+		}
+	}
+
+	addSection := func(sections []*ObjectSection, isAligned bool) {
+		var mapSection *MapSection
+		var mapBank *MapBank
+		for _, section := range sections {
+			labelOffset, found := labelOffsets[section.Label]
+			if !found {
+				return
+			}
+
+			bank := labelOffset.bankAt(int(labelOffset.Offset))
+			if mapSection == nil || bank != mapBank.Bank {
+				region := labelOffset.Region
+				if !isRAMRegion(region) {
+					region = RegionROM0
+					if bank > 0 {
+						region = RegionROMX
+					}
+				}
+				mapSection = &MapSection{Name: labelOffset.Label, Start: int(labelOffset.Offset), End: int(labelOffset.Offset)}
+				if isAligned {
+					// worked out once everything's sorted
+					mapSection.Padding = -1
+					isAligned = false
+				}
+				mapBank = bankFor(region, bank)
+				mapBank.Sections = append(mapBank.Sections, mapSection)
+			}
+			mapSection.Size += labelOffset.Size
+			mapSection.End += labelOffset.Size
+			mapSection.Symbols = append(mapSection.Symbols, &MapSymbol{labelOffset.Label, int(labelOffset.Offset)})
+		}
+	}
+
+	rom0 := bankFor(RegionROM0, 0)
+	rom0.Sections = append(rom0.Sections, &MapSection{Name: "(header)", Start: 0x0100, End: 0x0150, Size: 0x50, Symbols: []*MapSymbol{}})
+	for idx, label := range vectorNames {
+		// a vector that was moved leaves a jp to it in its slot
+		if labelOffset, found := labelOffsets[label]; found && int(labelOffset.Offset) != idx*0x08 {
+			stub := &MapSection{Name: fmt.Sprintf("(%s trampoline)", label), Start: idx * 0x08, End: idx*0x08 + 3, Size: 3, Symbols: []*MapSymbol{}}
+			rom0.Sections = append(rom0.Sections, stub)
+		}
+	}
+	for _, object := range objects {
+		for _, section := range object.Sections {
+			if isVector(section.Label) {
+				addSection([]*ObjectSection{section}, false)
+			}
+		}
+	}
+	for _, c := range chunks(objects) {
+		addSection(c.Sections, c.head().Align > 1)
+	}
+
+	for _, mapBank := range linkMap.Banks {
+		sort.SliceStable(mapBank.Sections, func(i, j int) bool {
+			return mapBank.Sections[i].Start < mapBank.Sections[j].Start
+		})
+		end := mapBank.Start
+		for _, mapSection := range mapBank.Sections {
+			if mapSection.Padding < 0 {
+				mapSection.Padding = mapSection.Start - end
+			}
+			if mapSection.Start > end {
+				end = mapSection.Start
+			}
+			if mapSection.End > end {
+				mapBank.Used += mapSection.End - end
+				end = mapSection.End
+			}
+		}
+		if end > mapBank.End {
+			// the rest of the section is in the next bank
+			mapBank.Used -= end - mapBank.End
+			bankFor(RegionROMX, mapBank.Bank+1).Used += end - mapBank.End
+		}
+		mapBank.Free = mapBank.End - mapBank.Start - mapBank.Used
+	}
+
+	// ROM banks first, then RAM in address order
+	sort.SliceStable(linkMap.Banks, func(i, j int) bool {
+		a, b := linkMap.Banks[i], linkMap.Banks[j]
+		isROM := func(bank *MapBank) bool { return bank.Start < 0x8000 }
+		if isROM(a) != isROM(b) {
+			return isROM(a)
+		} else if isROM(a) {
+			return a.Bank < b.Bank
+		} else if a.Start != b.Start {
+			return a.Start < b.Start
+		}
+		return a.Bank < b.Bank
+	})
+	return linkMap
+}
+
+func (m *LinkMap) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(m)
+}
+
+func (m *LinkMap) Write(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	for i, mapBank := range m.Banks {
+		if i > 0 {
+			fmt.Fprintln(out, "")
+		}
+		fmt.Fprintf(out, "%s bank %d ($%04x-$%04x): %d bytes used, %d free\n", mapBank.Region, mapBank.Bank, mapBank.Start, mapBank.End-1, mapBank.Used, mapBank.Free)
+		for _, mapSection := range mapBank.Sections {
+			details := fmt.Sprintf("%d bytes", mapSection.Size)
+			if mapSection.Padding > 0 {
+				details = fmt.Sprintf("%s, after %d bytes of padding", details, mapSection.Padding)
+			}
+			if mapSection.Size == 0 {
+				fmt.Fprintf(out, "  $%04x       %s (%s)\n", mapSection.Start, mapSection.Name, details)
+			} else {
+				fmt.Fprintf(out, "  $%04x-$%04x %s (%s)\n", mapSection.Start, mapSection.End-1, mapSection.Name, details)
+			}
+			if len(mapSection.Symbols) > 1 {
+				for _, symbol := range mapSection.Symbols {
+					fmt.Fprintf(out, "    $%04x %s\n", symbol.Addr, symbol.Name)
+				}
+			}
+		}
+	}
+	return out.Flush()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLinkMap(t *testing.T) {
+	object := buildObject(t, "map.o", []string{
+		".main",
+		"  nop",
+		".loop",
+		"  jr loop",
+		".table:aligned",
+		"  ds $10",
+		".after",
+		"  ret",
+		".banked:romx",
+		"  ds $100",
+		".int_vblank",
+		"  reti",
+		".vars:wram0",
+		"  ds 3",
+	})
+	rom, labelOffsets, diags := Link([]*Object{object}, LinkOptions{MBC: "mbc1"})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	linkMap := BuildLinkMap([]*Object{object}, labelOffsets, len(rom))
+
+	if len(linkMap.Banks) != 3 {
+		t.Fatalf("expected ROM0, ROMX bank 1 and WRAM0 but got %d banks", len(linkMap.Banks))
+	}
+	rom0, romx, wram0 := linkMap.Banks[0], linkMap.Banks[1], linkMap.Banks[2]
+
+	// vblank, the header, main and table
+	if rom0.Region != "ROM0" || len(rom0.Sections) != 4 {
+		t.Fatalf("unexpected ROM0 layout: %+v", rom0)
+	}
+	if used := 1 + 0x50 + 3 + 0x11; rom0.Used != used || rom0.Free != 0x4000-used {
+		t.Errorf("expected %d bytes used in ROM0 but got %d (%d free)", used, rom0.Used, rom0.Free)
+	}
+	main := rom0.Sections[2]
+	if main.Name != "main" || main.Start != 0x0150 || main.End != 0x0153 || len(main.Symbols) != 2 || main.Symbols[1].Name != "loop" || main.Symbols[1].Addr != 0x0151 {
+		t.Errorf("unexpected main section: %+v", main)
+	}
+	table := rom0.Sections[3]
+	if table.Name != "table" || table.Start != 0x0200 || table.Size != 0x11 || table.Padding != 0x0200-0x0153 {
+		t.Errorf("unexpected table section: %+v", table)
+	}
+	if len(table.Symbols) != 2 || table.Symbols[1].Name != "after" {
+		t.Errorf("expected 'after' to be in table's section but got %+v", table.Symbols)
+	}
+
+	if romx.Region != "ROMX" || romx.Bank != 1 || romx.Used != 0x100 || len(romx.Sections) != 1 {
+		t.Errorf("unexpected ROMX layout: %+v", romx)
+	}
+	if wram0.Region != "WRAM0" || wram0.Start != 0xc000 || wram0.Used != 3 || wram0.Free != 0x1000-3 {
+		t.Errorf("unexpected WRAM0 layout: %+v", wram0)
+	}
+
+	var text bytes.Buffer
+	if err := linkMap.Write(&text); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"ROM0 bank 0 ($0000-$3fff): 101 bytes used, 16283 free",
+		"  $0200-$0210 table (17 bytes, after 173 bytes of padding)",
+		"    $0210 after",
+		"WRAM0 bank 0 ($c000-$cfff): 3 bytes used, 4093 free",
+	} {
+		if !strings.Contains(text.String(), line+"\n") {
+			t.Errorf("expected map to have '%s' but got\n%s", line, text.String())
+		}
+	}
+
+	var encoded bytes.Buffer
+	if err := linkMap.WriteJSON(&encoded); err != nil {
+		t.Fatal(err)
+	}
+	var decoded LinkMap
+	if err := json.Unmarshal(encoded.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Banks) != 3 || decoded.Banks[0].Sections[3].Padding != table.Padding {
+		t.Errorf("JSON map didn't decode to the same thing: %s", encoded.String())
+	}
+}
+
+func TestLinkMapFlatROM(t *testing.T) {
+	object := buildObject(t, "flat.o", []string{
+		".main",
+		"  ret",
+		".big:at=$3000",
+		"  ds $2000",
+	})
+	rom, labelOffsets, diags := Link([]*Object{object}, LinkOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	linkMap := BuildLinkMap([]*Object{object}, labelOffsets, len(rom))
+
+	// big carries on into bank 1 without an MBC
+	if used := 0x50 + 1 + 0x1000; linkMap.Banks[0].Used != used {
+		t.Errorf("expected %d bytes used in bank 0 but got %d", used, linkMap.Banks[0].Used)
+	}
+	if linkMap.Banks[1].Used != 0x1000 || linkMap.Banks[1].Free != 0x3000 {
+		t.Errorf("expected $1000 bytes used in bank 1 but got %d", linkMap.Banks[1].Used)
+	}
+}
+
+func TestLinkMapTrampolines(t *testing.T) {
+	object := buildObject(t, "vectors.o", []string{
+		".main",
+		"  ret",
+		".int_timer",
+		"  push af",
+		"  push bc",
+		"  ld a, ($c000)",
+		"  ld b, a",
+		"  pop bc",
+		"  pop af",
+		"  reti",
+	})
+	rom, labelOffsets, diags := Link([]*Object{object}, LinkOptions{Trampolines: true})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	linkMap := BuildLinkMap([]*Object{object}, labelOffsets, len(rom))
+
+	// the jp left in the slot, then the header, main and the handler
+	rom0 := linkMap.Banks[0]
+	if len(rom0.Sections) != 4 {
+		t.Fatalf("expected 4 sections in ROM0 but got %+v", rom0.Sections)
+	}
+	stub := rom0.Sections[0]
+	if stub.Name != "(int_timer trampoline)" || stub.Start != 0x0050 || stub.Size != 3 {
+		t.Errorf("expected the trampoline at $0050 but got %+v", stub)
+	}
+	if handler := rom0.Sections[3]; handler.Name != "int_timer" || handler.Start != 0x0151 || handler.Size != 9 {
+		t.Errorf("expected int_timer after main but got %+v", handler)
+	}
+	if used := 3 + 0x50 + 1 + 9; rom0.Used != used {
+		t.Errorf("expected %d bytes used in ROM0 but got %d", used, rom0.Used)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// bytes per row of a listing, with longer db/dw lines carrying on in more
+// rows
+const listingRowBytes = 4
+
+// WriteListing writes every line that was parsed next to its address and
+// the bytes it ended up as, after labels were filled in. Lines from macros
+// and loops are listed where they were expanded, marked with a '+' for each
+// level, and included files are listed where they were included.
+func WriteListing(w io.Writer, unit *Unit, rom []uint8, labelOffsets labelOffsets) error {
+	locations := make([]string, len(unit.Lines))
+	width := 0
+	for i, line := range unit.Lines {
+		locations[i] = fmt.Sprintf("%s:%d", line.Pos.File, line.Pos.Line)
+		if len(locations[i]) > width {
+			width = len(locations[i])
+		}
+	}
+
+	out := bufio.NewWriter(w)
+	for i, line := range unit.Lines {
+		source := strings.TrimRight(line.Text, " \t\r")
+		if line.Pos.Parent != nil {
+			depth := 0
+			for pos := line.Pos.Parent; pos != nil; pos = pos.Parent {
+				depth++
+			}
+			source = strings.Repeat("+", depth) + " " + strings.TrimSpace(source)
+		}
+		location := fmt.Sprintf("%-*s", width, locations[i])
+
+		labelOffset, found := labelOffsets[line.Section]
+		if !found {
+			fmt.Fprintln(out, strings.TrimRight(fmt.Sprintf("%-7s %-11s  %s  %s", "", "", location, source), " "))
+			continue
+		}
+
+		addr, size, isFill := listedBytes(unit.Sections[line.Section], labelOffset, line.Insn)
+		bank := labelOffset.bankAt(addr)
+
+		var bytes []uint8
+		if !isRAMRegion(labelOffset.Region) {
+			offset := romOffset(bank, uint16(addr))
+			bytes = rom[offset : offset+size]
+		}
+		rows := [][]uint8{bytes}
+		if len(bytes) > listingRowBytes {
+			rows = [][]uint8{}
+			for len(bytes) > 0 {
+				n := listingRowBytes
+				if n > len(bytes) {
+					n = len(bytes)
+				}
+				rows = append(rows, bytes[:n])
+				bytes = bytes[n:]
+			}
+		}
+		// filling and data files could be thousands of bytes
+		if isFill && len(rows) > 1 {
+			rows = [][]uint8{rows[0], nil}
+		}
+
+		for j, row := range rows {
+			hex := []string{}
+			for _, b := range row {
+				hex = append(hex, fmt.Sprintf("%02x", b))
+			}
+			if j == 0 {
+				fmt.Fprintln(out, strings.TrimRight(fmt.Sprintf("%02x:%04x %-11s  %s  %s", bank, addr, strings.Join(hex, " "), location, source), " "))
+			} else if row == nil {
+				fmt.Fprintf(out, "%-7s ...\n", "")
+			} else {
+				fmt.Fprintf(out, "%-7s %s\n", "", strings.Join(hex, " "))
+			}
+		}
+	}
+	return out.Flush()
+}
+
+// listedBytes is the address and size of an instruction, or the section's
+// data for -1, and whether it's filler that doesn't need listing in full
+func listedBytes(section *Section, labelOffset LabelOffset, insn int) (int, int, bool) {
+	addr := int(labelOffset.Offset)
+	if insn < 0 {
+		return addr, len(section.Data), true
+	}
+
+	start := labelOffset.InsnOffsets[insn]
+	end := labelOffset.Size
+	if insn+1 < len(labelOffset.InsnOffsets) {
+		end = labelOffset.InsnOffsets[insn+1]
+	}
+	return addr + start, end - start, section.Insns[insn].Name == "ds"
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gbasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	included := filepath.Join(dir, "lib.asm")
+	if err := ioutil.WriteFile(included, []byte(".helper\n  ret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := []string{
+		"macro store",
+		"  ld (\\1), a",
+		"endm",
+		".main",
+		"  ld a, 3",
+		"  store var",
+		"  call helper",
+		"include \"" + included + "\"",
+		".text",
+		"  db \"Hello\", 0",
+		"  ds 10, $ff",
+		".var:wram0",
+		"  ds 2",
+	}
+	unit := parseUnit(t, lines)
+	rom, labelOffsets, diags := Compile(unit, CompileOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	var buffer bytes.Buffer
+	if err := WriteListing(&buffer, unit, rom, labelOffsets); err != nil {
+		t.Fatal(err)
+	}
+	listing := strings.Split(strings.TrimRight(buffer.String(), "\n"), "\n")
+
+	// addresses, bytes and source, ignoring how far apart they are
+	expected := [][]string{
+		{"compile.asm:1", "macro store"},
+		{"compile.asm:2", "ld (\\1), a"},
+		{"compile.asm:3", "endm"},
+		{"00:0150", "compile.asm:4", ".main"},
+		{"00:0150", "3e 03", "compile.asm:5", "ld a, 3"},
+		{"compile.asm:6", "store var"},
+		// the placeholder has been patched with var's address
+		{"00:0152", "ea 00 c0", "compile.asm:2", "+ ld (var), a"},
+		{"00:0155", "cd 58 01", "compile.asm:7", "call helper"},
+		{"compile.asm:8", "include \"" + included + "\""},
+		{"00:0158", included + ":1", ".helper"},
+		{"00:0158", "c9", included + ":2", "ret"},
+		{"00:0159", "compile.asm:9", ".text"},
+		{"00:0159", "48 65 6c 6c", "compile.asm:10", "db \"Hello\", 0"},
+		{"6f 00"},
+		{"00:015f", "ff ff ff ff", "compile.asm:11", "ds 10, $ff"},
+		{"..."},
+		{"00:c000", "compile.asm:12", ".var:wram0"},
+		{"00:c000", "compile.asm:13", "ds 2"},
+	}
+	if len(listing) != len(expected) {
+		t.Fatalf("expected %d lines but got %d:\n%s", len(expected), len(listing), buffer.String())
+	}
+	for i, parts := range expected {
+		line := listing[i]
+		for _, part := range parts {
+			index := strings.Index(line, part)
+			if index < 0 {
+				t.Errorf("expected line %d to have '%s' but got '%s'", i+1, part, listing[i])
+				break
+			}
+			line = line[index+len(part):]
+		}
+		if strings.TrimSpace(line) != "" {
+			t.Errorf("unexpected '%s' at the end of line %d", line, i+1)
+		}
+	}
+
+	// the RAM line shouldn't have any bytes
+	if fields := strings.Fields(listing[len(listing)-1]); fields[1] != "compile.asm:13" {
+		t.Errorf("expected no bytes for ds in RAM but got '%s'", listing[len(listing)-1])
+	}
+}
+
+func TestListingLoops(t *testing.T) {
+	lines := []string{
+		"macro wait",
+		"  rept 2",
+		".l\\@",
+		"  jr nz, l\\@",
+		"  endr",
+		"endm",
+		".main",
+		"  for i, 2",
+		".row{i}",
+		"  db {i}",
+		"  endr",
+		"  wait",
+	}
+	unit := parseUnit(t, lines)
+	rom, labelOffsets, diags := Compile(unit, CompileOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	var buffer bytes.Buffer
+	if err := WriteListing(&buffer, unit, rom, labelOffsets); err != nil {
+		t.Fatal(err)
+	}
+	listing := buffer.String()
+
+	// iterations are listed with the loop variable and \@ filled in
+	for _, line := range strings.Split(listing, "\n") {
+		if strings.Contains(line, "00:") && (strings.Contains(line, "{") || strings.Contains(line, "\\@")) {
+			t.Errorf("expected expanded text but got '%s'", line)
+		}
+	}
+	for _, text := range []string{"+ .row0", "00 ", "+ db 0", "+ .row1", "01 ", "+ db 1", "++ .l!", "20 fe", "++ jr nz, l!"} {
+		index := strings.Index(listing, text)
+		if index < 0 {
+			t.Fatalf("expected '%s' in listing:\n%s", text, buffer.String())
+		}
+		listing = listing[index+len(text):]
+	}
+}
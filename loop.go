@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// loops that would expand to more lines than this are assumed to be
+// mistakes
+const maxLoopIterations = 0x10000
+
+// loopBlock is a rept or for block whose body is being collected, up to the
+// matching endr.
+type loopBlock struct {
+	kind  string
+	args  string
+	lines []sourceLine
+	depth int
+	pos   Pos
+}
+
+var interpolateRegex = regexp.MustCompile(`\{([a-z_][a-z0-9_!]*)\}`)
+
+func isLoopStart(directive string) bool {
+	return directive == "rept" || directive == "for"
+}
+
+// collectLoop adds a line to the loop body, and expands the loop once its
+// endr is reached.
+func (p *parser) collectLoop(directive string, line sourceLine) error {
+	loop := p.loopDef
+	if isLoopStart(directive) {
+		loop.depth++
+	} else if directive == "endr" {
+		loop.depth--
+		if loop.depth == 0 {
+			p.loopDef = nil
+			return p.expandLoop(loop)
+		}
+	}
+	loop.lines = append(loop.lines, line)
+	return nil
+}
+
+// loopNesting is how many loops deep each line is, so \@ can be left alone
+// in the bodies of inner loops, which replace it themselves.
+func loopNesting(lines []sourceLine) []int {
+	nesting := make([]int, len(lines))
+	depth := 0
+	for i, line := range lines {
+		fields := strings.Fields(line.text)
+		if len(fields) > 0 && fields[0] == "endr" && depth > 0 {
+			depth--
+		}
+		nesting[i] = depth
+		if len(fields) > 0 && isLoopStart(fields[0]) {
+			depth++
+		}
+	}
+	return nesting
+}
+
+func (p *parser) expandLoop(loop *loopBlock) error {
+	name, values, err := p.loopValues(loop)
+	if err != nil {
+		return posError(loop.pos, err.Error())
+	}
+
+	depth := len(p.conds)
+	loopPos := loop.pos
+	nesting := loopNesting(loop.lines)
+	for _, value := range values {
+		if name != "" {
+			p.constants[name] = value
+			p.redefinable[name] = true
+		}
+
+		p.expansions++
+		unique := "!" + strconv.Itoa(p.expansions)
+		for i, line := range loop.lines {
+			text := line.text
+			if nesting[i] == 0 {
+				text = strings.Replace(text, "\\@", unique, -1)
+			}
+			linePos := line.pos
+			linePos.Macro = loop.kind
+			linePos.Parent = &loopPos
+			if err := p.parseLine(sourceLine{text, linePos}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return p.closeConds(depth)
+}
+
+// loopValues works out how many times to repeat a loop, and for 'for'
+// loops, the variable and the value it has for each iteration.
+func (p *parser) loopValues(loop *loopBlock) (string, []int, error) {
+	args := splitArgs(loop.args)
+
+	if loop.kind == "rept" {
+		if len(args) != 1 {
+			return "", nil, errors.New("rept expects a count")
+		}
+		count, err := p.evalConstant(args[0])
+		if err != nil {
+			return "", nil, err
+		} else if count < 0 || count > maxLoopIterations {
+			return "", nil, errors.New(fmt.Sprintf("rept count %d is out of range", count))
+		}
+		return "", make([]int, count), nil
+	}
+
+	// for var, [start,] stop [, step]
+	if len(args) < 2 || len(args) > 4 {
+		return "", nil, errors.New("for expects 'var, stop', 'var, start, stop' or 'var, start, stop, step'")
+	}
+
+	name := args[0]
+	if isSpecialName(name) || isDirective(name) || name == "_narg" {
+		return "", nil, errors.New(fmt.Sprintf("'%s' is reserved and can't be used as a loop variable", name))
+	} else if !isValidLabel(name) {
+		return "", nil, errors.New(fmt.Sprintf("loop variable '%s' is invalid (alphanumeric + '_' + '!', not starting with '!')", name))
+	} else if _, exists := p.constants[name]; exists && !p.redefinable[name] {
+		return "", nil, errors.New(fmt.Sprintf("loop variable '%s' is already defined with 'equ'", name))
+	} else if p.isLabel(name) {
+		return "", nil, errors.New(fmt.Sprintf("loop variable '%s' clashes with a label of the same name", name))
+	}
+
+	bounds := []int{0, 0, 1}
+	if len(args) == 2 {
+		args = []string{args[0], "0", args[1]}
+	}
+	for i, arg := range args[1:] {
+		value, err := p.evalConstant(arg)
+		if err != nil {
+			return "", nil, err
+		}
+		bounds[i] = value
+	}
+
+	start, stop, step := bounds[0], bounds[1], bounds[2]
+	if step == 0 {
+		return "", nil, errors.New("for step can't be 0")
+	}
+
+	values := make([]int, 0)
+	for value := start; step > 0 && value < stop || step < 0 && value > stop; value += step {
+		if len(values) == maxLoopIterations {
+			return "", nil, errors.New(fmt.Sprintf("for loop has more than %d iterations", maxLoopIterations))
+		}
+		values = append(values, value)
+	}
+	return name, values, nil
+}
+
+func (p *parser) evalConstant(text string) (int, error) {
+	expr, err := ParseExpr(text)
+	if err != nil {
+		return 0, err
+	}
+	return expr.Eval(p)
+}
+
+// interpolate replaces '{name}' with the value of the constant 'name', so
+// loop variables can be used in label names. Strings are left as they are.
+func (p *parser) interpolate(text string) (string, error) {
+	if !strings.Contains(text, "{") {
+		return text, nil
+	}
+
+	var err error
+	replace := func(match string) string {
+		name := match[1 : len(match)-1]
+		value, found := p.constants[name]
+		if !found {
+			err = errors.New(fmt.Sprintf("unknown constant '%s' in '%s'", name, match))
+			return match
+		}
+		return strconv.Itoa(value)
+	}
+
+	var out strings.Builder
+	start := 0
+	for i := 0; i <= len(text); i++ {
+		if i < len(text) && text[i] != '"' {
+			continue
+		}
+		out.WriteString(interpolateRegex.ReplaceAllStringFunc(text[start:i], replace))
+		if i == len(text) {
+			break
+		}
+
+		// copy the string up to and including its closing quote
+		end := i + 1
+		for end < len(text) && text[end] != '"' {
+			if text[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end < len(text) {
+			end++
+		} else {
+			end = len(text)
+		}
+		out.WriteString(text[i:end])
+		start, i = end, end-1
+	}
+	return out.String(), err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoopUniqueSuffix(t *testing.T) {
+	lines := []string{
+		"macro wait",
+		"  rept 2",
+		".l\\@",
+		"  dec b",
+		"  jr nz, l\\@",
+		"  endr",
+		"endm",
+		".main",
+		"  wait",
+		"  wait",
+		"  rept 2",
+		"    rept 2",
+		".n\\@",
+		"    endr",
+		"  endr",
+	}
+	unit := parseUnit(t, lines)
+
+	// every iteration of every loop gets its own label
+	counts := map[string]int{}
+	for _, label := range unit.Labels {
+		if i := strings.Index(label, "!"); i >= 0 {
+			counts[label[:i]]++
+		}
+	}
+	if counts["l"] != 4 || counts["n"] != 4 {
+		t.Errorf("expected 4 of each label but got %v", unit.Labels)
+	}
+	if _, _, diags := Compile(unit, CompileOptions{}); diags.HasErrors() {
+		t.Error(diags)
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	lines := []string{
+		".main",
+		"  for i, 2",
+		".data{i}",
+		"  db {i}, \"{i}\", \"\\\"{i}\"",
+		"  endr",
+	}
+	rom, labelOffsets, diags := Compile(parseUnit(t, lines), CompileOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	// only the braces outside strings are replaced
+	expected := map[string]string{
+		"data0": "\x00{i}\"{i}",
+		"data1": "\x01{i}\"{i}",
+	}
+	for label, data := range expected {
+		offset := int(labelOffsets[label].Offset)
+		if actual := string(rom[offset : offset+len(data)]); actual != data {
+			t.Errorf("expected %q at '%s' but got %q", data, label, actual)
+		}
+	}
+}
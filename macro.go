@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// macros calling macros more deeply than this are assumed to be recursing
+// forever
+const maxMacroDepth = 64
+
+type Macro struct {
+	Name   string
+	Params []string
+	Lines  []sourceLine
+	Pos    Pos
+}
+
+// macroCall is a macro that's being expanded. Positional args can be
+// shifted away, but named params stay bound to what they were called with.
+type macroCall struct {
+	macro *Macro
+	args  []string
+	named map[string]string
+	id    int
+}
+
+func newMacro(text string, pos Pos) (*Macro, error) {
+	if text == "" {
+		return nil, posError(pos, "macro needs a name")
+	}
+
+	name := text
+	params := []string{}
+	if i := strings.IndexFunc(text, unicode.IsSpace); i >= 0 {
+		name = text[:i]
+		params = splitArgs(text[i+1:])
+	}
+
+	if isSpecialName(name) || isDirective(name) {
+		return nil, tokenError(pos, name, fmt.Sprintf("'%s' is reserved and can't be used as a macro name", name))
+	} else if !isValidLabel(name) {
+		return nil, tokenError(pos, name, fmt.Sprintf("macro '%s' is invalid (alphanumeric + '_' + '!', not starting with '!')", name))
+	}
+
+	seen := make(map[string]bool)
+	for _, param := range params {
+		if !isValidLabel(param) || strings.Contains(param, "!") {
+			return nil, tokenError(pos, param, fmt.Sprintf("macro parameter '%s' is invalid (alphanumeric + '_')", param))
+		} else if seen[param] {
+			return nil, tokenError(pos, param, fmt.Sprintf("duplicate macro parameter '%s'", param))
+		}
+		seen[param] = true
+	}
+
+	return &Macro{name, params, []sourceLine{}, pos}, nil
+}
+
+func isDirective(name string) bool {
+	return "macro" == name ||
+		"endm" == name ||
+		"shift" == name ||
+		"include" == name ||
+		"if" == name ||
+		"elif" == name ||
+		"else" == name ||
+		"endif" == name ||
+		"endc" == name ||
+		"rept" == name ||
+		"for" == name ||
+		"endr" == name ||
+		"equ" == name ||
+		"set" == name ||
+		"def" == name
+}
+
+func (p *parser) expandMacro(macro *Macro, args []string, pos Pos) error {
+	if len(p.calls) >= maxMacroDepth {
+		// report where it all started rather than the whole chain of calls
+		for pos.Parent != nil {
+			pos = *pos.Parent
+		}
+		return posError(pos, fmt.Sprintf("macro '%s' nested too deeply (recursive macro?)", macro.Name))
+	}
+
+	p.expansions++
+	call := &macroCall{macro, args, make(map[string]string), p.expansions}
+	for i, param := range macro.Params {
+		if i < len(args) {
+			call.named[param] = args[i]
+		}
+	}
+
+	p.calls = append(p.calls, call)
+	prevNarg, hadNarg := p.constants["_narg"]
+	defer func() {
+		p.calls = p.calls[:len(p.calls)-1]
+		if hadNarg {
+			p.constants["_narg"] = prevNarg
+		} else {
+			delete(p.constants, "_narg")
+		}
+	}()
+
+	callPos := pos
+	depth := len(p.conds)
+	nesting := loopNesting(macro.Lines)
+	for i, line := range macro.Lines {
+		linePos := line.pos
+		linePos.Macro = macro.Name
+		linePos.Parent = &callPos
+
+		// \@ in a loop body is left for the loop, so every iteration gets
+		// its own
+		text, err := call.substitute(line.text, nesting[i] == 0)
+		if err != nil && p.isActive() {
+			return posError(linePos, err.Error())
+		} else if err != nil {
+			// lines being skipped by an if don't need their args, but still
+			// have to be seen in case they're an else or endif
+			text = line.text
+		}
+
+		p.constants["_narg"] = len(call.args)
+		if err := p.parseLine(sourceLine{text, linePos}); err != nil {
+			return err
+		}
+	}
+
+	return p.closeConds(depth)
+}
+
+// shift drops positional args from the front of the innermost macro call.
+func (p *parser) shift(text string, pos Pos) error {
+	if len(p.calls) == 0 {
+		return posError(pos, "'shift' can only be used inside a macro")
+	}
+	call := p.calls[len(p.calls)-1]
+
+	count := 1
+	if text != "" {
+		value, err := evalExpr(foldConstants(text, p.constants))
+		if err != nil {
+			return tokenError(pos, text, err.Error())
+		}
+		count = value
+	}
+
+	if count < 0 || count > len(call.args) {
+		return posError(pos, fmt.Sprintf("can't shift %d args, macro '%s' only has %d left", count, call.macro.Name, len(call.args)))
+	}
+	call.args = call.args[count:]
+	p.constants["_narg"] = len(call.args)
+	return nil
+}
+
+// substitute replaces \1..\9 with positional args, \name with named params,
+// \# with all remaining args and, if unique is set, \@ with a suffix that's
+// unique to this expansion, for labels.
+func (c *macroCall) substitute(text string, unique bool) (string, error) {
+	if !strings.Contains(text, "\\") {
+		return text, nil
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' || i+1 == len(text) {
+			out.WriteByte(text[i])
+			continue
+		}
+
+		next := text[i+1]
+		switch {
+		case next >= '1' && next <= '9':
+			index := int(next - '1')
+			if index >= len(c.args) {
+				return "", errors.New(fmt.Sprintf("macro '%s' has no arg \\%c (only %d given)", c.macro.Name, next, len(c.args)))
+			}
+			out.WriteString(c.args[index])
+			i++
+		case next == '@' && unique:
+			out.WriteString("!" + strconv.Itoa(c.id))
+			i++
+		case next == '#':
+			out.WriteString(strings.Join(c.args, ", "))
+			i++
+		case isIdentStart(next):
+			end := i + 1
+			for end < len(text) && isIdentChar(text[end]) {
+				end++
+			}
+			// anything that isn't a param is left alone, e.g. '\n' in strings
+			if arg, found := c.named[text[i+1:end]]; found {
+				out.WriteString(arg)
+				i = end - 1
+			} else if c.isParam(text[i+1 : end]) {
+				return "", errors.New(fmt.Sprintf("macro '%s' wasn't given a value for '%s'", c.macro.Name, text[i+1:end]))
+			} else {
+				out.WriteByte(text[i])
+			}
+		default:
+			out.WriteByte(text[i])
+		}
+	}
+	return out.String(), nil
+}
+
+func (c *macroCall) isParam(name string) bool {
+	for _, param := range c.macro.Params {
+		if param == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMacroArgs(t *testing.T) {
+	lines := []string{
+		"macro load x, y",
+		"  ld a, \\1",
+		"  ld b, \\y",
+		"  ld c, _narg",
+		"endm",
+		"macro all",
+		"  db \\#",
+		"endm",
+		"macro pairs",
+		"  db \\1, _narg",
+		"  shift",
+		"  db \\1, _narg",
+		"  shift 2",
+		"  db \\#, _narg",
+		"endm",
+		"macro here",
+		".here\\@",
+		"  jr here\\@",
+		"endm",
+		".main",
+		"  load 1, 2, 3",
+		"  all 4, 5 + 1, 7",
+		"  pairs 8, 9, 10, 11",
+		"  here",
+		"  here",
+	}
+	unit := parseUnit(t, lines)
+	rom, _, diags := Compile(unit, CompileOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	expected := []uint8{
+		0x3e, 0x01, 0x06, 0x02, 0x0e, 0x03, // load
+		0x04, 0x06, 0x07, // all
+		0x08, 0x04, 0x09, 0x03, 0x0b, 0x01, // pairs
+		0x18, 0xfe, 0x18, 0xfe, // here
+	}
+	if actual := rom[0x150 : 0x150+len(expected)]; !bytes.Equal(actual, expected) {
+		t.Errorf("expected % x but got % x", expected, actual)
+	}
+
+	// every expansion gets its own label
+	heres := 0
+	for _, label := range unit.Labels {
+		if strings.HasPrefix(label, "here!") {
+			heres++
+		}
+	}
+	if heres != 2 {
+		t.Errorf("expected 2 'here' labels but got %v", unit.Labels)
+	}
+	if _, found := unit.Constants["_narg"]; found {
+		t.Errorf("expected _narg to only be defined inside macros")
+	}
+}
+
+func TestMacroErrors(t *testing.T) {
+	cases := []struct {
+		lines    []string
+		expected string
+		line     uint
+	}{
+		{
+			[]string{"macro two", "  db \\1, \\2", "endm", ".main", "  two 1"},
+			"macro 'two' has no arg \\2 (only 1 given)", 2,
+		},
+		{
+			[]string{"macro named a, b", "  db \\a, \\b", "endm", ".main", "  named 1"},
+			"macro 'named' wasn't given a value for 'b'", 2,
+		},
+		{
+			[]string{"macro once", "  shift 2", "endm", ".main", "  once 1"},
+			"can't shift 2 args, macro 'once' only has 1 left", 2,
+		},
+		{
+			[]string{".main", "  shift"},
+			"'shift' can only be used inside a macro", 2,
+		},
+		{
+			// reported where the first call was rather than 64 calls deep
+			[]string{"macro forever", "  nop", "  forever", "endm", ".main", "  forever"},
+			"macro 'forever' nested too deeply (recursive macro?)", 6,
+		},
+		{
+			[]string{"macro outer", "macro inner", "endm", "endm"},
+			"macro definitions can't be nested", 2,
+		},
+		{
+			[]string{"macro dup a, a", "endm"},
+			"duplicate macro parameter 'a'", 1,
+		},
+		{
+			[]string{"macro rept", "endm"},
+			"'rept' is reserved and can't be used as a macro name", 1,
+		},
+	}
+	for _, c := range cases {
+		_, diags := Parse("macro.asm", c.lines, ParseOptions{})
+		if len(diags) == 0 || diags[0].Message != c.expected || diags[0].Pos.Line != c.line {
+			t.Errorf("expected '%s' on line %d but got:\n%v", c.expected, c.line, diags)
+		}
+	}
+}
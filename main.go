@@ -1,69 +1,381 @@
 package main
 
 import (
-	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"strings"
 )
 
+// stringList is a flag that can be given more than once
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
 func main() {
 	log.SetFlags(0)
 
-	if len(os.Args) < 2 {
-		log.Fatalf("Usage: %s <input> [<output>]\n", os.Args[0])
+	if len(os.Args) > 1 && os.Args[1] == "dis" {
+		disMain(os.Args[2:])
+		return
+	} else if len(os.Args) > 1 && os.Args[1] == "link" {
+		linkMain(os.Args[2:])
+		return
+	} else if len(os.Args) > 1 && os.Args[1] == "test" {
+		testMain(os.Args[2:])
+		return
+	}
+
+	var includeDirs, defineFlags stringList
+	var compileOptions CompileOptions
+	var objectOnly bool
+	var headerConfig string
+	var symOptions symFlags
+	var mapFilename, listingFilename string
+	flag.Var(&includeDirs, "I", "add a directory to search for include files (repeatable)")
+	flag.Var(&defineFlags, "D", "define a constant as NAME or NAME=value (repeatable)")
+	flag.BoolVar(&compileOptions.RelaxBranches, "relax", false, "turn jr into jp when the target is out of range")
+	flag.BoolVar(&compileOptions.WarnShortJumps, "warn-jp", false, "warn about jp that could be jr")
+	flag.StringVar(&compileOptions.MBC, "mbc", "", "memory bank controller: none, mbc1, mbc3 or mbc5")
+	flag.BoolVar(&compileOptions.Trampolines, "trampoline", false, "move vectors longer than 8 bytes elsewhere and jp to them")
+	flag.StringVar(&headerConfig, "header", "", "read cartridge header fields from a config file")
+	symOptions.register(flag.CommandLine)
+	flag.StringVar(&mapFilename, "m", "", "write a map of where every section went, as JSON if it ends in .json")
+	flag.StringVar(&listingFilename, "l", "", "write a listing of every source line with its address and bytes")
+	flag.BoolVar(&objectOnly, "c", false, "write an object file to link later instead of a ROM")
+	flag.Usage = func() {
+		log.Printf("Usage: %s [options] <input> [<output>]\n", os.Args[0])
+		log.Printf("       %s link [-warn-jp] [-mbc <name>] [-trampoline] [-header <file>] [-sym] [-m <file>] [-o <output.gb>] <input.o>...\n", os.Args[0])
+		log.Printf("       %s dis <input.gb> [<output.asm>]\n", os.Args[0])
+		log.Printf("       %s test [-I <dir>]... [-D <name>[=<value>]]... [-mbc <name>] [-v] <input.asm>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	} else if objectOnly && compileOptions.RelaxBranches {
+		log.Fatalln("-relax needs every section at once, so it can't be used with -c")
+	} else if objectOnly && compileOptions.MBC != "" {
+		log.Fatalln("banks are picked when linking, so give -mbc to link instead of -c")
+	} else if objectOnly && symOptions.enabled {
+		log.Fatalln("labels are only placed when linking, so give -sym to link instead of -c")
+	} else if objectOnly && mapFilename != "" {
+		log.Fatalln("sections are only placed when linking, so give -m to link instead of -c")
+	} else if objectOnly && listingFilename != "" {
+		log.Fatalln("addresses are only known after linking, so -l can't be used with -c")
+	} else if objectOnly && headerConfig != "" {
+		log.Fatalln("the header is made when linking, so give -header to link instead of -c")
 	}
+	compileOptions.Header = readHeaderConfig(headerConfig)
 
-	inputFilename := os.Args[1]
-	input, err := os.Open(inputFilename)
+	defines := parseDefines(defineFlags)
+
+	inputFilename := flag.Arg(0)
+	lines, err := readLines(inputFilename)
 	if err != nil {
-		log.Fatalf("Could not open input file '%s'\n", inputFilename)
+		log.Fatalf("Could not read input file '%s': %v\n", inputFilename, err)
 	}
-	defer input.Close()
 
 	outputFilename := ""
-	if len(os.Args) > 2 {
-		outputFilename = os.Args[2]
+	if flag.NArg() > 1 {
+		outputFilename = flag.Arg(1)
+	} else if objectOnly {
+		outputFilename = replaceExtension(inputFilename, ".o")
 	} else {
-		if i := strings.LastIndex(inputFilename, "."); i >= 0 {
-			outputFilename = inputFilename[0:i] + ".gb"
-		} else {
-			outputFilename = inputFilename + ".gb"
+		outputFilename = replaceExtension(inputFilename, ".gb")
+	}
+
+	unit, diags := Parse(inputFilename, lines, ParseOptions{includeDirs, defines, objectOnly})
+	reportDiagnostics(diags)
+
+	if objectOnly {
+		object, diags := BuildObject(unit, inputFilename)
+		reportDiagnostics(diags)
+
+		output := createOutput(outputFilename)
+		defer output.Close()
+		if err := object.Write(output); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	// the same as Compile, but keeping the object for the map
+	object, diags := CompileObject(unit, inputFilename, compileOptions)
+	reportDiagnostics(diags)
+	bytes, labelOffsets, diags := Link([]*Object{object}, compileOptions.linkOptions())
+	reportDiagnostics(diags)
+	writeROM(outputFilename, bytes)
+	symOptions.write(outputFilename, labelOffsets, unit.Constants)
+	if mapFilename != "" {
+		writeMap(mapFilename, []*Object{object}, labelOffsets, len(bytes))
+	}
+	if listingFilename != "" {
+		output := createOutput(listingFilename)
+		defer output.Close()
+		if err := WriteListing(output, unit, bytes, labelOffsets); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// parseDefines exits if a value isn't valid
+func parseDefines(defineFlags stringList) map[string]int {
+	defines := make(map[string]int)
+	for _, define := range defineFlags {
+		name, value := define, 1
+		if i := strings.Index(define, "="); i >= 0 {
+			var err error
+			name = define[:i]
+			value, err = evalExpr(define[i+1:])
+			if err != nil {
+				log.Fatalf("Invalid value for -D %s: %v\n", name, err)
+			}
 		}
+		defines[name] = value
 	}
+	return defines
+}
+
+func replaceExtension(filename string, extension string) string {
+	if i := strings.LastIndex(filename, "."); i >= 0 {
+		return filename[0:i] + extension
+	}
+	return filename + extension
+}
 
-	output, err := os.OpenFile(outputFilename, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0664)
+func createOutput(filename string) *os.File {
+	output, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0664)
 	if err != nil {
-		log.Fatalf("Could not open output file '%s'\n", outputFilename)
+		log.Fatalf("Could not open output file '%s'\n", filename)
 	}
+	return output
+}
+
+func writeROM(filename string, bytes []uint8) {
+	output := createOutput(filename)
 	defer output.Close()
 
-	scanner := bufio.NewScanner(input)
-	lines := make([]string, 0)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+	// already padded by the linker
+	if _, err := output.Write(bytes); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func linkMain(args []string) {
+	var linkOptions LinkOptions
+	flags := flag.NewFlagSet("link", flag.ExitOnError)
+	outputFilename := flags.String("o", "", "output file (defaults to the first input with .gb)")
+	flags.BoolVar(&linkOptions.WarnShortJumps, "warn-jp", false, "warn about jp that could be jr")
+	flags.StringVar(&linkOptions.MBC, "mbc", "", "memory bank controller: none, mbc1, mbc3 or mbc5")
+	flags.BoolVar(&linkOptions.Trampolines, "trampoline", false, "move vectors longer than 8 bytes elsewhere and jp to them")
+	var symOptions symFlags
+	symOptions.register(flags)
+	headerConfig := flags.String("header", "", "read cartridge header fields from a config file")
+	mapFilename := flags.String("m", "", "write a map of where every section went, as JSON if it ends in .json")
+	flags.Usage = func() {
+		log.Printf("Usage: %s link [-warn-jp] [-mbc <name>] [-trampoline] [-header <file>] [-sym] [-m <file>] [-o <output.gb>] <input.o>...\n", os.Args[0])
+		flags.PrintDefaults()
 	}
-	if err := scanner.Err(); err != nil {
-		log.Fatalf("Error reading file: %v\n", err)
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(1)
 	}
 
-	unit, err := Parse(lines)
-	if err != nil {
+	objects := make([]*Object, 0, flags.NArg())
+	for _, inputFilename := range flags.Args() {
+		input, err := os.Open(inputFilename)
+		if err != nil {
+			log.Fatalf("Could not read input file '%s': %v\n", inputFilename, err)
+		}
+		object, err := ReadObject(input)
+		input.Close()
+		if err != nil {
+			log.Fatalf("Could not read object file '%s': %v\n", inputFilename, err)
+		}
+		objects = append(objects, object)
+	}
+
+	if *outputFilename == "" {
+		*outputFilename = replaceExtension(flags.Arg(0), ".gb")
+	}
+	linkOptions.Header = readHeaderConfig(*headerConfig)
+
+	bytes, labelOffsets, diags := Link(objects, linkOptions)
+	reportDiagnostics(diags)
+	writeROM(*outputFilename, bytes)
+
+	constants := make(map[string]int)
+	for _, object := range objects {
+		for name, value := range object.Constants {
+			constants[name] = value
+		}
+	}
+	symOptions.write(*outputFilename, labelOffsets, constants)
+	if *mapFilename != "" {
+		writeMap(*mapFilename, objects, labelOffsets, len(bytes))
+	}
+}
+
+// symFlags are the flags for writing a symbol file, which are the same for
+// assembling and linking
+type symFlags struct {
+	enabled bool
+	format  string
+}
+
+func (s *symFlags) register(flags *flag.FlagSet) {
+	flags.BoolVar(&s.enabled, "sym", false, "write a .sym file next to the ROM")
+	flags.StringVar(&s.format, "sym-format", SymbolFormatRGBDS, "symbol file format: rgbds or nogmb (for no$gmb and BGB)")
+}
+
+func (s *symFlags) write(romFilename string, labelOffsets labelOffsets, constants map[string]int) {
+	if !s.enabled {
+		return
+	}
+	output := createOutput(replaceExtension(romFilename, ".sym"))
+	defer output.Close()
+	if err := WriteSymbols(output, labelOffsets, constants, s.format); err != nil {
 		log.Fatalln(err)
 	}
+}
 
-	bytes, err := Compile(unit)
-	if err != nil {
+func writeMap(filename string, objects []*Object, labelOffsets labelOffsets, romSize int) {
+	output := createOutput(filename)
+	defer output.Close()
+
+	linkMap := BuildLinkMap(objects, labelOffsets, romSize)
+	write := linkMap.Write
+	if strings.HasSuffix(filename, ".json") {
+		write = linkMap.WriteJSON
+	}
+	if err := write(output); err != nil {
 		log.Fatalln(err)
 	}
+}
 
-	count, err := output.Write(bytes)
+// readHeaderConfig exits if the config file can't be read or has errors
+func readHeaderConfig(filename string) Header {
+	if filename == "" {
+		return nil
+	}
+	lines, err := readLines(filename)
+	if err != nil {
+		log.Fatalf("Could not read header config '%s': %v\n", filename, err)
+	}
+	header, diags := ParseHeaderConfig(filename, lines)
+	reportDiagnostics(diags)
+	return header
+}
+
+// reportDiagnostics prints everything and exits if any of it was an error
+func reportDiagnostics(diags Diagnostics) {
+	for _, diag := range diags {
+		log.Println(diag)
+		if excerpt := diag.Excerpt(); excerpt != "" {
+			log.Println(excerpt)
+		}
+	}
+	if diags.HasErrors() {
+		os.Exit(1)
+	}
+}
+
+func testMain(args []string) {
+	var includeDirs, defineFlags stringList
+	var testOptions TestOptions
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	flags.Var(&includeDirs, "I", "add a directory to search for include files (repeatable)")
+	flags.Var(&defineFlags, "D", "define a constant as NAME or NAME=value (repeatable)")
+	flags.StringVar(&testOptions.MBC, "mbc", "", "memory bank controller: none, mbc1, mbc3 or mbc5")
+	flags.BoolVar(&testOptions.Verbose, "v", false, "print every test, not just failures")
+	flags.IntVar(&testOptions.MaxCycles, "max-cycles", 1000000, "fail tests that haven't returned after this many cycles")
+	flags.Usage = func() {
+		log.Printf("Usage: %s test [-I <dir>]... [-D <name>[=<value>]]... [-mbc <name>] [-v] <input.asm>...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	defines := parseDefines(defineFlags)
+
+	// each file is built and tested on its own, like a package
+	anyFailed := false
+	for _, inputFilename := range flags.Args() {
+		lines, err := readLines(inputFilename)
+		if err != nil {
+			log.Fatalf("Could not read input file '%s': %v\n", inputFilename, err)
+		}
+		unit, diags := Parse(inputFilename, lines, ParseOptions{includeDirs, defines, false})
+		reportDiagnostics(diags)
+
+		count, failed, diags := RunTests(os.Stdout, unit, testOptions)
+		reportDiagnostics(diags)
+		if count == 0 {
+			fmt.Printf("?   \t%s\t[no tests]\n", inputFilename)
+		} else if failed > 0 {
+			fmt.Printf("FAIL\t%s\t%d of %d failed\n", inputFilename, failed, count)
+			anyFailed = true
+		} else {
+			fmt.Printf("ok  \t%s\t%d tests\n", inputFilename, count)
+		}
+	}
+	if anyFailed {
+		os.Exit(1)
+	}
+}
+
+func disMain(args []string) {
+	flags := flag.NewFlagSet("dis", flag.ExitOnError)
+	flags.Usage = func() {
+		log.Printf("Usage: %s dis <input.gb> [<output.asm>]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	inputFilename := flags.Arg(0)
+	rom, err := ioutil.ReadFile(inputFilename)
+	if err != nil {
+		log.Fatalf("Could not read input file '%s': %v\n", inputFilename, err)
+	}
+
+	lines, warnings, err := Disassemble(rom)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	for _, warning := range warnings {
+		log.Printf("warning: %s\n", warning)
+	}
+
+	output := os.Stdout
+	if flags.NArg() > 1 {
+		outputFilename := flags.Arg(1)
+		output = createOutput(outputFilename)
+		defer output.Close()
+	}
 
-	if count < 0x8000 {
-		padding := make([]uint8, 0x8000-count)
-		output.Write(padding)
+	for _, line := range lines {
+		fmt.Fprintln(output, line)
 	}
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MBC is a cartridge's memory bank controller, which decides how many ROM
+// banks can be switched in at $4000-$7fff
+type MBC struct {
+	Name string
+	// the cartridge type byte at $0147, and what it is with battery
+	// backed RAM
+	CartType    uint8
+	CartTypeRAM uint8
+	// including bank 0
+	MaxBanks int
+}
+
+var mbcs = []MBC{
+	// no MBC, just a flat 32 KiB ROM
+	{"none", 0x00, 0x00, 2},
+	{"mbc1", 0x01, 0x03, 128},
+	{"mbc3", 0x11, 0x13, 128},
+	{"mbc5", 0x19, 0x1b, 512},
+}
+
+// LookupMBC finds an MBC by name, with "" meaning none
+func LookupMBC(name string) (MBC, error) {
+	if name == "" {
+		return mbcs[0], nil
+	}
+	names := make([]string, len(mbcs))
+	for i, mbc := range mbcs {
+		if mbc.Name == strings.ToLower(name) {
+			return mbc, nil
+		}
+		names[i] = mbc.Name
+	}
+	return MBC{}, errors.New(fmt.Sprintf("unknown MBC '%s' (expected one of %s)", name, strings.Join(names, ", ")))
+}
+
+// IsBanked is false for a plain 32 KiB ROM, which has nothing to switch
+func (m MBC) IsBanked() bool {
+	return m.MaxBanks > 2
+}
+
+// canSwitchTo is false for banks that can't be mapped at $4000. On the MBC1,
+// asking for $20, $40 or $60 gives the bank after it instead.
+func (m MBC) canSwitchTo(bank int) bool {
+	if m.Name == "mbc1" {
+		return bank&0x1f != 0
+	}
+	return bank != 0
+}
+
+// romSize is the ROM size byte at $0148 for a ROM with this many banks,
+// which has to be a power of two
+func romSize(banks int) uint8 {
+	size := uint8(0)
+	for n := 2; n < banks; n *= 2 {
+		size++
+	}
+	return size
+}
+
+// romBanks rounds up the number of banks used to a size that a cartridge
+// can actually have
+func romBanks(used int) int {
+	banks := 2
+	for banks < used {
+		banks *= 2
+	}
+	return banks
+}
+
+// ramSize is the RAM size byte at $0149 for this many 8 KiB banks of SRAM
+func ramSize(banks int) uint8 {
+	switch {
+	case banks <= 1:
+		return 0x02
+	case banks <= 4:
+		return 0x03
+	case banks <= 8:
+		return 0x05
+	default:
+		return 0x04
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// bumped whenever the object format changes incompatibly
+const objectVersion = 1
+
+// Object is an assembled source file whose sections haven't been placed in
+// the ROM yet. Every label is exported, and Imports are labels used here
+// that some other object has to define.
+type Object struct {
+	Version   int
+	File      string
+	Sections  []*ObjectSection
+	Exports   []string
+	Imports   []string
+	Header    Header
+	Constants map[string]int
+}
+
+type ObjectSection struct {
+	Label string
+	Pos   Pos
+	Placement
+	Bytes       []uint8
+	InsnOffsets []int
+	Fixups      []*Fixup
+}
+
+type FixupKind string
+
+const (
+	// jr, relative to the next insn
+	FixupRelative FixupKind = "rel8"
+	// db and 2-byte insns
+	FixupByte FixupKind = "byte"
+	// ldh, which also accepts $ff00-$ffff
+	FixupHighByte FixupKind = "high"
+	// dw and 3-byte insns
+	FixupWord FixupKind = "word"
+	// a word that's the target of a jp, which could be a jr if it's close
+	FixupJump FixupKind = "jump"
+	// a word that's the target of a call, or of a jp to more than a label
+	FixupCall FixupKind = "call"
+)
+
+// Fixup is a value in a section that depends on where labels get placed.
+// It's the LabelUsage of a unit once the section has been assembled, with
+// Offset counting from the start of the section.
+type Fixup struct {
+	Offset int
+	Kind   FixupKind
+	Expr   *Expr
+	Pos    Pos
+}
+
+// BuildObject assembles every section of unit, leaving label usages as
+// fixups for Link.
+func BuildObject(unit *Unit, file string) (*Object, Diagnostics) {
+	diags := Diagnostics{}
+	object := &Object{Version: objectVersion, File: file, Header: unit.Header, Constants: unit.Constants}
+	sections := make(map[string]*ObjectSection)
+
+	for _, label := range unit.Labels {
+		section := unit.Sections[label]
+		bytes, insnOffsets, errs := compileSection(unit, label)
+		diags = append(diags, errs...)
+
+		objectSection := &ObjectSection{label, section.Pos, section.Placement, bytes, insnOffsets, []*Fixup{}}
+		sections[label] = objectSection
+		object.Sections = append(object.Sections, objectSection)
+		object.Exports = append(object.Exports, label)
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	imported := make(map[string]bool)
+	for _, labelUsage := range unit.LabelUsages {
+		section := sections[labelUsage.SourceSection]
+		insn := unit.Sections[labelUsage.SourceSection].Insns[labelUsage.SourceInsnIndex]
+		insnOffset := section.InsnOffsets[labelUsage.SourceInsnIndex]
+
+		var kind FixupKind
+		switch {
+		case insn.Name == "jr":
+			kind = FixupRelative
+		case insn.Name == "db" || insn.Name != "dw" && insnLength(section, labelUsage.SourceInsnIndex) == 2:
+			kind = FixupByte
+			if insn.Name == "ldh" {
+				kind = FixupHighByte
+			}
+		case insn.Name == "jp" && labelUsage.Expr.Op == "sym":
+			kind = FixupJump
+		case insn.Name == "call" || insn.Name == "jp":
+			kind = FixupCall
+		default:
+			kind = FixupWord
+		}
+
+		section.Fixups = append(section.Fixups, &Fixup{insnOffset + labelUsage.Offset, kind, labelUsage.Expr, insn.Pos})
+
+		for _, name := range labelUsage.Expr.SymbolNames() {
+			if _, found := unit.Sections[name]; !found && !imported[name] {
+				imported[name] = true
+				object.Imports = append(object.Imports, name)
+			}
+		}
+	}
+
+	return object, diags
+}
+
+// insnLength is how many bytes the given instruction assembled to
+func insnLength(section *ObjectSection, index int) int {
+	end := len(section.Bytes)
+	if index+1 < len(section.InsnOffsets) {
+		end = section.InsnOffsets[index+1]
+	}
+	return end - section.InsnOffsets[index]
+}
+
+func (o *Object) Write(w io.Writer) error {
+	return json.NewEncoder(w).Encode(o)
+}
+
+func ReadObject(r io.Reader) (*Object, error) {
+	object := &Object{}
+	if err := json.NewDecoder(r).Decode(object); err != nil {
+		return nil, errors.New(fmt.Sprintf("not a gbasm object file (%v)", err))
+	}
+	if object.Version != objectVersion {
+		return nil, errors.New(fmt.Sprintf("object file is version %d, expected %d (rebuild it)", object.Version, objectVersion))
+	}
+	return object, nil
+}
@@ -1,224 +1,778 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode"
 )
 
 type Section struct {
-	Label      string
-	LineNumber uint
-	IsAligned  bool
-	Data       []uint8
-	Insns      []Insn
+	Label string
+	Pos   Pos
+	Placement
+	Data  []uint8
+	Insns []Insn
 }
 
 type Insn struct {
-	Name       string
-	Args       []string
-	LineNumber uint
-	Err        error
+	Name string
+	Args []string
+	// the args as written, before constants were folded and labels were
+	// replaced with placeholders, for errors
+	SourceArgs []string
+	Pos        Pos
 }
 
+// Pos is where a line came from. Lines expanded from a macro point at the
+// line in the macro definition, with Parent pointing at the call site.
+// Lines repeated by a rept or for loop have Macro set to "rept" or "for"
+// instead, with Parent pointing at the start of the loop.
+//
+// Columns are 1-based and EndColumn is exclusive. They span the whole line
+// (minus indentation and comments) unless narrowed down to a token by at.
+type Pos struct {
+	File      string
+	Line      uint
+	Column    uint
+	EndColumn uint
+	Source    string
+	Macro     string
+	Parent    *Pos
+}
+
+func (p Pos) String() string {
+	str := fmt.Sprintf("%d", p.Line)
+	if p.File != "" {
+		str = fmt.Sprintf("%s:%d", p.File, p.Line)
+	}
+	if p.Column > 0 {
+		str = fmt.Sprintf("%s:%d", str, p.Column)
+	}
+	if p.Parent != nil && isLoopStart(p.Macro) {
+		str = fmt.Sprintf("%s (in %s loop at %s)", str, p.Macro, p.Parent)
+	} else if p.Parent != nil {
+		str = fmt.Sprintf("%s (in macro '%s' called at %s)", str, p.Macro, p.Parent)
+	}
+	return str
+}
+
+type ParseOptions struct {
+	// directories searched for include files after the including file's
+	// own directory
+	IncludeDirs []string
+	// constants defined before parsing starts, e.g. from -D
+	Defines map[string]int
+	// leave labels that aren't defined for the linker to find in other
+	// objects, instead of reporting them
+	AllowUndefinedLabels bool
+}
+
+// LabelUsage is an arg that refers to labels, so it can only be evaluated
+// once every section has been placed. Expr has already had constants
+// substituted, and Offset is where the value goes in the assembled insn.
 type LabelUsage struct {
-	TargetLabel     string
+	Expr            *Expr
 	SourceSection   string
 	SourceInsnIndex int
+	Offset          int
 }
 
 type Unit struct {
 	Sections    map[string]*Section
 	Labels      []string
 	LabelUsages []*LabelUsage
+	// equ constants and defines, but not set or for variables, whose value
+	// at the end of the file doesn't mean anything
+	Constants map[string]int
+	Header    Header
+	// every line in the order it was parsed, for listings
+	Lines []*ListedLine
+}
+
+// ListedLine is a line that was parsed, including ones from included files
+// and each time a macro or loop was expanded. Section and Insn say what it
+// turned into: an instruction, or with Insn set to -1, the start of a
+// section (and its data, if it was a data file).
+type ListedLine struct {
+	Text    string
+	Pos     Pos
+	Section string
+	Insn    int
+	// in an if block that wasn't taken
+	Skipped bool
+}
+
+// constants are case insensitive like everything else, so the map is keyed
+// by lowercase names
+type Constants map[string]int
+
+func (c Constants) Value(name string) (int, error) {
+	if value, found := c[name]; found {
+		return value, nil
+	}
+	return 0, errors.New(fmt.Sprintf("unknown constant '%s'", name))
+}
+
+func (c Constants) Bank(name string) (int, error) {
+	return 0, errors.New(fmt.Sprintf("bank() of '%s' is only known once labels are placed", name))
+}
+
+type sourceLine struct {
+	text string
+	pos  Pos
+}
+
+type parser struct {
+	currentSection *Section
+	sections       map[string]*Section
+	definedLabels  []string
+	labelUsages    []*LabelUsage
+	constants      Constants
+	redefinable    map[string]bool
+	header         Header
+	lines          []*ListedLine
+
+	macros     map[string]*Macro
+	macroDef   *Macro
+	calls      []*macroCall
+	expansions int
+	conds      []condFrame
+	loopDef    *loopBlock
+
+	includeDirs []string
+	includes    []includedFile
+
+	diags Diagnostics
+}
+
+// includedFile is used to detect recursive includes
+type includedFile struct {
+	path string
+	name string
 }
 
-var labelRegex = regexp.MustCompile("^[a-z_!][a-z0-9_!]*$")
+// '!' is for the suffixes from \@, and can't come first where it would be
+// read as a logical not
+var labelRegex = regexp.MustCompile("^[a-z_][a-z0-9_!]*$")
+var constantRegex = regexp.MustCompile(`^(?:def\s+)?([^\s]+)\s+(equ|set)\s+(.*)$`)
 var dataLabelReplaceRegex = regexp.MustCompile("[^a-z0-9_]+")
 
-func Parse(lines []string) (*Unit, error) {
-	var currentSection *Section
+// Parse keeps going after errors where it can, so the diagnostics may have
+// more than one error. The unit is only usable if none of them are errors.
+func Parse(filename string, lines []string, options ParseOptions) (*Unit, Diagnostics) {
+	p := &parser{
+		sections:    make(map[string]*Section),
+		constants:   Constants{},
+		redefinable: make(map[string]bool),
+		macros:      make(map[string]*Macro),
+		includeDirs: options.IncludeDirs,
+	}
+
+	for name, value := range options.Defines {
+		name = strings.ToLower(name)
+		if isSpecialName(name) || !isValidLabel(name) {
+			p.diags.add(errors.New(fmt.Sprintf("can't define '%s' (alphanumeric + '_' + '!', not starting with '!' and not a register)", name)))
+			continue
+		}
+		p.constants[name] = value
+	}
+
+	if filename != "" {
+		if path, err := filepath.Abs(filename); err == nil {
+			p.includes = append(p.includes, includedFile{path, filename})
+		}
+	}
+	p.parseLines(filename, lines)
+	if err := p.closeConds(0); err != nil {
+		p.diags.add(err)
+	}
+
+	if p.macroDef != nil {
+		p.diags.add(posError(p.macroDef.Pos, fmt.Sprintf("macro '%s' is missing 'endm'", p.macroDef.Name)))
+	} else if p.loopDef != nil {
+		p.diags.add(posError(p.loopDef.pos, fmt.Sprintf("'%s' is missing 'endr'", p.loopDef.kind)))
+	}
+
+	if p.currentSection != nil {
+		p.sections[p.currentSection.Label] = p.currentSection
+	}
+
+	if len(p.sections) == 0 && !p.diags.HasErrors() {
+		p.diags.add(errors.New("there was nothing to parse"))
+	}
+
+	// validating labels
+	for _, labelUsage := range p.labelUsages {
+		for _, usedLabel := range labelUsage.Expr.SymbolNames() {
+			if _, found := p.sections[usedLabel]; !found && !options.AllowUndefinedLabels {
+				insn := p.sections[labelUsage.SourceSection].Insns[labelUsage.SourceInsnIndex]
+				p.diags.add(tokenError(insn.Pos, usedLabel, fmt.Sprintf("undefined label '%s'", usedLabel)))
+			}
+		}
+	}
+
+	if p.diags.HasErrors() {
+		return nil, p.diags
+	}
 
-	sections := make(map[string]*Section)
-	definedLabels := make([]string, 0)
-	labelUsages := make([]*LabelUsage, 0)
+	constants := Constants{}
+	for name, value := range p.constants {
+		if !p.redefinable[name] {
+			constants[name] = value
+		}
+	}
+	return &Unit{p.sections, p.definedLabels, p.labelUsages, constants, p.header, p.lines}, p.diags
+}
 
+// parseLines reports errors and carries on with the next line, so everything
+// wrong with a file shows up at once. Errors in a macro or loop still stop
+// that expansion, as the lines after are likely to fail the same way.
+func (p *parser) parseLines(filename string, lines []string) {
 	for i, text := range lines {
-		lineNumber := uint(i + 1)
+		column, endColumn := lineSpan(text)
+		pos := Pos{File: filename, Line: uint(i + 1), Column: column, EndColumn: endColumn, Source: text}
+		if err := p.parseLine(sourceLine{text, pos}); err != nil {
+			p.diags.add(err)
+		}
+	}
+}
 
-		// drop comments
-		if i := strings.Index(text, ";"); i >= 0 {
-			text = text[0:i]
+// lineSpan is the columns of everything on a line except indentation and
+// comments
+func lineSpan(text string) (uint, uint) {
+	code := text
+	inString := false
+	for i := 0; i < len(text); i++ {
+		if c := text[i]; inString && c == '\\' {
+			i++
+		} else if c == '"' {
+			inString = !inString
+		} else if c == ';' && !inString {
+			code = text[:i]
+			break
 		}
+	}
 
-		text = strings.TrimSpace(strings.ToLower(text))
-		if text == "" {
-			continue
+	start := strings.IndexFunc(code, func(c rune) bool { return !unicode.IsSpace(c) })
+	if start < 0 {
+		return 0, 0
+	}
+	end := len(strings.TrimRightFunc(code, unicode.IsSpace))
+	return uint(start + 1), uint(end + 1)
+}
+
+// at narrows the span down to the first whole-word match of token on the
+// line, if it can be found. Lines are lowercased before parsing, so the
+// match is case insensitive.
+func (p Pos) at(token string) Pos {
+	if token == "" || p.Column == 0 {
+		return p
+	}
+	source := strings.ToLower(p.Source)
+	token = strings.ToLower(token)
+	for from := int(p.Column) - 1; from < len(source); {
+		i := strings.Index(source[from:], token)
+		if i < 0 {
+			break
+		}
+		start, end := from+i, from+i+len(token)
+		if (start == 0 || !isIdentChar(source[start-1])) && (end == len(source) || !isIdentChar(source[end])) {
+			p.Column, p.EndColumn = uint(start+1), uint(end+1)
+			return p
 		}
+		from = start + 1
+	}
+	return p
+}
 
-		if text[0] == '.' { // label
+// include splices another source file in at the current line.
+func (p *parser) include(text string, pos Pos) error {
+	name, err := asmString(text)
+	if err != nil || !isString(text) {
+		return posError(pos, "include expects a quoted filename")
+	}
 
-			isAligned := false
-			label := text[1:]
-			if i := strings.Index(label, ":aligned"); i >= 0 {
-				label = label[:i]
-				isAligned = true
-			}
+	filename, err := p.findFile(string(name), pos)
+	if err != nil {
+		return tokenError(pos, text, err.Error())
+	}
 
-			if _, alreadyExists := sections[label]; alreadyExists {
-				return nil, errors.New(fmt.Sprintf("%d: duplicate label '%s' (labels are case insensitive)", i, label))
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return tokenError(pos, text, err.Error())
+	}
+	for i, included := range p.includes {
+		if included.path == path {
+			cycle := []string{}
+			for _, file := range p.includes[i:] {
+				cycle = append(cycle, file.name)
 			}
+			cycle = append(cycle, filename)
+			return tokenError(pos, text, fmt.Sprintf("recursive include of '%s' (%s)", filename, strings.Join(cycle, " -> ")))
+		}
+	}
 
-			section, err := newSection(label)
-			if err != nil {
-				return nil, err
-			}
+	lines, err := readLines(filename)
+	if err != nil {
+		return tokenError(pos, text, err.Error())
+	}
 
-			section.LineNumber = lineNumber
-			section.IsAligned = isAligned
-			definedLabels = append(definedLabels, label)
+	p.includes = append(p.includes, includedFile{path, filename})
+	defer func() { p.includes = p.includes[:len(p.includes)-1] }()
 
-			if currentSection != nil {
-				sections[currentSection.Label] = currentSection
-			}
-			currentSection = section
-
-		} else if text[0] == '<' { // data
-			isAligned := false
-			filename := text[1:]
-			if i := strings.Index(filename, ":aligned"); i >= 0 {
-				filename = filename[:i]
-				isAligned = true
-			}
+	depth := len(p.conds)
+	p.parseLines(filename, lines)
+	return p.closeConds(depth)
+}
 
-			dataFile, err := os.Open(filename)
-			if err != nil {
-				return nil, err
-			}
-			defer dataFile.Close()
+// findFile looks for a file next to the file that's including it, then in
+// each include dir in order, then in the working directory.
+func (p *parser) findFile(name string, pos Pos) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
 
-			// the '.' is intentional, and becomes a '_' after the regex replace
-			label := "data." + filename
-			label = dataLabelReplaceRegex.ReplaceAllLiteralString(label, "_")
-			if _, alreadyExists := sections[label]; alreadyExists {
-				return nil, errors.New(fmt.Sprintf("%d: duplicate label '%s' (labels are case insensitive)", i, label))
-			}
+	dirs := append([]string{filepath.Dir(pos.File)}, p.includeDirs...)
+	dirs = append(dirs, ".")
+	for _, dir := range dirs {
+		candidate := filepath.Join(dir, name)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", errors.New(fmt.Sprintf("could not find '%s' (searched %s)", name, strings.Join(dirs, ", ")))
+}
 
-			section, err := newSection(label)
-			if err != nil {
-				return nil, err
+func readLines(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+func (p *parser) parseLine(line sourceLine) error {
+	pos := line.pos
+	listed := &ListedLine{line.text, pos, "", -1, !p.isActive()}
+	text := cleanLine(line.text)
+	// loop bodies in macros and other loops are only listed as they're
+	// expanded, with \@ and {name} filled in
+	if p.loopDef == nil || pos.Parent == nil || p.loopDef.depth == 1 && text == "endr" {
+		p.lines = append(p.lines, listed)
+	}
+	if text == "" {
+		return nil
+	}
+
+	directive := strings.FieldsFunc(text, unicode.IsSpace)[0]
+
+	if p.macroDef != nil {
+		if directive == "endm" {
+			p.macros[p.macroDef.Name] = p.macroDef
+			p.macroDef = nil
+		} else if directive == "macro" {
+			return posError(pos, "macro definitions can't be nested")
+		} else {
+			p.macroDef.Lines = append(p.macroDef.Lines, sourceLine{text, pos})
+		}
+		return nil
+	}
+
+	if p.loopDef != nil {
+		return p.collectLoop(directive, sourceLine{text, pos})
+	}
+
+	if isCond, err := p.conditional(directive, text[len(directive):], pos); isCond {
+		return err
+	} else if !p.isActive() {
+		return nil
+	}
+
+	interpolated, err := p.interpolate(text)
+	if err != nil {
+		return posError(pos, err.Error())
+	} else if interpolated != text && pos.Parent != nil {
+		listed.Text = interpolated
+	}
+	text = interpolated
+	directive = strings.FieldsFunc(text, unicode.IsSpace)[0]
+
+	if directive == "macro" { // macro definition
+		macro, err := newMacro(strings.TrimSpace(text[len(directive):]), pos)
+		if err != nil {
+			return err
+		}
+		if _, alreadyExists := p.macros[macro.Name]; alreadyExists {
+			return tokenError(pos, macro.Name, fmt.Sprintf("macro '%s' is already defined", macro.Name))
+		}
+		p.macroDef = macro
+
+	} else if directive == "endm" {
+		return posError(pos, "'endm' without 'macro'")
+
+	} else if isLoopStart(directive) { // rept/for
+		p.loopDef = &loopBlock{directive, text[len(directive):], []sourceLine{}, 1, pos}
+
+	} else if directive == "endr" {
+		return posError(pos, "'endr' without 'rept' or 'for'")
+
+	} else if directive == "include" {
+		return p.include(strings.TrimSpace(text[len(directive):]), pos)
+
+	} else if directive == "shift" {
+		return p.shift(strings.TrimSpace(text[len(directive):]), pos)
+
+	} else if directive == "header" {
+		field, err := ParseHeaderField(strings.TrimSpace(text[len(directive):]), pos, p)
+		if err != nil {
+			return posError(pos, err.Error())
+		}
+		p.header = append(p.header, field)
+
+	} else if match := constantRegex.FindStringSubmatch(text); match != nil { // constant
+		name, kind, exprText := match[1], match[2], match[3]
+
+		if isSpecialName(name) || name == "_narg" {
+			return tokenError(pos, name, fmt.Sprintf("'%s' is reserved and can't be used as a constant name", name))
+		} else if !isValidLabel(name) {
+			return tokenError(pos, name, fmt.Sprintf("constant '%s' is invalid (alphanumeric + '_' + '!', not starting with '!')", name))
+		} else if p.isLabel(name) {
+			return tokenError(pos, name, fmt.Sprintf("constant '%s' clashes with a label of the same name", name))
+		}
+
+		if _, alreadyExists := p.constants[name]; alreadyExists {
+			if kind == "equ" || !p.redefinable[name] {
+				return tokenError(pos, name, fmt.Sprintf("constant '%s' is already defined (use 'set' for constants that change)", name))
 			}
+		}
+
+		expr, err := ParseExpr(exprText)
+		if err != nil {
+			return tokenError(pos, exprText, err.Error())
+		}
+		value, err := expr.Eval(p)
+		if err != nil {
+			return tokenError(pos, exprText, err.Error())
+		}
+
+		p.constants[name] = value
+		p.redefinable[name] = kind == "set"
+
+	} else if text[0] == '.' { // label
+
+		attrs := strings.Split(text[1:], ":")
+		label := attrs[0]
+
+		if p.isLabel(label) {
+			return tokenError(pos, label, fmt.Sprintf("duplicate label '%s' (labels are case insensitive)", label))
+		}
+		if _, isConstant := p.constants[label]; isConstant {
+			return tokenError(pos, label, fmt.Sprintf("label '%s' clashes with a constant of the same name", label))
+		}
+
+		section, err := newSection(label)
+		if err != nil {
+			return tokenError(pos, label, err.Error())
+		}
+
+		if err := section.setAttrs(attrs[1:], p); err != nil {
+			return tokenError(pos, text, err.Error())
+		}
+
+		section.Pos = pos
+		p.startSection(section)
+		listed.Section = section.Label
+
+	} else if text[0] == '<' { // data
+		attrs := strings.Split(text[1:], ":")
+		filename := attrs[0]
+
+		path, err := p.findFile(filename, pos)
+		if err != nil {
+			return tokenError(pos, filename, err.Error())
+		}
+		dataFile, err := os.Open(path)
+		if err != nil {
+			return tokenError(pos, filename, err.Error())
+		}
+		defer dataFile.Close()
+
+		// the '.' is intentional, and becomes a '_' after the regex replace
+		label := "data." + filename
+		label = dataLabelReplaceRegex.ReplaceAllLiteralString(label, "_")
+		if p.isLabel(label) {
+			return tokenError(pos, filename, fmt.Sprintf("duplicate label '%s' (labels are case insensitive)", label))
+		}
+
+		section, err := newSection(label)
+		if err != nil {
+			return tokenError(pos, filename, err.Error())
+		}
 
-			data, err := ioutil.ReadAll(dataFile)
-			if err != nil {
-				return nil, err
+		if err := section.setAttrs(attrs[1:], p); err != nil {
+			return tokenError(pos, text, err.Error())
+		} else if isRAMRegion(section.Region) {
+			return tokenError(pos, text, fmt.Sprintf("data files can't go in %s", section.Region))
+		}
+
+		data, err := ioutil.ReadAll(dataFile)
+		if err != nil {
+			return posError(pos, err.Error())
+		}
+
+		section.Data = data
+		section.Pos = pos
+		p.startSection(section)
+		listed.Section = section.Label
+
+	} else if macro, found := p.macros[directive]; found { // macro call
+		return p.expandMacro(macro, splitArgs(text[len(directive):]), pos)
+
+	} else if p.currentSection == nil {
+		return posError(pos, "all asm must be under some label")
+	} else {
+		insn := ParseInsn(text, pos)
+		if isRAMRegion(p.currentSection.Region) {
+			if insn.Name != "ds" {
+				return tokenError(pos, insn.Name, fmt.Sprintf("only 'ds' can go in %s sections", p.currentSection.Region))
+			} else if len(insn.Args) > 1 {
+				return tokenError(pos, insn.Args[1], "RAM isn't filled in, so 'ds' can't have a fill value")
 			}
+		}
 
-			section.Data = data
-			section.LineNumber = lineNumber
-			section.IsAligned = isAligned
-			definedLabels = append(definedLabels, label)
+		for argIndex, arg := range insn.Args {
+			insn.Args[argIndex] = foldConstants(arg, p.constants)
+		}
 
-			if currentSection != nil {
-				sections[currentSection.Label] = currentSection
+		// replace label usage with placeholder
+		for argIndex, arg := range insn.Args {
+			// only parens make it a memory access, like with numbers
+			expr, isAddr := argExpr(arg)
+			if expr == nil || insn.Name == "ds" {
+				continue
 			}
-			currentSection = section
 
-		} else if currentSection == nil {
-			return nil, errors.New(fmt.Sprintf("%d: all asm must be under some label", i))
-		} else {
-			insn := ParseInsn(text, lineNumber)
-
-			// replace label usage with placeholder
-			for argIndex, targetLabel := range insn.Args {
-				if !isSpecialName(targetLabel) && isValidLabel(targetLabel) {
-					labelUsages = append(labelUsages, &LabelUsage{
-						targetLabel,
-						currentSection.Label,
-						len(currentSection.Insns),
-					})
-
-					// replace with appropriate placeholder
-					switch insn.Name {
-					case "jr":
-						insn.Args[argIndex] = "$66"
-					case "ld":
-						if len(insn.Args) == 2 && isReg16(insn.Args[0]) {
-							insn.Args[argIndex] = "$6666"
-						} else {
-							insn.Args[argIndex] = "($6666)"
-						}
-					default:
-						insn.Args[argIndex] = "$6666"
-					}
-				}
+			expr = expr.Substitute(p.constants)
+			names := expr.SymbolNames()
+			isLabelExpr := len(names) > 0
+			for _, name := range names {
+				isLabelExpr = isLabelExpr && isValidLabel(name)
+			}
+			if !isLabelExpr {
+				continue
 			}
 
-			currentSection.Insns = append(currentSection.Insns, insn)
+			p.labelUsages = append(p.labelUsages, &LabelUsage{
+				expr,
+				p.currentSection.Label,
+				len(p.currentSection.Insns),
+				argOffset(&insn, argIndex),
+			})
+
+			// the placeholder only needs to pick the right encoding; the
+			// real value gets patched in by Compile
+			if isAddr {
+				insn.Args[argIndex] = "($66)"
+			} else {
+				insn.Args[argIndex] = "$66"
+			}
 		}
-	}
 
-	if currentSection != nil {
-		sections[currentSection.Label] = currentSection
+		listed.Section, listed.Insn = p.currentSection.Label, len(p.currentSection.Insns)
+		p.currentSection.Insns = append(p.currentSection.Insns, insn)
 	}
 
-	if len(sections) == 0 {
-		return nil, errors.New("there was nothing to parse")
+	return nil
+}
+
+func (p *parser) startSection(section *Section) {
+	p.definedLabels = append(p.definedLabels, section.Label)
+	if p.currentSection != nil {
+		p.sections[p.currentSection.Label] = p.currentSection
 	}
+	p.currentSection = section
+}
 
-	// validating labels
-	missingLabels := make([]string, 0)
-	for _, labelUsage := range labelUsages {
-		usedLabel := labelUsage.TargetLabel
+func (p *parser) isLabel(name string) bool {
+	_, found := p.sections[name]
+	return found || (p.currentSection != nil && p.currentSection.Label == name)
+}
+
+// foldConstants replaces an arg that's an expression over constants with
+// its value. Constants have to be substituted while parsing because 'set'
+// constants can change value between lines. Anything else (registers,
+// labels, garbage) is left for the assembler to deal with.
+func foldConstants(arg string, constants Constants) string {
+	expr, isAddr := argExpr(arg)
+	if expr == nil {
+		return arg
+	}
 
-		if _, found := sections[usedLabel]; !found {
-			missingLabels = append(missingLabels, usedLabel)
+	names := expr.SymbolNames()
+	if len(names) == 0 {
+		return arg
+	}
+	for _, name := range names {
+		if _, found := constants[name]; !found {
+			return arg
 		}
 	}
-	if len(missingLabels) > 0 {
-		return nil, errors.New(fmt.Sprintf("found undefined labels %s", missingLabels))
+
+	value, err := expr.Eval(constants)
+	if err != nil {
+		return arg
 	}
 
-	return &Unit{sections, definedLabels, labelUsages}, nil
+	if isAddr {
+		return fmt.Sprintf("(%d)", value)
+	}
+	return strconv.Itoa(value)
 }
 
-func ParseInsn(line string, num uint) Insn {
-	spaceOrComma := func(c rune) bool { return unicode.IsSpace(c) || c == ',' }
-	parts := strings.FieldsFunc(line, spaceOrComma)
+// argExpr parses an arg as an expression, stripping the parens off
+// addresses. Args that aren't expressions or that mention registers
+// return nil.
+func argExpr(arg string) (*Expr, bool) {
+	isAddr := isMemOperand(arg)
+	text := arg
+	if isAddr {
+		text = arg[1 : len(arg)-1]
+	}
+
+	expr, err := ParseExpr(text)
+	if err != nil {
+		return nil, false
+	}
+	for _, name := range expr.SymbolNames() {
+		if isSpecialName(name) {
+			return nil, false
+		}
+	}
+	return expr, isAddr
+}
+
+func ParseInsn(line string, pos Pos) Insn {
+	name := line
+	args := ""
+	if i := strings.IndexFunc(line, unicode.IsSpace); i >= 0 {
+		name = line[:i]
+		args = line[i+1:]
+	}
 
 	insn := Insn{}
-	insn.Name = parts[0]
-	insn.Args = parts[1:]
-	insn.LineNumber = num
+	insn.Name = name
+	insn.Args = splitArgs(args)
+	insn.SourceArgs = append([]string{}, insn.Args...)
+	insn.Pos = pos
 	return insn
 }
 
-func (i *Insn) Error() string {
-	return fmt.Sprintf("%d: %s", i.LineNumber, i.Err.Error())
+// splitArgs splits on commas that aren't nested inside parens or strings,
+// so that expressions like 'foo(a, b)' survive as a single arg.
+func splitArgs(text string) []string {
+	args := make([]string, 0)
+	if strings.TrimSpace(text) == "" {
+		return args
+	}
+
+	depth := 0
+	start := 0
+	inString := false
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case inString && c == '\\':
+			i++
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	return append(args, strings.TrimSpace(text[start:]))
 }
 
+// cleanLine drops comments and lowercases everything except string
+// literals.
+func cleanLine(text string) string {
+	out := []byte(text)
+	inString := false
+	for i := 0; i < len(out); i++ {
+		switch c := out[i]; {
+		case inString && c == '\\':
+			i++
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == ';':
+			out = out[:i]
+		case c >= 'A' && c <= 'Z':
+			out[i] = c + 'a' - 'A'
+		}
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// expectedNumberArgs lists the counts like 'expected 0, 1 or 2'
 func (i *Insn) expectedNumberArgs(expected ...uint) error {
-	str := fmt.Sprintf("'%s' has wrong number of args, expected %d", i.Name, expected)
-	i.Err = errors.New(str)
-	return i
+	sorted := append([]uint{}, expected...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+
+	counts := make([]string, len(sorted))
+	for j, count := range sorted {
+		counts[j] = strconv.Itoa(int(count))
+	}
+	text := counts[len(counts)-1]
+	if len(counts) > 1 {
+		text = strings.Join(counts[:len(counts)-1], ", ") + " or " + text
+	}
+	return errors.New(fmt.Sprintf("'%s' has wrong number of args, expected %s", i.Name, text))
 }
 
 func newSection(label string) (*Section, error) {
 	if isSpecialName(label) {
 		return nil, errors.New(fmt.Sprintf("'%s' is reserved and can't be used as a label name", label))
 	} else if !isValidLabel(label) {
-		return nil, errors.New(fmt.Sprintf("label '%s' is invalid (alphanumeric + '_' + '!')", label))
+		return nil, errors.New(fmt.Sprintf("label '%s' is invalid (alphanumeric + '_' + '!', not starting with '!')", label))
 	}
 
 	section := new(Section)
 	section.Label = label
+	section.Placement = newPlacement()
 	return section, nil
 }
 
+// setAttrs applies the ':'-separated attributes after a section's label,
+// e.g. '.tiles:romx:align=$10'
+func (s *Section) setAttrs(attrs []string, symbols Symbols) error {
+	for _, attr := range attrs {
+		if err := s.setAttr(attr, symbols); err != nil {
+			return err
+		}
+	}
+	return s.check()
+}
+
 func isValidLabel(name string) bool {
 	return labelRegex.MatchString(name)
 }
@@ -235,6 +789,8 @@ func isSpecialName(name string) bool {
 		"nz" == name ||
 		"z" == name ||
 		"nc" == name ||
+		"hli" == name ||
+		"hld" == name ||
 		isReg16(name)
 }
 
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseReportsAllErrors(t *testing.T) {
+	lines := []string{
+		"  nop",
+		".main",
+		"  jp nowhere",
+		".main",
+		"x equ 1 +",
+	}
+	_, diags := Parse("errors.asm", lines, ParseOptions{})
+
+	expected := []string{
+		"errors.asm:1:3: error: all asm must be under some label",
+		"errors.asm:4:2: error: duplicate label 'main' (labels are case insensitive)",
+		"errors.asm:5:7: error: unexpected end of expression",
+		"errors.asm:3:6: error: undefined label 'nowhere'",
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("expected %d diagnostics but got %d:\n%v", len(expected), len(diags), diags)
+	}
+	for i, diag := range diags {
+		if diag.Error() != expected[i] {
+			t.Errorf("expected '%s' but got '%s'", expected[i], diag)
+		}
+	}
+}
+
+func TestCompileReportsAllErrors(t *testing.T) {
+	lines := []string{
+		".main",
+		"  ld a, 300",
+		"  frob",
+		".other",
+		"  ld (hl), (hl)",
+	}
+	unit, diags := Parse("errors.asm", lines, ParseOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	_, _, diags = Compile(unit, CompileOptions{})
+	if len(diags) != 3 || !diags.HasErrors() {
+		t.Fatalf("expected 3 errors but got:\n%v", diags)
+	}
+	for i, line := range []uint{2, 3, 5} {
+		if diags[i].Pos.Line != line || diags[i].Severity != SeverityError {
+			t.Errorf("expected an error on line %d but got '%s'", line, diags[i])
+		}
+	}
+}
+
+func TestDiagnosticExcerpt(t *testing.T) {
+	lines := []string{
+		"macro mac",
+		"\tld a, \\1 ; comment",
+		"endm",
+		".main",
+		"\tjr far_away",
+		"  ds 200",
+		".Far_Away",
+		"  mac 300",
+	}
+	diags := compileDiagnostics(t, lines)
+	if excerpt := diags[0].Excerpt(); excerpt != "\tld a, \\1 ; comment\n\t^~~~~~~~" {
+		t.Errorf("unexpected excerpt for '%s':\n%s", diags[0], excerpt)
+	}
+	if diags[0].Pos.Parent == nil || diags[0].Pos.Parent.Line != 8 {
+		t.Errorf("expected '%s' to come from the macro call on line 8", diags[0])
+	}
+
+	lines[7] = "  mac 3"
+	diags = compileDiagnostics(t, lines)
+	if diags[0].Token != "far_away" || diags[0].Pos.Column != 5 || diags[0].Pos.EndColumn != 13 {
+		t.Errorf("expected '%s' to point at far_away", diags[0])
+	}
+	if excerpt := diags[0].Excerpt(); excerpt != "\tjr far_away\n\t   ^~~~~~~~" {
+		t.Errorf("unexpected excerpt for '%s':\n%s", diags[0], excerpt)
+	}
+}
+
+// compileDiagnostics expects lines to parse but give exactly one error
+// when compiled
+func compileDiagnostics(t *testing.T, lines []string) Diagnostics {
+	unit, diags := Parse("excerpt.asm", lines, ParseOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	_, _, diags = Compile(unit, CompileOptions{})
+	if len(diags) != 1 {
+		t.Fatalf("expected 1 diagnostic but got:\n%v", diags)
+	}
+	return diags
+}
+
+func TestConstants(t *testing.T) {
+	lines := []string{
+		"size equ 4",
+		"n set 1",
+		".main",
+		"  ld a, n",
+		"n set n * size",
+		"  ld a, n",
+		"n set 2",
+		"  ld a, n + size",
+	}
+	unit := parseUnit(t, lines)
+	rom, _, diags := Compile(unit, CompileOptions{})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	// each use sees the value set before it
+	expected := []uint8{0x3e, 0x01, 0x3e, 0x04, 0x3e, 0x06}
+	if actual := rom[0x150 : 0x150+len(expected)]; !bytes.Equal(actual, expected) {
+		t.Errorf("expected % x but got % x", expected, actual)
+	}
+	// set variables are only meaningful while parsing
+	if len(unit.Constants) != 1 || unit.Constants["size"] != 4 {
+		t.Errorf("expected only size = 4 but got %v", unit.Constants)
+	}
+}
+
+func TestConstantErrors(t *testing.T) {
+	cases := []struct {
+		lines    []string
+		expected string
+	}{
+		{
+			[]string{"x equ 1", "x equ 2"},
+			"const.asm:2:1: error: constant 'x' is already defined (use 'set' for constants that change)",
+		},
+		{
+			[]string{"x equ 1", "x set 2"},
+			"const.asm:2:1: error: constant 'x' is already defined (use 'set' for constants that change)",
+		},
+		{
+			[]string{"x set 1", "x equ 2"},
+			"const.asm:2:1: error: constant 'x' is already defined (use 'set' for constants that change)",
+		},
+		{
+			[]string{".main", "main equ 1"},
+			"const.asm:2:1: error: constant 'main' clashes with a label of the same name",
+		},
+		{
+			[]string{"main set 1", ".main"},
+			"const.asm:2:2: error: label 'main' clashes with a constant of the same name",
+		},
+		{
+			[]string{"!x equ 1"},
+			"const.asm:1:1: error: constant '!x' is invalid (alphanumeric + '_' + '!', not starting with '!')",
+		},
+		{
+			[]string{".!main"},
+			"const.asm:1:2: error: label '!main' is invalid (alphanumeric + '_' + '!', not starting with '!')",
+		},
+		{
+			[]string{"_narg equ 1"},
+			"const.asm:1:1: error: '_narg' is reserved and can't be used as a constant name",
+		},
+	}
+	for _, c := range cases {
+		_, diags := Parse("const.asm", c.lines, ParseOptions{})
+		if len(diags) == 0 || diags[0].Error() != c.expected {
+			t.Errorf("expected '%s' but got:\n%v", c.expected, diags)
+		}
+	}
+}
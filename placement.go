@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// memory regions a section can go in
+const (
+	// the fixed bank at $0000-$3fff, which is the default
+	RegionROM0 = "rom0"
+	// any switchable bank at $4000-$7fff
+	RegionROMX = "romx"
+
+	// RAM regions only reserve space with ds, and don't take up any ROM
+	RegionWRAM0 = "wram0"
+	RegionWRAMX = "wramx"
+	RegionHRAM  = "hram"
+	// cartridge RAM, which needs an MBC
+	RegionSRAM = "sram"
+)
+
+// memoryRegion is the address range of a region, with End exclusive, and
+// the banks it can be switched to
+type memoryRegion struct {
+	Name      string
+	Start     int
+	End       int
+	FirstBank int
+	LastBank  int
+}
+
+// in address order. The last ROMX bank depends on the MBC.
+var regionNames = []string{RegionROM0, RegionROMX, RegionSRAM, RegionWRAM0, RegionWRAMX, RegionHRAM}
+
+var regions = map[string]memoryRegion{
+	RegionROM0:  {"ROM0", 0x0000, 0x4000, 0, 0},
+	RegionROMX:  {"ROMX", 0x4000, 0x8000, 1, 511},
+	RegionSRAM:  {"SRAM", 0xa000, 0xc000, 0, 15},
+	RegionWRAM0: {"WRAM0", 0xc000, 0xd000, 0, 0},
+	RegionWRAMX: {"WRAMX", 0xd000, 0xe000, 1, 7},
+	RegionHRAM:  {"HRAM", 0xff80, 0xffff, 0, 0},
+}
+
+func isRAMRegion(region string) bool {
+	return region == RegionWRAM0 || region == RegionWRAMX || region == RegionHRAM || region == RegionSRAM
+}
+
+// Placement is where a section is allowed to go, from the attributes after
+// its label
+type Placement struct {
+	// "" is the same as ROM0
+	Region string
+	// a fixed address, or -1 for anywhere in the region
+	At int
+	// the address has to be a multiple of Align (a power of two) plus
+	// AlignOffset, with 0 meaning any address
+	Align       int
+	AlignOffset int
+	// a fixed bank, or -1 for any
+	Bank int
+}
+
+func newPlacement() Placement {
+	return Placement{At: -1, Bank: -1}
+}
+
+// alignUp is the first address from addr that meets the alignment
+func (p Placement) alignUp(addr int) int {
+	if p.Align <= 1 {
+		return addr
+	}
+	return addr + ((p.AlignOffset-addr)%p.Align+p.Align)%p.Align
+}
+
+// setAttr applies one attribute, e.g. 'romx' or 'align=$100'
+func (p *Placement) setAttr(attr string, symbols Symbols) error {
+	name, valueText := attr, ""
+	if i := strings.Index(attr, "="); i >= 0 {
+		name, valueText = attr[:i], attr[i+1:]
+	}
+
+	value := 0
+	switch name {
+	case "at", "align", "offset", "bank":
+		if valueText == "" {
+			return errors.New(fmt.Sprintf("section attribute '%s' needs a value, e.g. '%s=$100'", name, name))
+		}
+		expr, err := ParseExpr(valueText)
+		if err != nil {
+			return err
+		}
+		if value, err = expr.Eval(symbols); err != nil {
+			return err
+		}
+	default:
+		if valueText != "" {
+			return errors.New(fmt.Sprintf("section attribute '%s' doesn't take a value", name))
+		}
+	}
+
+	switch name {
+	case "aligned":
+		p.Align = 0x100
+	case "align":
+		if value < 1 || value > 0x4000 || value&(value-1) != 0 {
+			return errors.New(fmt.Sprintf("alignment $%x has to be a power of two up to $4000", value))
+		}
+		p.Align = value
+	case "offset":
+		p.AlignOffset = value
+	case "at":
+		if value < 0 || value > 0xffff {
+			return errors.New(fmt.Sprintf("address $%x is out of range", value))
+		}
+		p.At = value
+	case "bank":
+		if value < 0 {
+			return errors.New(fmt.Sprintf("bank %d is out of range", value))
+		}
+		p.Bank = value
+	case RegionROM0, RegionROMX, RegionWRAM0, RegionWRAMX, RegionHRAM, RegionSRAM:
+		if p.Region != "" && p.Region != name {
+			return errors.New(fmt.Sprintf("a section can't be in both %s and %s", p.Region, name))
+		}
+		p.Region = name
+	default:
+		return errors.New(fmt.Sprintf("unknown section attribute '%s'", name))
+	}
+	return nil
+}
+
+// check works out the region from the address or bank if there wasn't one,
+// and makes sure the attributes agree with each other
+func (p *Placement) check() error {
+	if p.Region == "" && p.At >= 0 {
+		for _, name := range regionNames {
+			if region := regions[name]; p.At >= region.Start && p.At < region.End {
+				p.Region = name
+				break
+			}
+		}
+		if p.Region == "" {
+			return errors.New(fmt.Sprintf("address $%04x isn't in ROM or RAM", p.At))
+		}
+	} else if p.Region == "" && p.Bank > 0 {
+		p.Region = RegionROMX
+	}
+
+	region := regions[p.Region]
+	if p.Region == "" {
+		region = regions[RegionROM0]
+	}
+	if p.Bank >= 0 && (p.Bank < region.FirstBank || p.Bank > region.LastBank) {
+		return errors.New(fmt.Sprintf("%s can't be in bank %d (expected %d-%d)", region.Name, p.Bank, region.FirstBank, region.LastBank))
+	}
+
+	align := p.Align
+	if align == 0 {
+		align = 1
+	}
+	if p.AlignOffset < 0 || p.AlignOffset >= align {
+		return errors.New(fmt.Sprintf("offset $%x has to be less than the alignment $%x", p.AlignOffset, align))
+	}
+	if p.At >= 0 && p.alignUp(p.At) != p.At {
+		return errors.New(fmt.Sprintf("address $%04x isn't aligned to $%x (offset $%x)", p.At, align, p.AlignOffset))
+	}
+	return nil
+}
+
+// span is part of an address space that's taken, with End exclusive
+type span struct {
+	Start int
+	End   int
+	Label string
+}
+
+// allocator keeps track of what's been placed in each address space, so
+// sections can go in the first gap that fits them. ROM is one space of file
+// offsets across all the banks.
+type allocator map[string][]span
+
+// reserve takes start-end for label, unless it overlaps something already
+// there, in which case that label is returned instead
+func (a allocator) reserve(space string, start, end int, label string) string {
+	for _, s := range a[space] {
+		if start < s.End && s.Start < end {
+			return s.Label
+		}
+	}
+	a[space] = append(a[space], span{start, end, label})
+	return ""
+}
+
+// firstFit finds the lowest start between start and end that has room for
+// size bytes and meets the alignment
+func (a allocator) firstFit(space string, start, end, size int, placement Placement) (int, bool) {
+	candidate := placement.alignUp(start)
+	for candidate+size <= end {
+		moved := false
+		for _, s := range a[space] {
+			if candidate < s.End && s.Start < candidate+size {
+				candidate = placement.alignUp(s.End)
+				moved = true
+			}
+		}
+		if !moved {
+			return candidate, true
+		}
+	}
+	return 0, false
+}
+
+// window is one bank of a region that a section could go in
+type window struct {
+	Space string
+	Bank  int
+	Start int
+	End   int
+}
+
+// offset is where addr goes in the window's space, which is the ROM file
+// for ROM
+func (w window) offset(addr int) int {
+	if w.Space == "rom" && w.Bank > 0 {
+		return romOffset(w.Bank, uint16(addr))
+	}
+	return addr
+}
+
+// windows are every bank of its region a section could go in
+func (p Placement) windows(mbc MBC) ([]window, error) {
+	name := p.Region
+	if name == "" {
+		name = RegionROM0
+	}
+	region := regions[name]
+
+	switch name {
+	case RegionROM0:
+		// see LabelOffset.bankAt
+		end := region.End
+		if !mbc.IsBanked() {
+			end = 0x8000
+		}
+		return []window{{"rom", 0, region.Start, end}}, nil
+	case RegionROMX:
+		if p.Bank >= mbc.MaxBanks {
+			return nil, errors.New(fmt.Sprintf("bank %d doesn't exist with MBC '%s' (which has up to %d)", p.Bank, mbc.Name, mbc.MaxBanks-1))
+		} else if p.Bank >= 0 && !mbc.canSwitchTo(p.Bank) {
+			return nil, errors.New(fmt.Sprintf("MBC '%s' can't switch to bank $%02x", mbc.Name, p.Bank))
+		}
+
+		windows := []window{}
+		for bank := 1; bank < mbc.MaxBanks; bank++ {
+			if (p.Bank < 0 || p.Bank == bank) && mbc.canSwitchTo(bank) {
+				windows = append(windows, window{"rom", bank, region.Start, region.End})
+			}
+		}
+		return windows, nil
+	default:
+		bank := p.Bank
+		if bank < 0 {
+			bank = region.FirstBank
+		}
+		return []window{{fmt.Sprintf("%s:%d", name, bank), bank, region.Start, region.End}}, nil
+	}
+}
@@ -0,0 +1,317 @@
+package sim
+
+import (
+	"fmt"
+
+	"github.com/echojc/gbasm/sm83"
+)
+
+// insn is an opcode with the bytes after it, which are only meaningful if
+// it has operands that use them
+type insn struct {
+	*sm83.Opcode
+	imm8  uint8
+	imm16 uint16
+}
+
+func is16(operand string) bool {
+	switch operand {
+	case "af", "bc", "de", "hl", "sp", sm83.Imm16:
+		return true
+	}
+	return false
+}
+
+// get8 reads an 8-bit operand, which might be memory
+func (c *CPU) get8(i *insn, operand string) uint8 {
+	if r := c.reg8(operand); r != nil {
+		return *r
+	}
+	switch operand {
+	case "(bc)", "(de)", "(hl)":
+		return c.Memory.Read(c.reg16(operand[1:3]))
+	case "(hl+)", "(hl-)":
+		return c.Memory.Read(c.stepHL(operand))
+	case "(c)":
+		return c.Memory.Read(0xff00 + uint16(c.C))
+	case sm83.Imm8:
+		return i.imm8
+	case sm83.Mem8:
+		return c.Memory.Read(0xff00 + uint16(i.imm8))
+	case sm83.Mem16:
+		return c.Memory.Read(i.imm16)
+	}
+	panic(fmt.Sprintf("can't read operand '%s' of '%s'", operand, i.Opcode))
+}
+
+func (c *CPU) set8(i *insn, operand string, value uint8) {
+	if r := c.reg8(operand); r != nil {
+		*r = value
+		return
+	}
+	switch operand {
+	case "(bc)", "(de)", "(hl)":
+		c.Memory.Write(c.reg16(operand[1:3]), value)
+	case "(hl+)", "(hl-)":
+		c.Memory.Write(c.stepHL(operand), value)
+	case "(c)":
+		c.Memory.Write(0xff00+uint16(c.C), value)
+	case sm83.Mem8:
+		c.Memory.Write(0xff00+uint16(i.imm8), value)
+	case sm83.Mem16:
+		c.Memory.Write(i.imm16, value)
+	default:
+		panic(fmt.Sprintf("can't write operand '%s' of '%s'", operand, i.Opcode))
+	}
+}
+
+// stepHL returns hl and then increments or decrements it
+func (c *CPU) stepHL(operand string) uint16 {
+	hl := c.reg16("hl")
+	if operand == "(hl+)" {
+		c.setReg16("hl", hl+1)
+	} else {
+		c.setReg16("hl", hl-1)
+	}
+	return hl
+}
+
+func (c *CPU) condition(name string) bool {
+	switch name {
+	case "nz":
+		return !c.Flag(FlagZ)
+	case "z":
+		return c.Flag(FlagZ)
+	case "nc":
+		return !c.Flag(FlagC)
+	}
+	return c.Flag(FlagC)
+}
+
+// execute runs an instruction whose operands have already been skipped
+// over. It returns true if it was a conditional jump, call or return that
+// was taken.
+func (c *CPU) execute(i *insn) bool {
+	operands := i.Operands
+	last := ""
+	if len(operands) > 0 {
+		last = operands[len(operands)-1]
+	}
+
+	switch i.Mnemonic {
+	case "nop":
+	case "ld", "ldh":
+		c.load(i)
+
+	case "inc", "dec":
+		delta := 1
+		if i.Mnemonic == "dec" {
+			delta = -1
+		}
+		if is16(last) {
+			c.setReg16(last, c.reg16(last)+uint16(delta))
+			break
+		}
+		value := c.get8(i, last)
+		result := uint8(int(value) + delta)
+		c.set8(i, last, result)
+		halfCarry := value&0x0f == 0x0f
+		if delta < 0 {
+			halfCarry = value&0x0f == 0
+		}
+		c.setFlags(result == 0, delta < 0, halfCarry, c.Flag(FlagC))
+
+	case "add":
+		if operands[0] == "hl" {
+			hl, value := c.reg16("hl"), c.reg16(last)
+			c.setReg16("hl", hl+value)
+			c.setFlags(c.Flag(FlagZ), false, hl&0x0fff+value&0x0fff > 0x0fff, int(hl)+int(value) > 0xffff)
+		} else if operands[0] == "sp" {
+			c.SP = c.addSP(i.imm8)
+		} else {
+			c.A = c.add8(c.A, c.get8(i, last), 0)
+		}
+	case "adc":
+		c.A = c.add8(c.A, c.get8(i, last), c.carry())
+	case "sub":
+		c.A = c.sub8(c.A, c.get8(i, last), 0)
+	case "sbc":
+		c.A = c.sub8(c.A, c.get8(i, last), c.carry())
+	case "cp":
+		c.sub8(c.A, c.get8(i, last), 0)
+	case "and":
+		c.A &= c.get8(i, last)
+		c.setFlags(c.A == 0, false, true, false)
+	case "xor":
+		c.A ^= c.get8(i, last)
+		c.setFlags(c.A == 0, false, false, false)
+	case "or":
+		c.A |= c.get8(i, last)
+		c.setFlags(c.A == 0, false, false, false)
+
+	case "daa":
+		c.daa()
+	case "cpl":
+		c.A = ^c.A
+		c.F |= FlagN | FlagH
+	case "scf":
+		c.setFlags(c.Flag(FlagZ), false, false, true)
+	case "ccf":
+		c.setFlags(c.Flag(FlagZ), false, false, !c.Flag(FlagC))
+
+	case "rlca", "rrca", "rla", "rra":
+		// the same as the prefixed versions on a, except Z is always reset
+		c.A = c.shift(i.Mnemonic[:len(i.Mnemonic)-1], c.A)
+		c.F &^= FlagZ
+	case "rlc", "rrc", "rl", "rr", "sla", "sra", "swap", "srl":
+		c.set8(i, last, c.shift(i.Mnemonic, c.get8(i, last)))
+	case "bit":
+		bit, _ := sm83.FixedValue(operands[0])
+		c.setFlags(c.get8(i, last)&(1<<uint(bit)) == 0, false, true, c.Flag(FlagC))
+	case "res", "set":
+		bit, _ := sm83.FixedValue(operands[0])
+		value := c.get8(i, last) &^ (1 << uint(bit))
+		if i.Mnemonic == "set" {
+			value |= 1 << uint(bit)
+		}
+		c.set8(i, last, value)
+
+	case "jr", "jp", "call":
+		if len(operands) > 1 && !c.condition(operands[0]) {
+			return false
+		}
+		target := i.imm16
+		if last == sm83.Rel8 {
+			target = c.PC + uint16(int8(i.imm8))
+		} else if last == "hl" {
+			target = c.reg16("hl")
+		} else if i.Mnemonic == "call" {
+			c.push(c.PC)
+		}
+		c.PC = target
+		return len(operands) > 1
+	case "ret", "reti":
+		if len(operands) > 0 && !c.condition(operands[0]) {
+			return false
+		}
+		c.PC = c.pop()
+		if i.Mnemonic == "reti" {
+			c.IME = true
+		}
+		return len(operands) > 0
+	case "rst":
+		target, _ := sm83.FixedValue(last)
+		c.push(c.PC)
+		c.PC = uint16(target)
+	case "push":
+		c.push(c.reg16(last))
+	case "pop":
+		c.setReg16(last, c.pop())
+
+	case "di":
+		c.IME = false
+	case "ei":
+		c.IME = true
+	case "halt", "stop":
+		// nothing can wake it up, so both just stop
+		c.Halted = true
+
+	default:
+		panic(fmt.Sprintf("'%s' isn't implemented", i.Opcode))
+	}
+	return false
+}
+
+// load handles every form of ld and ldh
+func (c *CPU) load(i *insn) {
+	dst, src := i.Operands[0], i.Operands[1]
+	switch {
+	case src == sm83.SPOffset:
+		c.setReg16("hl", c.addSP(i.imm8))
+	case dst == sm83.Mem16 && src == "sp":
+		c.write16(i.imm16, c.SP)
+	case src == sm83.Imm16:
+		c.setReg16(dst, i.imm16)
+	case is16(src):
+		c.setReg16(dst, c.reg16(src))
+	default:
+		c.set8(i, dst, c.get8(i, src))
+	}
+}
+
+func (c *CPU) carry() uint8 {
+	if c.Flag(FlagC) {
+		return 1
+	}
+	return 0
+}
+
+func (c *CPU) add8(a, value, carry uint8) uint8 {
+	result := int(a) + int(value) + int(carry)
+	c.setFlags(uint8(result) == 0, false, a&0x0f+value&0x0f+carry > 0x0f, result > 0xff)
+	return uint8(result)
+}
+
+func (c *CPU) sub8(a, value, carry uint8) uint8 {
+	result := int(a) - int(value) - int(carry)
+	c.setFlags(uint8(result) == 0, true, int(a&0x0f) < int(value&0x0f)+int(carry), result < 0)
+	return uint8(result)
+}
+
+// addSP is sp plus a signed offset, with the flags set from adding the
+// offset's low byte to sp's as if unsigned
+func (c *CPU) addSP(offset uint8) uint16 {
+	c.setFlags(false, false, c.SP&0x0f+uint16(offset&0x0f) > 0x0f, c.SP&0xff+uint16(offset) > 0xff)
+	return c.SP + uint16(int8(offset))
+}
+
+// daa turns the result of adding or subtracting two BCD numbers back into
+// BCD
+func (c *CPU) daa() {
+	adjust := uint8(0)
+	carry := c.Flag(FlagC)
+	if c.Flag(FlagN) {
+		if c.Flag(FlagH) {
+			adjust |= 0x06
+		}
+		if carry {
+			adjust |= 0x60
+		}
+		c.A -= adjust
+	} else {
+		if c.Flag(FlagH) || c.A&0x0f > 0x09 {
+			adjust |= 0x06
+		}
+		if carry || c.A > 0x99 {
+			adjust |= 0x60
+			carry = true
+		}
+		c.A += adjust
+	}
+	c.setFlags(c.A == 0, c.Flag(FlagN), false, carry)
+}
+
+// shift does one of the rotates or shifts, setting the flags
+func (c *CPU) shift(mnemonic string, value uint8) uint8 {
+	var result, carry uint8
+	switch mnemonic {
+	case "rlc":
+		result, carry = value<<1|value>>7, value>>7
+	case "rrc":
+		result, carry = value>>1|value<<7, value&1
+	case "rl":
+		result, carry = value<<1|c.carry(), value>>7
+	case "rr":
+		result, carry = value>>1|c.carry()<<7, value&1
+	case "sla":
+		result, carry = value<<1, value>>7
+	case "sra":
+		result, carry = value>>1|value&0x80, value&1
+	case "srl":
+		result, carry = value>>1, value&1
+	case "swap":
+		result = value<<4 | value>>4
+	}
+	c.setFlags(result == 0, false, false, carry != 0)
+	return result
+}
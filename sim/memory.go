@@ -0,0 +1,52 @@
+package sim
+
+// Memory is everything the CPU can read and write
+type Memory interface {
+	Read(addr uint16) uint8
+	Write(addr uint16, value uint8)
+}
+
+// FlatMemory is a ROM with one bank switched in at $4000-$7fff, and plain
+// RAM everywhere else, without any I/O registers or echo RAM.
+type FlatMemory struct {
+	ROM []uint8
+	// the bank at $4000-$7fff
+	Bank int
+	RAM  [0x10000]uint8
+
+	// OnROMWrite is called for writes to $0000-$7fff, which go to the MBC
+	// on a real cartridge. If it's nil, writes to $2000-$3fff switch banks
+	// like most MBCs.
+	OnROMWrite func(m *FlatMemory, addr uint16, value uint8)
+}
+
+func NewFlatMemory(rom []uint8) *FlatMemory {
+	return &FlatMemory{ROM: rom, Bank: 1}
+}
+
+func (m *FlatMemory) Read(addr uint16) uint8 {
+	offset := int(addr)
+	if addr >= 0x8000 {
+		return m.RAM[addr]
+	} else if addr >= 0x4000 {
+		offset = m.Bank*0x4000 + int(addr-0x4000)
+	}
+	if offset >= len(m.ROM) {
+		// nothing there, so the bus floats high
+		return 0xff
+	}
+	return m.ROM[offset]
+}
+
+func (m *FlatMemory) Write(addr uint16, value uint8) {
+	if addr >= 0x8000 {
+		m.RAM[addr] = value
+	} else if m.OnROMWrite != nil {
+		m.OnROMWrite(m, addr, value)
+	} else if addr >= 0x2000 && addr < 0x4000 {
+		m.Bank = int(value)
+		if m.Bank == 0 {
+			m.Bank = 1
+		}
+	}
+}
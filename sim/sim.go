@@ -0,0 +1,234 @@
+// Package sim runs SM83 code without an emulator. It only has the CPU and
+// memory: there's no PPU, timer or interrupts, so it's for running routines
+// headlessly rather than games.
+//
+// Instructions are decoded with the same opcode tables the assembler uses,
+// so lengths and cycle counts always agree with it.
+package sim
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/echojc/gbasm/sm83"
+)
+
+// bits of F, whose low nibble is always 0
+const (
+	FlagZ uint8 = 0x80
+	FlagN uint8 = 0x40
+	FlagH uint8 = 0x20
+	FlagC uint8 = 0x10
+)
+
+// why Run stopped
+const (
+	StopHalt       = "halt"
+	StopBreakpoint = "breakpoint"
+	StopCycleLimit = "cycle limit"
+)
+
+type CPU struct {
+	A, F, B, C, D, E, H, L uint8
+	SP, PC                 uint16
+	// interrupts are never taken, but ei and di still set this
+	IME bool
+	// set by halt and stop, and cleared by changing PC
+	Halted bool
+	// clock cycles (4 per machine cycle) since the start
+	Cycles int
+	Memory Memory
+}
+
+// New loads a ROM, e.g. from Compile, in the state the boot ROM leaves a
+// DMG in when it jumps to $0100
+func New(rom []uint8) *CPU {
+	return &CPU{
+		A: 0x01, F: 0xb0, B: 0x00, C: 0x13, D: 0x00, E: 0xd8, H: 0x01, L: 0x4d,
+		SP:     0xfffe,
+		PC:     0x0100,
+		Memory: NewFlatMemory(rom),
+	}
+}
+
+type RunOptions struct {
+	// stop before running the instruction at any of these, other than the
+	// first one, so Run can be called again to carry on
+	Breakpoints map[uint16]bool
+	// stop once at least this many cycles have run, or 0 for no limit
+	MaxCycles int
+}
+
+// Run steps until the CPU halts, a breakpoint is hit or the cycle limit is
+// reached, and returns which one it was
+func (c *CPU) Run(options RunOptions) (string, error) {
+	start := c.Cycles
+	for first := true; ; first = false {
+		if c.Halted {
+			return StopHalt, nil
+		} else if !first && options.Breakpoints[c.PC] {
+			return StopBreakpoint, nil
+		} else if options.MaxCycles > 0 && c.Cycles-start >= options.MaxCycles {
+			return StopCycleLimit, nil
+		}
+		if _, err := c.Step(); err != nil {
+			return "", err
+		}
+	}
+}
+
+// Step runs one instruction and returns how many cycles it took. It does
+// nothing while halted.
+func (c *CPU) Step() (int, error) {
+	if c.Halted {
+		return 0, nil
+	}
+
+	addr := c.PC
+	opcode := sm83.Unprefixed[c.Memory.Read(addr)]
+	if c.Memory.Read(addr) == 0xcb {
+		opcode = sm83.Prefixed[c.Memory.Read(addr+1)]
+	}
+	if opcode == nil {
+		return 0, errors.New(fmt.Sprintf("illegal opcode $%02x at $%04x", c.Memory.Read(addr), addr))
+	}
+
+	// operands always come straight after the opcode, and prefixed
+	// instructions don't have any
+	c.PC += uint16(opcode.Length)
+	i := &insn{opcode, c.Memory.Read(addr + 1), c.read16(addr + 1)}
+	cycles := opcode.Cycles
+	if c.execute(i) {
+		cycles = opcode.CyclesTaken
+	}
+	c.Cycles += cycles
+	return cycles, nil
+}
+
+// Reg is the value of a register by name, e.g. 'a' or 'hl'
+func (c *CPU) Reg(name string) (int, bool) {
+	if r := c.reg8(name); r != nil {
+		return int(*r), true
+	}
+	switch name {
+	case "f":
+		return int(c.F), true
+	case "af", "bc", "de", "hl", "sp":
+		return int(c.reg16(name)), true
+	case "pc":
+		return int(c.PC), true
+	}
+	return 0, false
+}
+
+// SetReg sets a register by name, returning false if there isn't one
+func (c *CPU) SetReg(name string, value int) bool {
+	if r := c.reg8(name); r != nil {
+		*r = uint8(value)
+		return true
+	}
+	switch name {
+	case "f":
+		c.F = uint8(value) & 0xf0
+	case "af", "bc", "de", "hl", "sp":
+		c.setReg16(name, uint16(value))
+	case "pc":
+		c.PC = uint16(value)
+		c.Halted = false
+	default:
+		return false
+	}
+	return true
+}
+
+// Flag is whether a bit of F is set
+func (c *CPU) Flag(flag uint8) bool {
+	return c.F&flag != 0
+}
+
+func (c *CPU) setFlags(z, n, h, carry bool) {
+	c.F = 0
+	if z {
+		c.F |= FlagZ
+	}
+	if n {
+		c.F |= FlagN
+	}
+	if h {
+		c.F |= FlagH
+	}
+	if carry {
+		c.F |= FlagC
+	}
+}
+
+// reg8 doesn't include f, which can only be changed as part of af
+func (c *CPU) reg8(name string) *uint8 {
+	switch name {
+	case "a":
+		return &c.A
+	case "b":
+		return &c.B
+	case "c":
+		return &c.C
+	case "d":
+		return &c.D
+	case "e":
+		return &c.E
+	case "h":
+		return &c.H
+	case "l":
+		return &c.L
+	}
+	return nil
+}
+
+func (c *CPU) reg16(name string) uint16 {
+	switch name {
+	case "af":
+		return uint16(c.A)<<8 | uint16(c.F)
+	case "bc":
+		return uint16(c.B)<<8 | uint16(c.C)
+	case "de":
+		return uint16(c.D)<<8 | uint16(c.E)
+	case "hl":
+		return uint16(c.H)<<8 | uint16(c.L)
+	}
+	return c.SP
+}
+
+func (c *CPU) setReg16(name string, value uint16) {
+	high, low := uint8(value>>8), uint8(value)
+	switch name {
+	case "af":
+		c.A, c.F = high, low&0xf0
+	case "bc":
+		c.B, c.C = high, low
+	case "de":
+		c.D, c.E = high, low
+	case "hl":
+		c.H, c.L = high, low
+	default:
+		c.SP = value
+	}
+}
+
+func (c *CPU) read16(addr uint16) uint16 {
+	return uint16(c.Memory.Read(addr)) | uint16(c.Memory.Read(addr+1))<<8
+}
+
+func (c *CPU) write16(addr uint16, value uint16) {
+	c.Memory.Write(addr, uint8(value))
+	c.Memory.Write(addr+1, uint8(value>>8))
+}
+
+func (c *CPU) push(value uint16) {
+	c.SP -= 2
+	c.write16(c.SP, value)
+}
+
+func (c *CPU) pop() uint16 {
+	value := c.read16(c.SP)
+	c.SP += 2
+	return value
+}
@@ -0,0 +1,172 @@
+package sim
+
+import (
+	"testing"
+)
+
+// run puts code at $0150 and runs it until it halts
+func run(t *testing.T, code ...uint8) *CPU {
+	rom := make([]uint8, 0x8000)
+	copy(rom[0x0150:], code)
+	cpu := New(rom)
+	cpu.PC, cpu.F = 0x0150, 0
+	if reason, err := cpu.Run(RunOptions{MaxCycles: 10000}); err != nil {
+		t.Fatal(err)
+	} else if reason != StopHalt {
+		t.Fatalf("expected to halt but stopped for '%s'", reason)
+	}
+	return cpu
+}
+
+func TestInsns(t *testing.T) {
+	cases := []struct {
+		name     string
+		code     []uint8
+		expected map[string]int
+	}{
+		{"add half carry", []uint8{0x3e, 0x0f, 0xc6, 0x01}, map[string]int{"a": 0x10, "f": 0x20}},
+		{"add carry", []uint8{0x3e, 0xff, 0xc6, 0x01}, map[string]int{"a": 0x00, "f": 0xb0}},
+		{"adc", []uint8{0x37, 0x3e, 0x01, 0xce, 0x01}, map[string]int{"a": 0x03, "f": 0x00}},
+		{"sub borrow", []uint8{0x3e, 0x10, 0xd6, 0x01}, map[string]int{"a": 0x0f, "f": 0x60}},
+		{"sbc", []uint8{0x37, 0x3e, 0x00, 0xde, 0x00}, map[string]int{"a": 0xff, "f": 0x70}},
+		{"cp", []uint8{0x3e, 0x05, 0xfe, 0x05}, map[string]int{"a": 0x05, "f": 0xc0}},
+		{"xor a", []uint8{0x3e, 0x12, 0xaf}, map[string]int{"a": 0x00, "f": 0x80}},
+		{"and", []uint8{0x3e, 0xf0, 0xe6, 0x3c}, map[string]int{"a": 0x30, "f": 0x20}},
+		{"inc keeps carry", []uint8{0x37, 0x06, 0xff, 0x04}, map[string]int{"b": 0x00, "f": 0xb0}},
+		{"dec", []uint8{0x0e, 0x10, 0x0d}, map[string]int{"c": 0x0f, "f": 0x60}},
+		{"daa", []uint8{0x3e, 0x45, 0xc6, 0x38, 0x27}, map[string]int{"a": 0x83, "f": 0x00}},
+		{"daa after sub", []uint8{0x3e, 0x10, 0xd6, 0x01, 0x27}, map[string]int{"a": 0x09, "f": 0x40}},
+		{"cpl", []uint8{0x3e, 0x0f, 0x2f}, map[string]int{"a": 0xf0, "f": 0x60}},
+		{"add hl", []uint8{0x21, 0xff, 0x0f, 0x01, 0x01, 0x00, 0x09}, map[string]int{"hl": 0x1000, "f": 0x20}},
+		{"inc 16-bit", []uint8{0x11, 0xff, 0xff, 0x13}, map[string]int{"de": 0x0000, "f": 0x00}},
+		{"ld hl, sp+e8", []uint8{0x31, 0xf8, 0xff, 0xf8, 0x08}, map[string]int{"hl": 0x0000, "f": 0x30}},
+		{"add sp, e8", []uint8{0x31, 0x00, 0xd0, 0xe8, 0xfe}, map[string]int{"sp": 0xcffe, "f": 0x00}},
+		{"rlca", []uint8{0x3e, 0x80, 0x07}, map[string]int{"a": 0x01, "f": 0x10}},
+		{"rla", []uint8{0x37, 0x3e, 0x00, 0x17}, map[string]int{"a": 0x01, "f": 0x00}},
+		{"rlc zero", []uint8{0x06, 0x00, 0xcb, 0x00}, map[string]int{"b": 0x00, "f": 0x80}},
+		{"sra", []uint8{0x3e, 0x81, 0xcb, 0x2f}, map[string]int{"a": 0xc0, "f": 0x10}},
+		{"swap", []uint8{0x3e, 0x12, 0xcb, 0x37}, map[string]int{"a": 0x21, "f": 0x00}},
+		{"bit", []uint8{0x37, 0x3e, 0x7f, 0xcb, 0x7f}, map[string]int{"a": 0x7f, "f": 0xb0}},
+		{"set res", []uint8{0x3e, 0x01, 0xcb, 0xff, 0xcb, 0x87}, map[string]int{"a": 0x80}},
+		{"push pop af", []uint8{0x01, 0xff, 0x12, 0xc5, 0xf1}, map[string]int{"a": 0x12, "f": 0xf0}},
+		{"loop", []uint8{0x06, 0x05, 0x05, 0x20, 0xfd}, map[string]int{"b": 0x00, "f": 0xc0}},
+		{"call ret", []uint8{0xcd, 0x57, 0x01, 0x76, 0x00, 0x00, 0x00, 0x3e, 0x07, 0xc9}, map[string]int{"a": 0x07, "sp": 0xfffe}},
+		{"ret cc not taken", []uint8{0xcd, 0x54, 0x01, 0x76, 0xaf, 0xc0, 0x3e, 0x09, 0xc9}, map[string]int{"a": 0x09}},
+		{"jp hl", []uint8{0x21, 0x56, 0x01, 0xe9, 0x76, 0x76, 0x3e, 0x04}, map[string]int{"a": 0x04}},
+	}
+
+	for _, c := range cases {
+		// halt after everything
+		cpu := run(t, append(c.code, 0x76)...)
+		for name, value := range c.expected {
+			if actual, _ := cpu.Reg(name); actual != value {
+				t.Errorf("%s: expected %s = $%02x but got $%02x", c.name, name, value, actual)
+			}
+		}
+	}
+}
+
+func TestMemory(t *testing.T) {
+	cpu := run(t,
+		0x21, 0x00, 0xc0, // ld hl, $c000
+		0x3e, 0x42, // ld a, $42
+		0x22,       // ld (hl+), a
+		0x36, 0x43, // ld (hl), $43
+		0x2a,             // ld a, (hl+)
+		0xea, 0x10, 0xc0, // ld ($c010), a
+		0xe0, 0x80, // ldh ($80), a
+		0x0e, 0x81, // ld c, $81
+		0xe2,             // ld (c), a
+		0x08, 0x20, 0xc0, // ld ($c020), sp
+		0x76,
+	)
+	memory := cpu.Memory.(*FlatMemory)
+	expected := map[uint16]uint8{0xc000: 0x42, 0xc001: 0x43, 0xc010: 0x43, 0xff80: 0x43, 0xff81: 0x43, 0xc020: 0xfe, 0xc021: 0xff}
+	for addr, value := range expected {
+		if memory.RAM[addr] != value {
+			t.Errorf("expected $%02x at $%04x but got $%02x", value, addr, memory.RAM[addr])
+		}
+	}
+	if hl, _ := cpu.Reg("hl"); hl != 0xc002 {
+		t.Errorf("expected hl to be $c002 but got $%04x", hl)
+	}
+}
+
+func TestBanking(t *testing.T) {
+	rom := make([]uint8, 0x10000)
+	copy(rom[0x0150:], []uint8{
+		0xfa, 0x00, 0x40, // ld a, ($4000)
+		0x47,       // ld b, a
+		0x3e, 0x03, // ld a, 3
+		0xea, 0x00, 0x20, // ld ($2000), a
+		0xfa, 0x00, 0x40, // ld a, ($4000)
+		0x76,
+	})
+	rom[1*0x4000] = 0x11
+	rom[3*0x4000] = 0x33
+
+	cpu := New(rom)
+	cpu.PC = 0x0150
+	if _, err := cpu.Run(RunOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.B != 0x11 || cpu.A != 0x33 {
+		t.Errorf("expected $11 from bank 1 and $33 from bank 3 but got $%02x and $%02x", cpu.B, cpu.A)
+	}
+
+	// a hook can stand in for a different MBC
+	cpu = New(rom)
+	cpu.PC = 0x0150
+	cpu.Memory.(*FlatMemory).OnROMWrite = func(m *FlatMemory, addr uint16, value uint8) {}
+	if _, err := cpu.Run(RunOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.A != 0x11 {
+		t.Errorf("expected the hook to stop the bank switching but got $%02x", cpu.A)
+	}
+}
+
+func TestRun(t *testing.T) {
+	rom := make([]uint8, 0x8000)
+	copy(rom[0x0150:], []uint8{
+		0x00,       // nop
+		0x18, 0xfd, // jr $0150
+	})
+
+	cpu := New(rom)
+	cpu.PC = 0x0150
+	if reason, err := cpu.Run(RunOptions{MaxCycles: 100}); err != nil || reason != StopCycleLimit {
+		t.Fatalf("expected to hit the cycle limit but got '%s' (%v)", reason, err)
+	}
+	// 16 cycles per time around the loop, stopping after the 7th nop
+	if cpu.Cycles != 100 {
+		t.Errorf("expected 100 cycles but got %d", cpu.Cycles)
+	}
+
+	breakpoints := map[uint16]bool{0x0151: true}
+	for i := 0; i < 2; i++ {
+		if reason, err := cpu.Run(RunOptions{Breakpoints: breakpoints}); err != nil || reason != StopBreakpoint || cpu.PC != 0x0151 {
+			t.Fatalf("expected to stop at the breakpoint but got '%s' at $%04x (%v)", reason, cpu.PC, err)
+		}
+	}
+
+	// from the start of the ROM, where the header jumps to $0150
+	rom[0x0100], rom[0x0101], rom[0x0102], rom[0x0103] = 0x00, 0xc3, 0x50, 0x01
+	cpu = New(rom)
+	if _, err := cpu.Run(RunOptions{Breakpoints: map[uint16]bool{0x0150: true}}); err != nil || cpu.Cycles != 20 {
+		t.Errorf("expected to get to $0150 in 20 cycles but took %d (%v)", cpu.Cycles, err)
+	}
+
+	rom[0x0150], rom[0x0028] = 0xef, 0x76 // rst $28, which halts
+	cpu = New(rom)
+	cpu.PC = 0x0150
+	if _, err := cpu.Run(RunOptions{}); err != nil || cpu.PC != 0x0029 || cpu.read16(cpu.SP) != 0x0151 {
+		t.Errorf("expected rst to call $0028 but got to $%04x (%v)", cpu.PC, err)
+	}
+
+	rom[0x0150] = 0xd3
+	cpu = New(rom)
+	if _, err := cpu.Run(RunOptions{}); err == nil || err.Error() != "illegal opcode $d3 at $0150" {
+		t.Errorf("expected an illegal opcode error but got %v", err)
+	}
+}
@@ -0,0 +1,509 @@
+package sm83
+
+// Unprefixed is indexed by opcode; illegal opcodes and the $cb prefix are nil.
+var Unprefixed = [256]*Opcode{
+	0x00: op(4, "nop"),
+	0x01: op(12, "ld bc, n16"),
+	0x02: op(8, "ld (bc), a"),
+	0x03: op(8, "inc bc"),
+	0x04: op(4, "inc b"),
+	0x05: op(4, "dec b"),
+	0x06: op(8, "ld b, n8"),
+	0x07: op(4, "rlca"),
+	0x08: op(20, "ld (a16), sp"),
+	0x09: op(8, "add hl, bc"),
+	0x0a: op(8, "ld a, (bc)"),
+	0x0b: op(8, "dec bc"),
+	0x0c: op(4, "inc c"),
+	0x0d: op(4, "dec c"),
+	0x0e: op(8, "ld c, n8"),
+	0x0f: op(4, "rrca"),
+	0x10: {Mnemonic: "stop", Length: 2, Cycles: 4}, // the second byte is always $00
+	0x11: op(12, "ld de, n16"),
+	0x12: op(8, "ld (de), a"),
+	0x13: op(8, "inc de"),
+	0x14: op(4, "inc d"),
+	0x15: op(4, "dec d"),
+	0x16: op(8, "ld d, n8"),
+	0x17: op(4, "rla"),
+	0x18: op(12, "jr rel"),
+	0x19: op(8, "add hl, de"),
+	0x1a: op(8, "ld a, (de)"),
+	0x1b: op(8, "dec de"),
+	0x1c: op(4, "inc e"),
+	0x1d: op(4, "dec e"),
+	0x1e: op(8, "ld e, n8"),
+	0x1f: op(4, "rra"),
+	0x20: cond(8, 12, "jr nz, rel"),
+	0x21: op(12, "ld hl, n16"),
+	0x22: op(8, "ld (hl+), a"),
+	0x23: op(8, "inc hl"),
+	0x24: op(4, "inc h"),
+	0x25: op(4, "dec h"),
+	0x26: op(8, "ld h, n8"),
+	0x27: op(4, "daa"),
+	0x28: cond(8, 12, "jr z, rel"),
+	0x29: op(8, "add hl, hl"),
+	0x2a: op(8, "ld a, (hl+)"),
+	0x2b: op(8, "dec hl"),
+	0x2c: op(4, "inc l"),
+	0x2d: op(4, "dec l"),
+	0x2e: op(8, "ld l, n8"),
+	0x2f: op(4, "cpl"),
+	0x30: cond(8, 12, "jr nc, rel"),
+	0x31: op(12, "ld sp, n16"),
+	0x32: op(8, "ld (hl-), a"),
+	0x33: op(8, "inc sp"),
+	0x34: op(12, "inc (hl)"),
+	0x35: op(12, "dec (hl)"),
+	0x36: op(12, "ld (hl), n8"),
+	0x37: op(4, "scf"),
+	0x38: cond(8, 12, "jr c, rel"),
+	0x39: op(8, "add hl, sp"),
+	0x3a: op(8, "ld a, (hl-)"),
+	0x3b: op(8, "dec sp"),
+	0x3c: op(4, "inc a"),
+	0x3d: op(4, "dec a"),
+	0x3e: op(8, "ld a, n8"),
+	0x3f: op(4, "ccf"),
+	0x40: op(4, "ld b, b"),
+	0x41: op(4, "ld b, c"),
+	0x42: op(4, "ld b, d"),
+	0x43: op(4, "ld b, e"),
+	0x44: op(4, "ld b, h"),
+	0x45: op(4, "ld b, l"),
+	0x46: op(8, "ld b, (hl)"),
+	0x47: op(4, "ld b, a"),
+	0x48: op(4, "ld c, b"),
+	0x49: op(4, "ld c, c"),
+	0x4a: op(4, "ld c, d"),
+	0x4b: op(4, "ld c, e"),
+	0x4c: op(4, "ld c, h"),
+	0x4d: op(4, "ld c, l"),
+	0x4e: op(8, "ld c, (hl)"),
+	0x4f: op(4, "ld c, a"),
+	0x50: op(4, "ld d, b"),
+	0x51: op(4, "ld d, c"),
+	0x52: op(4, "ld d, d"),
+	0x53: op(4, "ld d, e"),
+	0x54: op(4, "ld d, h"),
+	0x55: op(4, "ld d, l"),
+	0x56: op(8, "ld d, (hl)"),
+	0x57: op(4, "ld d, a"),
+	0x58: op(4, "ld e, b"),
+	0x59: op(4, "ld e, c"),
+	0x5a: op(4, "ld e, d"),
+	0x5b: op(4, "ld e, e"),
+	0x5c: op(4, "ld e, h"),
+	0x5d: op(4, "ld e, l"),
+	0x5e: op(8, "ld e, (hl)"),
+	0x5f: op(4, "ld e, a"),
+	0x60: op(4, "ld h, b"),
+	0x61: op(4, "ld h, c"),
+	0x62: op(4, "ld h, d"),
+	0x63: op(4, "ld h, e"),
+	0x64: op(4, "ld h, h"),
+	0x65: op(4, "ld h, l"),
+	0x66: op(8, "ld h, (hl)"),
+	0x67: op(4, "ld h, a"),
+	0x68: op(4, "ld l, b"),
+	0x69: op(4, "ld l, c"),
+	0x6a: op(4, "ld l, d"),
+	0x6b: op(4, "ld l, e"),
+	0x6c: op(4, "ld l, h"),
+	0x6d: op(4, "ld l, l"),
+	0x6e: op(8, "ld l, (hl)"),
+	0x6f: op(4, "ld l, a"),
+	0x70: op(8, "ld (hl), b"),
+	0x71: op(8, "ld (hl), c"),
+	0x72: op(8, "ld (hl), d"),
+	0x73: op(8, "ld (hl), e"),
+	0x74: op(8, "ld (hl), h"),
+	0x75: op(8, "ld (hl), l"),
+	0x76: op(4, "halt"),
+	0x77: op(8, "ld (hl), a"),
+	0x78: op(4, "ld a, b"),
+	0x79: op(4, "ld a, c"),
+	0x7a: op(4, "ld a, d"),
+	0x7b: op(4, "ld a, e"),
+	0x7c: op(4, "ld a, h"),
+	0x7d: op(4, "ld a, l"),
+	0x7e: op(8, "ld a, (hl)"),
+	0x7f: op(4, "ld a, a"),
+	0x80: op(4, "add a, b"),
+	0x81: op(4, "add a, c"),
+	0x82: op(4, "add a, d"),
+	0x83: op(4, "add a, e"),
+	0x84: op(4, "add a, h"),
+	0x85: op(4, "add a, l"),
+	0x86: op(8, "add a, (hl)"),
+	0x87: op(4, "add a, a"),
+	0x88: op(4, "adc a, b"),
+	0x89: op(4, "adc a, c"),
+	0x8a: op(4, "adc a, d"),
+	0x8b: op(4, "adc a, e"),
+	0x8c: op(4, "adc a, h"),
+	0x8d: op(4, "adc a, l"),
+	0x8e: op(8, "adc a, (hl)"),
+	0x8f: op(4, "adc a, a"),
+	0x90: op(4, "sub b"),
+	0x91: op(4, "sub c"),
+	0x92: op(4, "sub d"),
+	0x93: op(4, "sub e"),
+	0x94: op(4, "sub h"),
+	0x95: op(4, "sub l"),
+	0x96: op(8, "sub (hl)"),
+	0x97: op(4, "sub a"),
+	0x98: op(4, "sbc a, b"),
+	0x99: op(4, "sbc a, c"),
+	0x9a: op(4, "sbc a, d"),
+	0x9b: op(4, "sbc a, e"),
+	0x9c: op(4, "sbc a, h"),
+	0x9d: op(4, "sbc a, l"),
+	0x9e: op(8, "sbc a, (hl)"),
+	0x9f: op(4, "sbc a, a"),
+	0xa0: op(4, "and b"),
+	0xa1: op(4, "and c"),
+	0xa2: op(4, "and d"),
+	0xa3: op(4, "and e"),
+	0xa4: op(4, "and h"),
+	0xa5: op(4, "and l"),
+	0xa6: op(8, "and (hl)"),
+	0xa7: op(4, "and a"),
+	0xa8: op(4, "xor b"),
+	0xa9: op(4, "xor c"),
+	0xaa: op(4, "xor d"),
+	0xab: op(4, "xor e"),
+	0xac: op(4, "xor h"),
+	0xad: op(4, "xor l"),
+	0xae: op(8, "xor (hl)"),
+	0xaf: op(4, "xor a"),
+	0xb0: op(4, "or b"),
+	0xb1: op(4, "or c"),
+	0xb2: op(4, "or d"),
+	0xb3: op(4, "or e"),
+	0xb4: op(4, "or h"),
+	0xb5: op(4, "or l"),
+	0xb6: op(8, "or (hl)"),
+	0xb7: op(4, "or a"),
+	0xb8: op(4, "cp b"),
+	0xb9: op(4, "cp c"),
+	0xba: op(4, "cp d"),
+	0xbb: op(4, "cp e"),
+	0xbc: op(4, "cp h"),
+	0xbd: op(4, "cp l"),
+	0xbe: op(8, "cp (hl)"),
+	0xbf: op(4, "cp a"),
+	0xc0: cond(8, 20, "ret nz"),
+	0xc1: op(12, "pop bc"),
+	0xc2: cond(12, 16, "jp nz, a16"),
+	0xc3: op(16, "jp a16"),
+	0xc4: cond(12, 24, "call nz, a16"),
+	0xc5: op(16, "push bc"),
+	0xc6: op(8, "add a, n8"),
+	0xc7: op(16, "rst $00"),
+	0xc8: cond(8, 20, "ret z"),
+	0xc9: op(16, "ret"),
+	0xca: cond(12, 16, "jp z, a16"),
+	0xcc: cond(12, 24, "call z, a16"),
+	0xcd: op(24, "call a16"),
+	0xce: op(8, "adc a, n8"),
+	0xcf: op(16, "rst $08"),
+	0xd0: cond(8, 20, "ret nc"),
+	0xd1: op(12, "pop de"),
+	0xd2: cond(12, 16, "jp nc, a16"),
+	0xd4: cond(12, 24, "call nc, a16"),
+	0xd5: op(16, "push de"),
+	0xd6: op(8, "sub n8"),
+	0xd7: op(16, "rst $10"),
+	0xd8: cond(8, 20, "ret c"),
+	0xd9: op(16, "reti"),
+	0xda: cond(12, 16, "jp c, a16"),
+	0xdc: cond(12, 24, "call c, a16"),
+	0xde: op(8, "sbc a, n8"),
+	0xdf: op(16, "rst $18"),
+	0xe0: op(12, "ldh (a8), a"),
+	0xe1: op(12, "pop hl"),
+	0xe2: op(8, "ld (c), a"),
+	0xe5: op(16, "push hl"),
+	0xe6: op(8, "and n8"),
+	0xe7: op(16, "rst $20"),
+	0xe8: op(16, "add sp, e8"),
+	0xe9: op(4, "jp hl"),
+	0xea: op(16, "ld (a16), a"),
+	0xee: op(8, "xor n8"),
+	0xef: op(16, "rst $28"),
+	0xf0: op(12, "ldh a, (a8)"),
+	0xf1: op(12, "pop af"),
+	0xf2: op(8, "ld a, (c)"),
+	0xf3: op(4, "di"),
+	0xf5: op(16, "push af"),
+	0xf6: op(8, "or n8"),
+	0xf7: op(16, "rst $30"),
+	0xf8: op(12, "ld hl, sp+e8"),
+	0xf9: op(8, "ld sp, hl"),
+	0xfa: op(16, "ld a, (a16)"),
+	0xfb: op(4, "ei"),
+	0xfe: op(8, "cp n8"),
+	0xff: op(16, "rst $38"),
+}
+
+// Prefixed is indexed by the byte after the $cb prefix.
+var Prefixed = [256]*Opcode{
+	0x00: op(8, "rlc b"),
+	0x01: op(8, "rlc c"),
+	0x02: op(8, "rlc d"),
+	0x03: op(8, "rlc e"),
+	0x04: op(8, "rlc h"),
+	0x05: op(8, "rlc l"),
+	0x06: op(16, "rlc (hl)"),
+	0x07: op(8, "rlc a"),
+	0x08: op(8, "rrc b"),
+	0x09: op(8, "rrc c"),
+	0x0a: op(8, "rrc d"),
+	0x0b: op(8, "rrc e"),
+	0x0c: op(8, "rrc h"),
+	0x0d: op(8, "rrc l"),
+	0x0e: op(16, "rrc (hl)"),
+	0x0f: op(8, "rrc a"),
+	0x10: op(8, "rl b"),
+	0x11: op(8, "rl c"),
+	0x12: op(8, "rl d"),
+	0x13: op(8, "rl e"),
+	0x14: op(8, "rl h"),
+	0x15: op(8, "rl l"),
+	0x16: op(16, "rl (hl)"),
+	0x17: op(8, "rl a"),
+	0x18: op(8, "rr b"),
+	0x19: op(8, "rr c"),
+	0x1a: op(8, "rr d"),
+	0x1b: op(8, "rr e"),
+	0x1c: op(8, "rr h"),
+	0x1d: op(8, "rr l"),
+	0x1e: op(16, "rr (hl)"),
+	0x1f: op(8, "rr a"),
+	0x20: op(8, "sla b"),
+	0x21: op(8, "sla c"),
+	0x22: op(8, "sla d"),
+	0x23: op(8, "sla e"),
+	0x24: op(8, "sla h"),
+	0x25: op(8, "sla l"),
+	0x26: op(16, "sla (hl)"),
+	0x27: op(8, "sla a"),
+	0x28: op(8, "sra b"),
+	0x29: op(8, "sra c"),
+	0x2a: op(8, "sra d"),
+	0x2b: op(8, "sra e"),
+	0x2c: op(8, "sra h"),
+	0x2d: op(8, "sra l"),
+	0x2e: op(16, "sra (hl)"),
+	0x2f: op(8, "sra a"),
+	0x30: op(8, "swap b"),
+	0x31: op(8, "swap c"),
+	0x32: op(8, "swap d"),
+	0x33: op(8, "swap e"),
+	0x34: op(8, "swap h"),
+	0x35: op(8, "swap l"),
+	0x36: op(16, "swap (hl)"),
+	0x37: op(8, "swap a"),
+	0x38: op(8, "srl b"),
+	0x39: op(8, "srl c"),
+	0x3a: op(8, "srl d"),
+	0x3b: op(8, "srl e"),
+	0x3c: op(8, "srl h"),
+	0x3d: op(8, "srl l"),
+	0x3e: op(16, "srl (hl)"),
+	0x3f: op(8, "srl a"),
+	0x40: op(8, "bit 0, b"),
+	0x41: op(8, "bit 0, c"),
+	0x42: op(8, "bit 0, d"),
+	0x43: op(8, "bit 0, e"),
+	0x44: op(8, "bit 0, h"),
+	0x45: op(8, "bit 0, l"),
+	0x46: op(12, "bit 0, (hl)"),
+	0x47: op(8, "bit 0, a"),
+	0x48: op(8, "bit 1, b"),
+	0x49: op(8, "bit 1, c"),
+	0x4a: op(8, "bit 1, d"),
+	0x4b: op(8, "bit 1, e"),
+	0x4c: op(8, "bit 1, h"),
+	0x4d: op(8, "bit 1, l"),
+	0x4e: op(12, "bit 1, (hl)"),
+	0x4f: op(8, "bit 1, a"),
+	0x50: op(8, "bit 2, b"),
+	0x51: op(8, "bit 2, c"),
+	0x52: op(8, "bit 2, d"),
+	0x53: op(8, "bit 2, e"),
+	0x54: op(8, "bit 2, h"),
+	0x55: op(8, "bit 2, l"),
+	0x56: op(12, "bit 2, (hl)"),
+	0x57: op(8, "bit 2, a"),
+	0x58: op(8, "bit 3, b"),
+	0x59: op(8, "bit 3, c"),
+	0x5a: op(8, "bit 3, d"),
+	0x5b: op(8, "bit 3, e"),
+	0x5c: op(8, "bit 3, h"),
+	0x5d: op(8, "bit 3, l"),
+	0x5e: op(12, "bit 3, (hl)"),
+	0x5f: op(8, "bit 3, a"),
+	0x60: op(8, "bit 4, b"),
+	0x61: op(8, "bit 4, c"),
+	0x62: op(8, "bit 4, d"),
+	0x63: op(8, "bit 4, e"),
+	0x64: op(8, "bit 4, h"),
+	0x65: op(8, "bit 4, l"),
+	0x66: op(12, "bit 4, (hl)"),
+	0x67: op(8, "bit 4, a"),
+	0x68: op(8, "bit 5, b"),
+	0x69: op(8, "bit 5, c"),
+	0x6a: op(8, "bit 5, d"),
+	0x6b: op(8, "bit 5, e"),
+	0x6c: op(8, "bit 5, h"),
+	0x6d: op(8, "bit 5, l"),
+	0x6e: op(12, "bit 5, (hl)"),
+	0x6f: op(8, "bit 5, a"),
+	0x70: op(8, "bit 6, b"),
+	0x71: op(8, "bit 6, c"),
+	0x72: op(8, "bit 6, d"),
+	0x73: op(8, "bit 6, e"),
+	0x74: op(8, "bit 6, h"),
+	0x75: op(8, "bit 6, l"),
+	0x76: op(12, "bit 6, (hl)"),
+	0x77: op(8, "bit 6, a"),
+	0x78: op(8, "bit 7, b"),
+	0x79: op(8, "bit 7, c"),
+	0x7a: op(8, "bit 7, d"),
+	0x7b: op(8, "bit 7, e"),
+	0x7c: op(8, "bit 7, h"),
+	0x7d: op(8, "bit 7, l"),
+	0x7e: op(12, "bit 7, (hl)"),
+	0x7f: op(8, "bit 7, a"),
+	0x80: op(8, "res 0, b"),
+	0x81: op(8, "res 0, c"),
+	0x82: op(8, "res 0, d"),
+	0x83: op(8, "res 0, e"),
+	0x84: op(8, "res 0, h"),
+	0x85: op(8, "res 0, l"),
+	0x86: op(16, "res 0, (hl)"),
+	0x87: op(8, "res 0, a"),
+	0x88: op(8, "res 1, b"),
+	0x89: op(8, "res 1, c"),
+	0x8a: op(8, "res 1, d"),
+	0x8b: op(8, "res 1, e"),
+	0x8c: op(8, "res 1, h"),
+	0x8d: op(8, "res 1, l"),
+	0x8e: op(16, "res 1, (hl)"),
+	0x8f: op(8, "res 1, a"),
+	0x90: op(8, "res 2, b"),
+	0x91: op(8, "res 2, c"),
+	0x92: op(8, "res 2, d"),
+	0x93: op(8, "res 2, e"),
+	0x94: op(8, "res 2, h"),
+	0x95: op(8, "res 2, l"),
+	0x96: op(16, "res 2, (hl)"),
+	0x97: op(8, "res 2, a"),
+	0x98: op(8, "res 3, b"),
+	0x99: op(8, "res 3, c"),
+	0x9a: op(8, "res 3, d"),
+	0x9b: op(8, "res 3, e"),
+	0x9c: op(8, "res 3, h"),
+	0x9d: op(8, "res 3, l"),
+	0x9e: op(16, "res 3, (hl)"),
+	0x9f: op(8, "res 3, a"),
+	0xa0: op(8, "res 4, b"),
+	0xa1: op(8, "res 4, c"),
+	0xa2: op(8, "res 4, d"),
+	0xa3: op(8, "res 4, e"),
+	0xa4: op(8, "res 4, h"),
+	0xa5: op(8, "res 4, l"),
+	0xa6: op(16, "res 4, (hl)"),
+	0xa7: op(8, "res 4, a"),
+	0xa8: op(8, "res 5, b"),
+	0xa9: op(8, "res 5, c"),
+	0xaa: op(8, "res 5, d"),
+	0xab: op(8, "res 5, e"),
+	0xac: op(8, "res 5, h"),
+	0xad: op(8, "res 5, l"),
+	0xae: op(16, "res 5, (hl)"),
+	0xaf: op(8, "res 5, a"),
+	0xb0: op(8, "res 6, b"),
+	0xb1: op(8, "res 6, c"),
+	0xb2: op(8, "res 6, d"),
+	0xb3: op(8, "res 6, e"),
+	0xb4: op(8, "res 6, h"),
+	0xb5: op(8, "res 6, l"),
+	0xb6: op(16, "res 6, (hl)"),
+	0xb7: op(8, "res 6, a"),
+	0xb8: op(8, "res 7, b"),
+	0xb9: op(8, "res 7, c"),
+	0xba: op(8, "res 7, d"),
+	0xbb: op(8, "res 7, e"),
+	0xbc: op(8, "res 7, h"),
+	0xbd: op(8, "res 7, l"),
+	0xbe: op(16, "res 7, (hl)"),
+	0xbf: op(8, "res 7, a"),
+	0xc0: op(8, "set 0, b"),
+	0xc1: op(8, "set 0, c"),
+	0xc2: op(8, "set 0, d"),
+	0xc3: op(8, "set 0, e"),
+	0xc4: op(8, "set 0, h"),
+	0xc5: op(8, "set 0, l"),
+	0xc6: op(16, "set 0, (hl)"),
+	0xc7: op(8, "set 0, a"),
+	0xc8: op(8, "set 1, b"),
+	0xc9: op(8, "set 1, c"),
+	0xca: op(8, "set 1, d"),
+	0xcb: op(8, "set 1, e"),
+	0xcc: op(8, "set 1, h"),
+	0xcd: op(8, "set 1, l"),
+	0xce: op(16, "set 1, (hl)"),
+	0xcf: op(8, "set 1, a"),
+	0xd0: op(8, "set 2, b"),
+	0xd1: op(8, "set 2, c"),
+	0xd2: op(8, "set 2, d"),
+	0xd3: op(8, "set 2, e"),
+	0xd4: op(8, "set 2, h"),
+	0xd5: op(8, "set 2, l"),
+	0xd6: op(16, "set 2, (hl)"),
+	0xd7: op(8, "set 2, a"),
+	0xd8: op(8, "set 3, b"),
+	0xd9: op(8, "set 3, c"),
+	0xda: op(8, "set 3, d"),
+	0xdb: op(8, "set 3, e"),
+	0xdc: op(8, "set 3, h"),
+	0xdd: op(8, "set 3, l"),
+	0xde: op(16, "set 3, (hl)"),
+	0xdf: op(8, "set 3, a"),
+	0xe0: op(8, "set 4, b"),
+	0xe1: op(8, "set 4, c"),
+	0xe2: op(8, "set 4, d"),
+	0xe3: op(8, "set 4, e"),
+	0xe4: op(8, "set 4, h"),
+	0xe5: op(8, "set 4, l"),
+	0xe6: op(16, "set 4, (hl)"),
+	0xe7: op(8, "set 4, a"),
+	0xe8: op(8, "set 5, b"),
+	0xe9: op(8, "set 5, c"),
+	0xea: op(8, "set 5, d"),
+	0xeb: op(8, "set 5, e"),
+	0xec: op(8, "set 5, h"),
+	0xed: op(8, "set 5, l"),
+	0xee: op(16, "set 5, (hl)"),
+	0xef: op(8, "set 5, a"),
+	0xf0: op(8, "set 6, b"),
+	0xf1: op(8, "set 6, c"),
+	0xf2: op(8, "set 6, d"),
+	0xf3: op(8, "set 6, e"),
+	0xf4: op(8, "set 6, h"),
+	0xf5: op(8, "set 6, l"),
+	0xf6: op(16, "set 6, (hl)"),
+	0xf7: op(8, "set 6, a"),
+	0xf8: op(8, "set 7, b"),
+	0xf9: op(8, "set 7, c"),
+	0xfa: op(8, "set 7, d"),
+	0xfb: op(8, "set 7, e"),
+	0xfc: op(8, "set 7, h"),
+	0xfd: op(8, "set 7, l"),
+	0xfe: op(16, "set 7, (hl)"),
+	0xff: op(8, "set 7, a"),
+}
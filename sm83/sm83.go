@@ -0,0 +1,136 @@
+// Package sm83 describes the instruction set of the Game Boy's CPU, so the
+// assembler, disassembler and anything that counts cycles agree on it.
+package sm83
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Operands in the opcode tables are either one of these placeholders or are
+// matched literally: registers, conditions, '(hl+)' and the fixed numbers of
+// 'rst' and 'bit'.
+const (
+	Imm8     = "n8"    // unsigned byte
+	Imm16    = "n16"   // little-endian word
+	Addr16   = "a16"   // jp and call targets
+	Mem8     = "(a8)"  // $ff00-$ffff, stored as the low byte
+	Mem16    = "(a16)" // any address
+	Offset8  = "e8"    // signed byte, as in 'add sp, e8'
+	SPOffset = "sp+e8" // signed byte added to sp
+	Rel8     = "rel"   // jr target, stored relative to the next instruction
+)
+
+type Opcode struct {
+	Mnemonic string
+	Operands []string
+	Code     uint8
+	Prefixed bool
+	// bytes including the prefix and operands
+	Length int
+	// in clock cycles (4 per machine cycle). Conditional jumps, calls and
+	// returns take CyclesTaken instead when the condition holds.
+	Cycles      int
+	CyclesTaken int
+}
+
+var byMnemonic = make(map[string][]*Opcode)
+
+// operands spelled out literally in the tables, other than fixed numbers
+var keywords = make(map[string]bool)
+
+func init() {
+	for code, opcode := range Unprefixed {
+		if opcode != nil {
+			opcode.Code = uint8(code)
+			byMnemonic[opcode.Mnemonic] = append(byMnemonic[opcode.Mnemonic], opcode)
+			addKeywords(opcode)
+		}
+	}
+	for code, opcode := range Prefixed {
+		opcode.Code = uint8(code)
+		opcode.Prefixed = true
+		opcode.Length++
+		byMnemonic[opcode.Mnemonic] = append(byMnemonic[opcode.Mnemonic], opcode)
+		addKeywords(opcode)
+	}
+}
+
+func addKeywords(opcode *Opcode) {
+	for _, operand := range opcode.Operands {
+		if _, isFixed := FixedValue(operand); !isFixed && !IsPlaceholder(operand) {
+			keywords[operand] = true
+		}
+	}
+}
+
+// op parses an entry like "ld a, n8"
+func op(cycles int, text string) *Opcode {
+	opcode := &Opcode{Mnemonic: text, Length: 1, Cycles: cycles}
+	if i := strings.Index(text, " "); i >= 0 {
+		opcode.Mnemonic = text[:i]
+		opcode.Operands = strings.Split(text[i+1:], ", ")
+	}
+	for _, operand := range opcode.Operands {
+		opcode.Length += OperandSize(operand)
+	}
+	return opcode
+}
+
+func cond(cycles, cyclesTaken int, text string) *Opcode {
+	opcode := op(cycles, text)
+	opcode.CyclesTaken = cyclesTaken
+	return opcode
+}
+
+// Lookup returns every opcode with the given mnemonic, unprefixed ones first
+// and each in opcode order.
+func Lookup(mnemonic string) []*Opcode {
+	return byMnemonic[mnemonic]
+}
+
+// OperandSize is how many bytes an operand adds to an instruction.
+func OperandSize(operand string) int {
+	switch operand {
+	case Imm8, Mem8, Offset8, SPOffset, Rel8:
+		return 1
+	case Imm16, Addr16, Mem16:
+		return 2
+	}
+	return 0
+}
+
+// IsPlaceholder is true for operands that stand for a value in the
+// instruction's bytes.
+func IsPlaceholder(operand string) bool {
+	return OperandSize(operand) > 0
+}
+
+// IsKeyword is true for registers, conditions and the other operands that
+// are matched literally, like '(hl+)' and '(c)'.
+func IsKeyword(operand string) bool {
+	return keywords[operand]
+}
+
+// FixedValue is the number a literal operand stands for, like the 3 in
+// 'bit 3, a' or the $38 in 'rst $38'.
+func FixedValue(operand string) (int, bool) {
+	base := 10
+	text := operand
+	if strings.HasPrefix(operand, "$") {
+		base = 16
+		text = operand[1:]
+	}
+	value, err := strconv.ParseInt(text, base, 32)
+	if err != nil {
+		return 0, false
+	}
+	return int(value), true
+}
+
+func (o *Opcode) String() string {
+	if len(o.Operands) == 0 {
+		return o.Mnemonic
+	}
+	return o.Mnemonic + " " + strings.Join(o.Operands, ", ")
+}
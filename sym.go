@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// formats for WriteSymbols
+const (
+	// 'bank:addr label' lines as read by most emulators, with constants
+	// in bank 0
+	SymbolFormatRGBDS = "rgbds"
+	// the same lines in the [labels] section that no$gmb and BGB expect,
+	// with constants under [definitions]
+	SymbolFormatNoGMB = "nogmb"
+)
+
+// no$gmb ignores anything longer
+const noGMBMaxLabel = 32
+
+type symbol struct {
+	Bank int
+	Addr int
+	Name string
+}
+
+// WriteSymbols writes a .sym file with every label, including RAM ones, and
+// every equ constant that fits in 16 bits, because they're often I/O
+// registers. Everything is in bank and address order.
+func WriteSymbols(w io.Writer, labelOffsets labelOffsets, constants map[string]int, format string) error {
+	if format != SymbolFormatRGBDS && format != SymbolFormatNoGMB {
+		return errors.New(fmt.Sprintf("unknown symbol file format '%s' (expected %s or %s)", format, SymbolFormatRGBDS, SymbolFormatNoGMB))
+	}
+
+	labels := []symbol{}
+	for _, labelOffset := range labelOffsets {
+		labels = append(labels, symbol{labelOffset.Bank, int(labelOffset.Offset), labelOffset.Label})
+	}
+	definitions := []symbol{}
+	for name, value := range constants {
+		if value >= 0 && value <= 0xffff {
+			definitions = append(definitions, symbol{0, value, name})
+		}
+	}
+	sortSymbols(labels)
+	sortSymbols(definitions)
+
+	out := bufio.NewWriter(w)
+	if format == SymbolFormatNoGMB {
+		fmt.Fprintln(out, "; no$gmb format .sym file generated by gbasm")
+		fmt.Fprintln(out, "")
+		fmt.Fprintln(out, "[labels]")
+		for _, label := range labels {
+			if len(label.Name) > noGMBMaxLabel {
+				label.Name = label.Name[:noGMBMaxLabel]
+			}
+			fmt.Fprintf(out, "%02x:%04x %s\n", label.Bank, label.Addr, label.Name)
+		}
+		fmt.Fprintln(out, "")
+		fmt.Fprintln(out, "[definitions]")
+		for _, definition := range definitions {
+			fmt.Fprintf(out, "%08x %s\n", definition.Addr, definition.Name)
+		}
+	} else {
+		symbols := append(labels, definitions...)
+		sortSymbols(symbols)
+		fmt.Fprintln(out, "; generated by gbasm")
+		for _, symbol := range symbols {
+			fmt.Fprintf(out, "%02x:%04x %s\n", symbol.Bank, symbol.Addr, symbol.Name)
+		}
+	}
+	return out.Flush()
+}
+
+func sortSymbols(symbols []symbol) {
+	sort.Slice(symbols, func(i, j int) bool {
+		a, b := symbols[i], symbols[j]
+		if a.Bank != b.Bank {
+			return a.Bank < b.Bank
+		} else if a.Addr != b.Addr {
+			return a.Addr < b.Addr
+		}
+		return a.Name < b.Name
+	})
+}
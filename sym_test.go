@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteSymbols(t *testing.T) {
+	lines := []string{
+		"rlcdc equ $ff40",
+		"big equ $12345",
+		"screen_w set 160",
+		".main",
+		"  call far",
+		".far:romx",
+		"  ret",
+		".player:wram0",
+		"  ds 2",
+		".joypad:hram",
+		"  ds 1",
+		".save:sram:bank=1",
+		"  ds 1",
+		"  for i, 3",
+		".row{i}:wram0",
+		"  ds screen_w / 8",
+		"  endr",
+	}
+	unit := parseUnit(t, lines)
+	_, labelOffsets, diags := Compile(unit, CompileOptions{MBC: "mbc5"})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	var out bytes.Buffer
+	if err := WriteSymbols(&out, labelOffsets, unit.Constants, SymbolFormatRGBDS); err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join([]string{
+		"; generated by gbasm",
+		"00:0150 main",
+		"00:c000 player",
+		"00:c002 row0",
+		"00:c016 row1",
+		"00:c02a row2",
+		"00:ff40 rlcdc",
+		"00:ff80 joypad",
+		"01:4000 far",
+		"01:a000 save",
+		"",
+	}, "\n")
+	if out.String() != expected {
+		t.Errorf("expected\n%s\nbut got\n%s", expected, out.String())
+	}
+
+	out.Reset()
+	if err := WriteSymbols(&out, labelOffsets, unit.Constants, SymbolFormatNoGMB); err != nil {
+		t.Fatal(err)
+	}
+	expected = strings.Join([]string{
+		"; no$gmb format .sym file generated by gbasm",
+		"",
+		"[labels]",
+		"00:0150 main",
+		"00:c000 player",
+		"00:c002 row0",
+		"00:c016 row1",
+		"00:c02a row2",
+		"00:ff80 joypad",
+		"01:4000 far",
+		"01:a000 save",
+		"",
+		"[definitions]",
+		"0000ff40 rlcdc",
+		"",
+	}, "\n")
+	if out.String() != expected {
+		t.Errorf("expected\n%s\nbut got\n%s", expected, out.String())
+	}
+
+	// only labels and equ constants, not the set and for variables
+	for _, name := range []string{"screen_w", " i\n", "_narg"} {
+		if strings.Contains(out.String(), name) {
+			t.Errorf("expected '%s' not to be in the symbols", name)
+		}
+	}
+
+	if err := WriteSymbols(&out, labelOffsets, nil, "bgb"); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}